@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Roles and per-album access control. Albums without an ACL, in themselves or an album above them, stay public.
+// Without a users file everyone may do everything, as before.
+
+type userRole int
+
+const (
+	// May view what album ACLs allow:
+	roleViewer userRole = iota
+	// May also upload, delete and edit in the albums they can view, unless an album names its contributors:
+	roleContributor
+	// May view and change everything:
+	roleAdmin
+)
+
+func parseUserRole(s string) (userRole, error) {
+	switch strings.ToLower(s) {
+	case "viewer":
+		return roleViewer, nil
+	case "contributor", "":
+		return roleContributor, nil
+	case "admin":
+		return roleAdmin, nil
+	default:
+		return roleViewer, fmt.Errorf(`unknown role '%s'; expected "viewer", "contributor" or "admin"`, s)
+	}
+}
+
+// Access to an album and the albums below it, unless one of those has its own, e.g.
+// `"albums": {"family": {"viewers": ["grandma"], "contributors": ["ryan"]}}` in the users file:
+type AlbumACL struct {
+	// Anyone, signed in or not, may view:
+	Public bool `json:"public,omitempty"`
+	// Users who may view:
+	Viewers []string `json:"viewers,omitempty"`
+	// Users who may view and, if their role allows, change; if empty, any contributor who may view can change:
+	Contributors []string `json:"contributors,omitempty"`
+}
+
+func hasString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The ACL governing `album`: its own or that of the nearest album above it; nil if none does:
+func (a *Accounts) albumACL(album string) *AlbumACL {
+	for {
+		if acl, ok := a.acls[album]; ok {
+			return acl
+		}
+		if album == "" {
+			return nil
+		}
+		album = albumOf(album)
+	}
+}
+
+func requestRole(req *http.Request) (string, userRole) {
+	user := currentUser(req)
+	if user == "" {
+		return "", roleViewer
+	}
+	return user, accounts.roles[user]
+}
+
+func canViewAlbum(req *http.Request, album string) bool {
+	if accounts == nil {
+		return true
+	}
+	acl := accounts.albumACL(album)
+	if acl == nil || acl.Public {
+		return true
+	}
+	user, role := requestRole(req)
+	if user == "" {
+		return false
+	}
+	return role == roleAdmin || hasString(acl.Viewers, user) || hasString(acl.Contributors, user)
+}
+
+func canEditAlbum(req *http.Request, album string) bool {
+	if accounts == nil {
+		return true
+	}
+	user, role := requestRole(req)
+	switch {
+	case user == "" || role == roleViewer:
+		return false
+	case role == roleAdmin:
+		return true
+	case !canViewAlbum(req, album):
+		return false
+	}
+	acl := accounts.albumACL(album)
+	return acl == nil || len(acl.Contributors) == 0 || hasString(acl.Contributors, user)
+}
+
+// Reports whether anyone, signed in or not, may view `album`:
+func isPublicAlbum(album string) bool {
+	if accounts == nil {
+		return true
+	}
+	acl := accounts.albumACL(album)
+	return acl == nil || acl.Public
+}
+
+// Keeps shared caches, e.g. a caching reverse proxy, from handing out what not everyone may view; files fetched by
+// share link are not cached at all, so each download goes through the link:
+func restrictCaching(rsp http.ResponseWriter, rel string, shared bool) {
+	switch {
+	case shared:
+		rsp.Header().Set("Cache-Control", "no-store")
+	case !isPublicAlbum(rel):
+		rsp.Header().Set("Cache-Control", "private")
+	}
+}
+
+func isAdmin(req *http.Request) bool {
+	if accounts == nil {
+		return true
+	}
+	user, role := requestRole(req)
+	return user != "" && role == roleAdmin
+}
+
+// Albums the requestor may not view look the same as albums that do not exist:
+func requireViewAlbum(req *http.Request, album string) error {
+	if !canViewAlbum(req, album) {
+		return NewHttpError(http.StatusNotFound, "Album not found", fmt.Errorf("'%s' may not view album '%s'", currentUser(req), album))
+	}
+	return nil
+}
+
+func requireEditAlbum(req *http.Request, album string) error {
+	if !canEditAlbum(req, album) {
+		return NewHttpError(http.StatusForbidden, "You may not change pictures in this album", fmt.Errorf("'%s' may not change album '%s'", currentUser(req), album))
+	}
+	return nil
+}
+
+// Pictures in albums the requestor may not view look the same as pictures that do not exist:
+func requireViewPic(req *http.Request, rel string) error {
+	if !canViewAlbum(req, albumOf(rel)) {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("'%s' may not view '%s'", currentUser(req), rel))
+	}
+	return nil
+}
+
+func requireEditPics(req *http.Request, names []string) error {
+	for _, name := range names {
+		if err := requireEditAlbum(req, albumOf(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func requireAdmin(req *http.Request) error {
+	if !isAdmin(req) {
+		return NewHttpError(http.StatusForbidden, "Only administrators may do that", fmt.Errorf("'%s' is not an administrator", currentUser(req)))
+	}
+	return nil
+}
+
+func requireContributor(req *http.Request) error {
+	if accounts == nil {
+		return nil
+	}
+	if user, role := requestRole(req); user == "" || role < roleContributor {
+		return NewHttpError(http.StatusForbidden, "You may not change pictures", fmt.Errorf("'%s' is not a contributor", user))
+	}
+	return nil
+}
+
+// Drops the sub-albums of `album` the requestor may not view:
+func visibleEntries(req *http.Request, album string, fis []os.FileInfo) []os.FileInfo {
+	if accounts == nil {
+		return fis
+	}
+	visible := make([]os.FileInfo, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() && !canViewAlbum(req, path.Join(album, fi.Name())) {
+			continue
+		}
+		visible = append(visible, fi)
+	}
+	return visible
+}
+
+// Keeps the pictures the requestor may view, preserving order:
+func visiblePics(req *http.Request, names []string) []string {
+	if accounts == nil {
+		return names
+	}
+	visible := make([]string, 0, len(names))
+	for _, name := range names {
+		if canViewAlbum(req, albumOf(name)) {
+			visible = append(visible, name)
+		}
+	}
+	return visible
+}
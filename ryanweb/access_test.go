@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Family pictures are for the family, except the party; shared pictures may only be changed by carol:
+const testACLUsers = `{"users":[
+	{"name":"ryan","passwordHash":"` + testPasswordHash + `","role":"admin"},
+	{"name":"bob","passwordHash":"` + testPasswordHash + `","role":"contributor"},
+	{"name":"carol","passwordHash":"` + testPasswordHash + `","role":"contributor"},
+	{"name":"vic","passwordHash":"` + testPasswordHash + `","role":"viewer"}],
+	"albums":{
+		"family":{"viewers":["vic"],"contributors":["bob"]},
+		"family/party":{"public":true},
+		"shared":{"public":true,"contributors":["carol"]}}}`
+
+// A request signed in as `user`, or anonymous if empty:
+func testUserRequest(user string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	if user == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sessions.Create(user)))
+}
+
+func TestAlbumACLInheritance(t *testing.T) {
+	setupTestAccounts(t, testACLUsers)
+	family, party, shared := accounts.acls["family"], accounts.acls["family/party"], accounts.acls["shared"]
+	for album, want := range map[string]*AlbumACL{"": nil, "trips/2024": nil, "family": family, "family/kids": family,
+		"family/kids/2024": family, "family/party": party, "family/party/cake": party, "familyx": nil, "shared/sub": shared} {
+		if got := accounts.albumACL(album); got != want {
+			t.Errorf("albumACL(%q) = %+v, want %+v", album, got, want)
+		}
+	}
+}
+
+func TestAlbumAccessMatrix(t *testing.T) {
+	setupTestAccounts(t, testACLUsers)
+	// Per user, in the order anonymous, vic, bob, carol, ryan: "v" may view, "e" may also edit,
+	// "s" may do anything as an admin, "-" neither:
+	users := []string{"", "vic", "bob", "carol", "ryan"}
+	tests := []struct {
+		album  string
+		access string
+	}{
+		{"", "vvees"},
+		{"trips/2024", "vvees"},
+		{"family", "-ve-s"},
+		{"family/kids", "-ve-s"},
+		{"family/party", "vvees"},
+		{"shared", "vvves"},
+		{"shared/sub", "vvves"},
+	}
+	for _, tt := range tests {
+		for i, user := range users {
+			req := testUserRequest(user)
+			got := "-"
+			switch view, edit := canViewAlbum(req, tt.album), canEditAlbum(req, tt.album); {
+			case edit && isAdmin(req):
+				got = "s"
+			case edit && !view:
+				got = "!"
+			case edit:
+				got = "e"
+			case view:
+				got = "v"
+			}
+			if want := tt.access[i : i+1]; got != want {
+				t.Errorf("%q as %q: got %q, want %q", tt.album, user, got, want)
+			}
+		}
+	}
+
+	// Without accounts, everyone may do everything:
+	accounts = nil
+	req := testUserRequest("")
+	if !canViewAlbum(req, "family") || !canEditAlbum(req, "family") || !isAdmin(req) {
+		t.Error("access denied without accounts")
+	}
+}
+
+func TestVisibleEntries(t *testing.T) {
+	setupTestStores(t)
+	setupTestAccounts(t, testACLUsers)
+	for _, rel := range []string{"a.jpg", "family/b.jpg", "family/party/c.jpg", "family/kids/d.jpg", "shared/e.jpg"} {
+		writeTestPic(t, rel, []byte(rel))
+	}
+	drainMetaQueue()
+
+	names := []string{"a.jpg", "family/b.jpg", "family/party/c.jpg", "family/kids/d.jpg", "shared/e.jpg"}
+	for user, want := range map[string][]string{
+		"":      {"a.jpg", "family/party/c.jpg", "shared/e.jpg"},
+		"vic":   names,
+		"carol": {"a.jpg", "family/party/c.jpg", "shared/e.jpg"},
+	} {
+		req := testUserRequest(user)
+		if got := visiblePics(req, names); !reflect.DeepEqual(got, want) {
+			t.Errorf("pictures for %q: got %v, want %v", user, got, want)
+		}
+	}
+
+	// Restricted sub-albums are left out of listings, as though they did not exist:
+	for user, want := range map[string][]string{"": {"a.jpg", "shared"}, "vic": {"a.jpg", "family", "shared"}, "carol": {"a.jpg", "shared"}} {
+		if got := entryNames(visibleEntries(testUserRequest(user), "", picIndex.Settled(""))); !reflect.DeepEqual(got, want) {
+			t.Errorf("root for %q: got %v, want %v", user, got, want)
+		}
+	}
+	if err := requireViewAlbum(testUserRequest(""), "family/kids"); err == nil || err.(HttpError).StatusCode != http.StatusNotFound {
+		t.Errorf("restricted album: %v", err)
+	}
+
+	// Pictures of restricted albums must not be cached by shared caches:
+	for rel, want := range map[string]string{"a.jpg": "", "family/b.jpg": "private", "family/party/c.jpg": ""} {
+		rec := httptest.NewRecorder()
+		restrictCaching(rec, rel, false)
+		if got := rec.Header().Get("Cache-Control"); got != want {
+			t.Errorf("Cache-Control for %q = %q, want %q", rel, got, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Albums are the subdirectories of `picsDir`, addressed by their slash-separated path relative to it.
+
+// Static file server for `picsDir`, behind `picsFileHandler`:
+var picsFileServer http.Handler
+
+// Returns the album containing the entry at path `rel`:
+func albumOf(rel string) string {
+	if d := path.Dir(rel); d != "." {
+		return d
+	}
+	return ""
+}
+
+func hasHiddenComponent(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if isHiddenName(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalizes a client-supplied path relative to `picsDir`; `..` cannot climb above the root and hidden components are refused:
+func safeRelPath(p string) (string, bool) {
+	rel := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if rel != "" && hasHiddenComponent(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+// Resolves a path relative to `picsDir` to a local filesystem path, refusing symlinks that lead outside `picsDir`:
+func resolvePicPath(rel string) (string, error) {
+	p := path.Join(picsDir, rel)
+	real, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		// Nothing there yet (e.g. an upload target); the path itself is already confined:
+		return p, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if real != picsDir && !strings.HasPrefix(real, picsDir+"/") {
+		return "", fmt.Errorf("'%s' resolves outside of the pics directory", rel)
+	}
+	return p, nil
+}
+
+// Reads and validates the `album` query value:
+func getAlbum(req *http.Request) (string, error) {
+	album, ok := safeRelPath(req.URL.Query().Get("album"))
+	if !ok || !picIndex.HasAlbum(album) {
+		return "", NewHttpError(http.StatusNotFound, "Album not found", fmt.Errorf("No album '%s'", req.URL.Query().Get("album")))
+	}
+	if err := requireViewAlbum(req, album); err != nil {
+		return "", err
+	}
+	return album, nil
+}
+
+func albumURL(album string) string {
+	if album == "" {
+		return rootURL
+	}
+	return pjoin(albumsURL, album+"/")
+}
+
+type BreadcrumbViewModel struct {
+	Name string
+	URL  string
+}
+
+// Links to each album from the root down to `album`:
+func breadcrumbs(album string) []BreadcrumbViewModel {
+	crumbs := []BreadcrumbViewModel{{Name: "All pictures", URL: rootURL}}
+	if album == "" {
+		return crumbs
+	}
+	parts := strings.Split(album, "/")
+	for i := range parts {
+		a := strings.Join(parts[:i+1], "/")
+		crumbs = append(crumbs, BreadcrumbViewModel{Name: parts[i], URL: albumURL(a)})
+	}
+	return crumbs
+}
+
+// HTML handler for `/albums/<path>/`:
+func albumHandler(rsp http.ResponseWriter, req *http.Request) error {
+	p := removePrefix(req.URL.Path, albumsURL)
+
+	// Canonical album URLs end in '/':
+	if !strings.HasSuffix(p, "/") {
+		http.Redirect(rsp, req, req.URL.Path+"/", http.StatusMovedPermanently)
+		return nil
+	}
+
+	album, ok := safeRelPath(p)
+	if !ok || !picIndex.HasAlbum(album) {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("No album '%s'", p))
+	}
+	if err := requireViewAlbum(req, album); err != nil {
+		return err
+	}
+	if album == "" {
+		http.Redirect(rsp, req, rootURL, http.StatusFound)
+		return nil
+	}
+
+	return renderIndex(rsp, req, album)
+}
+
+// Guards the static file server for `/pics/` against hidden files (e.g. the trash) and symlinks out of `picsDir`:
+func picsFileHandler(rsp http.ResponseWriter, req *http.Request) error {
+	rel, ok := safeRelPath(req.URL.Path)
+	if !ok {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("Refusing hidden path '%s'", req.URL.Path))
+	}
+	// Share links open up what they cover; otherwise checking the path itself as an album also covers directory listings:
+	share, err := requestShare(req, rel)
+	if err != nil {
+		return err
+	}
+	if share == nil {
+		if err := requireViewAlbum(req, rel); err != nil {
+			return err
+		}
+	}
+	picPath, err := resolvePicPath(rel)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", err)
+	}
+	restrictCaching(rsp, rel, share != nil)
+	if share != nil {
+		if share.Album && rel == share.Path {
+			serveSharedAlbum(rsp, req, share)
+			return nil
+		}
+		if fi, err := os.Stat(picPath); err != nil || !fi.Mode().IsRegular() {
+			return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("No file '%s'", rel))
+		}
+		if err := useShare(req, share, rel); err != nil {
+			return err
+		}
+	}
+	if isVideoName(rel) {
+		if fi, err := os.Stat(picPath); err == nil && fi.Mode().IsRegular() {
+			return serveVideo(rsp, req, picPath, fi)
+		}
+	}
+	if privacy != privacyOff && strings.HasPrefix(getMimeType(rel), "image/") {
+		if fi, err := os.Stat(picPath); err == nil && fi.Mode().IsRegular() {
+			return servePrivate(rsp, req, picPath)
+		}
+	}
+	picsFileServer.ServeHTTP(rsp, req)
+	return nil
+}
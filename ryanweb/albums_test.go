@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAlbumPaths(t *testing.T) {
+	for rel, want := range map[string]string{"a.jpg": "", "2024/a.jpg": "2024", "2024/summer/a.jpg": "2024/summer", "2024": ""} {
+		if got := albumOf(rel); got != want {
+			t.Errorf("albumOf(%q) = %q, want %q", rel, got, want)
+		}
+	}
+
+	tests := []struct {
+		p, rel string
+		ok     bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"2024/summer/", "2024/summer", true},
+		{"/2024//summer/a.jpg", "2024/summer/a.jpg", true},
+		{"../../etc/passwd", "etc/passwd", true},
+		{"2024/../../a.jpg", "a.jpg", true},
+		{".trash/a.jpg", "", false},
+		{"2024/.hidden", "", false},
+		{"2024/.hidden/../a.jpg", "2024/a.jpg", true},
+	}
+	for _, tt := range tests {
+		if rel, ok := safeRelPath(tt.p); rel != tt.rel || ok != tt.ok {
+			t.Errorf("safeRelPath(%q) = %q, %v, want %q, %v", tt.p, rel, ok, tt.rel, tt.ok)
+		}
+	}
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	defer func(r, a string) { rootURL, albumsURL = r, a }(rootURL, albumsURL)
+	rootURL, albumsURL = "/", "/albums/"
+	want := []BreadcrumbViewModel{{"All pictures", "/"}, {"2024", "/albums/2024/"}, {"summer", "/albums/2024/summer/"}}
+	if got := breadcrumbs("2024/summer"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := breadcrumbs(""); len(got) != 1 {
+		t.Errorf("root: got %v", got)
+	}
+}
+
+func TestResolvePicPath(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "album/a.jpg", []byte("a"))
+	outside := path.Join(t.TempDir(), "secret.jpg")
+	if err := ioutil.WriteFile(outside, []byte("secret"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{"inside.jpg": "album/a.jpg", "outside.jpg": outside, "outside": path.Dir(outside)} {
+		if err := os.Symlink(target, path.Join(picsDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		rel string
+		ok  bool
+	}{
+		{"album/a.jpg", true},
+		{"album", true},
+		{"inside.jpg", true},
+		{"album/new.jpg", true},
+		{"outside.jpg", false},
+		{"outside/secret.jpg", false},
+	}
+	for _, tt := range tests {
+		p, err := resolvePicPath(tt.rel)
+		if (err == nil) != tt.ok {
+			t.Errorf("resolvePicPath(%q) = %q, %v", tt.rel, p, err)
+		} else if tt.ok && p != path.Join(picsDir, tt.rel) {
+			t.Errorf("resolvePicPath(%q) = %q", tt.rel, p)
+		}
+	}
+
+	// And the file server refuses them too:
+	defer func(h http.Handler) { picsFileServer = h }(picsFileServer)
+	picsFileServer = http.FileServer(http.Dir(picsDir))
+	for rel, status := range map[string]int{"album/a.jpg": http.StatusOK, "inside.jpg": http.StatusOK,
+		"outside.jpg": http.StatusNotFound, "outside/secret.jpg": http.StatusNotFound, ".tags.json": http.StatusNotFound} {
+		rec := httptest.NewRecorder()
+		http.StripPrefix("/pics/", NewErrorHandler(picsFileHandler)).ServeHTTP(rec, httptest.NewRequest("GET", "/pics/"+rel, nil))
+		if rec.Code != status {
+			t.Errorf("/pics/%s: %d, want %d", rel, rec.Code, status)
+		}
+	}
+}
+
+func TestAlbumCover(t *testing.T) {
+	setupTestStores(t)
+	now := time.Now()
+	// Sub-albums are named so that the newest comes first:
+	files := map[string]time.Duration{
+		"trip/a.jpg":              3 * time.Hour,
+		"trip/b.jpg":              2 * time.Hour,
+		"trip/notes.txt":          time.Hour,
+		"nested/private/c.jpg":    4 * time.Hour,
+		"nested/public/d.jpg":     5 * time.Hour,
+		"nested/public/notes.txt": time.Hour,
+		"nothing/notes.txt":       time.Hour,
+	}
+	for rel, age := range files {
+		writeUnindexedPic(t, rel, rel)
+		mtime := now.Add(-age)
+		if err := os.Chtimes(path.Join(picsDir, rel), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for dir, age := range map[string]time.Duration{"nested/private": time.Hour, "nested/public": 2 * time.Hour} {
+		mtime := now.Add(-age)
+		if err := os.Chtimes(path.Join(picsDir, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	drainMetaQueue()
+
+	all := func(string) bool { return true }
+	notPrivate := func(album string) bool { return album != "nested/private" }
+	tests := []struct {
+		album   string
+		visible func(string) bool
+		want    string
+	}{
+		{"trip", all, "trip/b.jpg"},
+		{"nested", all, "nested/private/c.jpg"},
+		{"nested", notPrivate, "nested/public/d.jpg"},
+		{"nothing", all, ""},
+		{"missing", all, ""},
+	}
+	for _, tt := range tests {
+		if got := picIndex.Cover(tt.album, tt.visible); got != tt.want {
+			t.Errorf("Cover(%q) = %q, want %q", tt.album, got, tt.want)
+		}
+	}
+}
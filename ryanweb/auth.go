@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Local accounts and cookie sessions. Viewing stays public; routes marked with `RequireLogin` need a signed-in user.
+
+// Path of the accounts file given by `-users`; accounts are disabled if empty:
+var usersFile string
+
+var loginURL, logoutURL string
+
+const (
+	sessionCookieName   = "ryanweb_session"
+	loginCSRFCookieName = "ryanweb_login_csrf"
+	// Double-submit CSRF token for visitors without a session, e.g. when there are no accounts:
+	csrfCookieName  = "ryanweb_csrf"
+	sessionLifetime = 14 * 24 * time.Hour
+)
+
+// An account in the users file, e.g. `{"users": [{"name": "ryan", "passwordHash": "$2a$10$...", "role": "admin"}]}`:
+type UserAccount struct {
+	Name string `json:"name"`
+	// bcrypt hash; generate with `ryanweb -hash-password`:
+	PasswordHash string `json:"passwordHash"`
+	// "viewer", "contributor" (default) or "admin":
+	Role string `json:"role,omitempty"`
+}
+
+type usersConfig struct {
+	Users []UserAccount `json:"users"`
+	// Album ACLs by album path:
+	Albums map[string]*AlbumACL `json:"albums"`
+}
+
+type Accounts struct {
+	users map[string]UserAccount
+	roles map[string]userRole
+	acls  map[string]*AlbumACL
+}
+
+// nil when no users file is configured, in which case nothing requires signing in:
+var accounts *Accounts
+
+func LoadAccounts(filePath string) (*Accounts, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg usersConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("could not parse users file '%s'; %s", filePath, err)
+	}
+
+	a := &Accounts{
+		users: make(map[string]UserAccount, len(cfg.Users)),
+		roles: make(map[string]userRole, len(cfg.Users)),
+		acls:  make(map[string]*AlbumACL, len(cfg.Albums)),
+	}
+	for _, u := range cfg.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("users file '%s' has an account without a name", filePath)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("account '%s' in '%s' has no valid bcrypt password hash; %s", u.Name, filePath, err)
+		}
+		role, err := parseUserRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("account '%s' in '%s': %s", u.Name, filePath, err)
+		}
+		a.users[u.Name] = u
+		a.roles[u.Name] = role
+	}
+
+	for album, acl := range cfg.Albums {
+		rel, ok := safeRelPath(album)
+		if !ok || acl == nil {
+			return nil, fmt.Errorf("users file '%s' has an invalid ACL for album '%s'", filePath, album)
+		}
+		// Catch typos rather than silently locking someone out:
+		for _, name := range append(append([]string{}, acl.Viewers...), acl.Contributors...) {
+			if _, ok := a.users[name]; !ok {
+				return nil, fmt.Errorf("ACL for album '%s' in '%s' names unknown user '%s'", album, filePath, name)
+			}
+		}
+		a.acls[rel] = acl
+	}
+	return a, nil
+}
+
+// Compared against for unknown users so failed sign-ins take as long either way:
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func (a *Accounts) Authenticate(name, password string) (UserAccount, bool) {
+	u, ok := a.users[name]
+	hash := []byte(u.PasswordHash)
+	if !ok {
+		hash = dummyPasswordHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return UserAccount{}, false
+	}
+	return u, true
+}
+
+// Reads a password from standard input and prints its bcrypt hash for the users file:
+func hashPasswordCommand(input []byte) (string, error) {
+	password := strings.TrimRight(string(input), "\r\n")
+	if password == "" {
+		return "", errors.New("no password given on standard input")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Random token suitable for session IDs and CSRF tokens:
+func randomToken() string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+type Session struct {
+	ID   string
+	User string
+	// Must accompany state-changing requests made with this session:
+	CSRFToken string
+	Expires   time.Time
+}
+
+// Sessions live in memory; restarting the server signs everyone out:
+type SessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*Session
+}
+
+var sessions = NewSessionStore()
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*Session)}
+}
+
+func (s *SessionStore) Create(user string) *Session {
+	session := &Session{
+		ID:        randomToken(),
+		User:      user,
+		CSRFToken: randomToken(),
+		Expires:   time.Now().Add(sessionLifetime),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Drop expired sessions while we are here:
+	now := time.Now()
+	for id, old := range s.sessions {
+		if now.After(old.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[session.ID] = session
+	return session
+}
+
+// Returns the live session with the ID; nil if there is none:
+func (s *SessionStore) Get(id string) *Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	return session
+}
+
+func (s *SessionStore) Delete(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+}
+
+// Cookies are scoped to the site root and only sent over HTTPS when the site is served over HTTPS:
+func newCookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     rootURL,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(siteHost, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func expireCookie(rsp http.ResponseWriter, name string) {
+	c := newCookie(name, "", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(rsp, c)
+}
+
+func sessionFromCookie(req *http.Request) *Session {
+	c, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	return sessions.Get(c.Value)
+}
+
+type sessionContextKey struct{}
+
+// The session of the signed-in user making the request; nil if signed out:
+func currentSession(req *http.Request) *Session {
+	session, _ := req.Context().Value(sessionContextKey{}).(*Session)
+	return session
+}
+
+// Name of the signed-in user, or of the owner of the API token used; "" if signed out:
+func currentUser(req *http.Request) string {
+	if session := currentSession(req); session != nil {
+		return session.User
+	}
+	if t := currentToken(req); t != nil {
+		return t.User
+	}
+	return ""
+}
+
+// The CSRF token for pages to send back with changes: the session's if signed in, otherwise that of a cookie, set if need be.
+// Must be called before the response header is written:
+func pageCSRFToken(rsp http.ResponseWriter, req *http.Request) string {
+	if token := requestCSRFToken(req); token != "" {
+		return token
+	}
+	token := randomToken()
+	http.SetCookie(rsp, newCookie(csrfCookieName, token, time.Time{}))
+	return token
+}
+
+// The CSRF token a change must carry. Without a session, any value works as long as the cookie matches it;
+// other sites can neither read nor set our cookies:
+func requestCSRFToken(req *http.Request) string {
+	if session := currentSession(req); session != nil {
+		return session.CSRFToken
+	}
+	if c, err := req.Cookie(csrfCookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// Refuses changes that browsers mark as coming from another site, and those with neither header; browsers send at
+// least one with every change, and scripts without them use API tokens instead:
+func sameOrigin(req *http.Request) bool {
+	source := req.Header.Get("Origin")
+	if source == "" {
+		source = req.Header.Get("Referer")
+	}
+	if source == "" {
+		return false
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		// Includes `Origin: null` from sandboxed frames and the like:
+		return false
+	}
+	if strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	// Behind a reverse proxy, the host we see may not be the public one:
+	site, err := url.Parse(siteHost)
+	return err == nil && strings.EqualFold(u.Host, site.Host)
+}
+
+// Checks the CSRF token sent in the `X-CSRF-Token` header or a urlencoded `csrf` form value. Never the query string,
+// where it would end up in logs and `Referer` headers:
+func checkCSRF(req *http.Request, expected string) bool {
+	token := req.Header.Get("X-CSRF-Token")
+	if token == "" && strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		// Multipart bodies are left alone so uploads can still be streamed:
+		token = req.PostFormValue("csrf")
+	}
+	return token != "" && expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// What a route demands of the request:
+type routePolicy struct {
+	// A signed-in user:
+	Login bool
+	// A CSRF token on anything but GET, HEAD and OPTIONS, even without accounts:
+	CSRF bool
+	// The API token scope that grants access; routes without one are closed to tokens:
+	Scope string
+}
+
+// Wraps the mux to attach sessions to requests and enforce per-route policies:
+type AuthHandler struct {
+	mux      *http.ServeMux
+	policies map[string]routePolicy
+}
+
+func NewAuthHandler(mux *http.ServeMux) *AuthHandler {
+	return &AuthHandler{mux: mux, policies: make(map[string]routePolicy)}
+}
+
+// Requires a signed-in user for the mux patterns:
+func (h *AuthHandler) RequireLogin(patterns ...string) {
+	for _, pattern := range patterns {
+		p := h.policies[pattern]
+		p.Login = true
+		h.policies[pattern] = p
+	}
+}
+
+// Requires a signed-in user and their CSRF token for the mux patterns:
+func (h *AuthHandler) RequireCSRF(patterns ...string) {
+	for _, pattern := range patterns {
+		p := h.policies[pattern]
+		p.Login, p.CSRF = true, true
+		h.policies[pattern] = p
+	}
+}
+
+// Lets API tokens with `scope` use the mux patterns:
+func (h *AuthHandler) AllowToken(scope string, patterns ...string) {
+	for _, pattern := range patterns {
+		p := h.policies[pattern]
+		p.Scope = scope
+		h.policies[pattern] = p
+	}
+}
+
+func (h *AuthHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+	handler, pattern := h.mux.Handler(req)
+	policy := h.policies[pattern]
+
+	if accounts == nil {
+		// Without accounts everything is open, but only to pages of our own:
+		if !isSafeMethod(req.Method) && !h.checkForgery(rsp, req, handler, policy) {
+			return
+		}
+		handler.ServeHTTP(rsp, req)
+		return
+	}
+
+	if secret := bearerToken(req); secret != "" {
+		t, ok := tokenStore.Authenticate(secret)
+		if !ok {
+			h.deny(rsp, req, handler, NewHttpError(http.StatusUnauthorized, "Invalid API token", fmt.Errorf("Unknown API token for '%s'", req.URL.Path)).WithCode("token_invalid"))
+			return
+		}
+		// Tokens only reach routes opened to them, whatever their account could see:
+		if policy.Scope == "" || !t.HasScope(policy.Scope) {
+			h.deny(rsp, req, handler, NewHttpError(http.StatusForbidden, "API token does not allow this request", fmt.Errorf("Token %s of '%s' lacks scope '%s' for '%s'", t.ID, t.User, policy.Scope, req.URL.Path)).WithCode("token_scope"))
+			return
+		}
+		// Browsers never send the header on their own, so token requests need no CSRF token:
+		req = req.WithContext(context.WithValue(req.Context(), tokenContextKey{}, &t))
+		handler.ServeHTTP(rsp, req)
+		return
+	}
+
+	session := sessionFromCookie(req)
+	if session != nil {
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, session))
+	}
+	if policy.Login && session == nil {
+		h.deny(rsp, req, handler, NewHttpError(http.StatusUnauthorized, "Please sign in first", fmt.Errorf("Anonymous request for '%s'", req.URL.Path)).WithCode("login_required"))
+		return
+	}
+	if !isSafeMethod(req.Method) && !h.checkForgery(rsp, req, handler, policy) {
+		return
+	}
+
+	handler.ServeHTTP(rsp, req)
+}
+
+// Checks a change for signs of cross-site request forgery, responding and returning false if found:
+func (h *AuthHandler) checkForgery(rsp http.ResponseWriter, req *http.Request, handler http.Handler, policy routePolicy) bool {
+	if !sameOrigin(req) {
+		h.deny(rsp, req, handler, NewHttpError(http.StatusForbidden, "Requests from other sites are not allowed", fmt.Errorf("Cross-site %s to '%s'; Origin '%s', Referer '%s'", req.Method, req.URL.Path, req.Header.Get("Origin"), req.Header.Get("Referer"))).WithCode("cross_site"))
+		return false
+	}
+	if policy.CSRF && !checkCSRF(req, requestCSRFToken(req)) {
+		h.deny(rsp, req, handler, NewHttpError(http.StatusForbidden, "Missing or invalid CSRF token; reload the page and try again", fmt.Errorf("Bad CSRF token from '%s' for '%s'", requestor(req), req.URL.Path)).WithCode("csrf_invalid"))
+		return false
+	}
+	return true
+}
+
+// Responds with `herr` the way the route's own handler reports errors; pages send signed-out visitors to sign in:
+func (h *AuthHandler) deny(rsp http.ResponseWriter, req *http.Request, handler http.Handler, herr HttpError) {
+	logError(req, herr)
+	if _, ok := handler.(JsonHandler); !ok && herr.StatusCode == http.StatusUnauthorized && req.Method == "GET" && bearerToken(req) == "" {
+		http.Redirect(rsp, req, loginURL+"?"+url.Values{"next": {req.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+		return
+	}
+	writeErrorFor(rsp, handler, herr)
+}
+
+// Only same-site paths may be returned to after signing in:
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return rootURL
+	}
+	return next
+}
+
+type LoginViewModel struct {
+	LoginURL  string
+	IndexURL  string
+	User      string
+	Next      string
+	CSRFToken string
+	Error     string
+}
+
+func requireAccounts() error {
+	if accounts == nil {
+		return NewHttpError(http.StatusNotFound, "Accounts are not enabled", fmt.Errorf("No users file configured"))
+	}
+	return nil
+}
+
+// HTML handler for `/login`:
+func loginHandler(rsp http.ResponseWriter, req *http.Request) error {
+	if err := requireAccounts(); err != nil {
+		return err
+	}
+
+	model := LoginViewModel{
+		LoginURL: loginURL,
+		IndexURL: rootURL,
+		Next:     safeNext(req.FormValue("next")),
+	}
+	status := http.StatusOK
+
+	switch req.Method {
+	case "GET":
+	case "POST":
+		// There is no session yet, so the form's token is checked against a cookie set alongside it:
+		c, err := req.Cookie(loginCSRFCookieName)
+		if err != nil || !checkCSRF(req, c.Value) {
+			return NewHttpError(http.StatusForbidden, "Missing or invalid CSRF token; reload the page and try again", fmt.Errorf("Bad login CSRF token"))
+		}
+
+		model.User = req.PostFormValue("user")
+		if u, ok := accounts.Authenticate(model.User, req.PostFormValue("password")); ok {
+			session := sessions.Create(u.Name)
+			http.SetCookie(rsp, newCookie(sessionCookieName, session.ID, session.Expires))
+			expireCookie(rsp, loginCSRFCookieName)
+			log.Printf("User '%s' signed in\n", u.Name)
+			http.Redirect(rsp, req, model.Next, http.StatusSeeOther)
+			return nil
+		}
+		log.Printf("Failed sign-in for '%s'\n", model.User)
+		model.Error = "Unknown user name or wrong password"
+		status = http.StatusUnauthorized
+	default:
+		return NewHttpError(http.StatusMethodNotAllowed, "Login requires GET or POST method", fmt.Errorf("Login requires GET or POST method"))
+	}
+
+	model.CSRFToken = randomToken()
+	http.SetCookie(rsp, newCookie(loginCSRFCookieName, model.CSRFToken, time.Time{}))
+
+	return renderTemplate(rsp, status, "login.html", model)
+}
+
+type LogoutViewModel struct {
+	LogoutURL string
+	IndexURL  string
+	User      string
+	CSRFToken string
+}
+
+// HTML handler for `/logout`; GET asks for confirmation and POST signs out:
+func logoutHandler(rsp http.ResponseWriter, req *http.Request) error {
+	if err := requireAccounts(); err != nil {
+		return err
+	}
+
+	session := currentSession(req)
+	if session == nil {
+		http.Redirect(rsp, req, rootURL, http.StatusSeeOther)
+		return nil
+	}
+
+	switch req.Method {
+	case "GET":
+		return renderTemplate(rsp, http.StatusOK, "logout.html", LogoutViewModel{
+			LogoutURL: logoutURL,
+			IndexURL:  rootURL,
+			User:      session.User,
+			CSRFToken: session.CSRFToken,
+		})
+	case "POST":
+		if !checkCSRF(req, session.CSRFToken) {
+			return NewHttpError(http.StatusForbidden, "Missing or invalid CSRF token; reload the page and try again", fmt.Errorf("Bad CSRF token from '%s' for logout", session.User))
+		}
+		sessions.Delete(session.ID)
+		expireCookie(rsp, sessionCookieName)
+		log.Printf("User '%s' signed out\n", session.User)
+		http.Redirect(rsp, req, rootURL, http.StatusSeeOther)
+	default:
+		return NewHttpError(http.StatusMethodNotAllowed, "Logout requires GET or POST method", fmt.Errorf("Logout requires GET or POST method"))
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testUsers = `{"users":[
+	{"name":"ryan","passwordHash":"` + testPasswordHash + `","role":"admin"},
+	{"name":"bob","passwordHash":"` + testPasswordHash + `","role":"contributor"}]}`
+
+// Serves JSON `/change`, which needs a CSRF token, and `/read`, which API tokens with the read scope may use:
+func newTestAuthHandler() *AuthHandler {
+	ok := NewJsonHandler(func(*http.Request) (interface{}, error) {
+		return struct {
+			Success bool `json:"success"`
+		}{true}, nil
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/change", ok)
+	mux.Handle("/read", ok)
+	auth := NewAuthHandler(mux)
+	auth.RequireCSRF("/change")
+	auth.AllowToken(scopeRead, "/read")
+	return auth
+}
+
+func TestAuthHandlerOpen(t *testing.T) {
+	auth := newTestAuthHandler()
+	tests := []struct {
+		name   string
+		origin string
+		cookie string
+		header string
+		status int
+		code   string
+	}{
+		{"no token", "http://example.com", "", "", http.StatusForbidden, "csrf_invalid"},
+		{"no cookie", "http://example.com", "", "abc", http.StatusForbidden, "csrf_invalid"},
+		{"mismatch", "http://example.com", "abc", "abd", http.StatusForbidden, "csrf_invalid"},
+		{"double submit", "http://example.com", "abc", "abc", http.StatusOK, ""},
+		{"other site", "http://evil.example", "abc", "abc", http.StatusForbidden, "cross_site"},
+		{"null origin", "null", "abc", "abc", http.StatusForbidden, "cross_site"},
+		{"no origin", "", "abc", "abc", http.StatusForbidden, "cross_site"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/change", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			req.Header.Set("X-CSRF-Token", tt.header)
+		}
+		status, body := serveJson(t, auth, req)
+		if status != tt.status || body.Code != tt.code {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, status, body.Code, tt.status, tt.code)
+		}
+	}
+
+	// A `Referer` stands in for a missing `Origin`:
+	for referer, status := range map[string]int{"http://example.com/album": http.StatusOK, "http://evil.example/": http.StatusForbidden} {
+		req := httptest.NewRequest("POST", "/change", nil)
+		req.Header.Set("Referer", referer)
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "abc"})
+		req.Header.Set("X-CSRF-Token", "abc")
+		if got, body := serveJson(t, auth, req); got != status {
+			t.Errorf("referer %s: %d %q, want %d", referer, got, body.Code, status)
+		}
+	}
+
+	// The token is never taken from the query string:
+	req := httptest.NewRequest("POST", "/change?csrf=abc", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "abc"})
+	if status, body := serveJson(t, auth, req); status != http.StatusForbidden || body.Code != "csrf_invalid" {
+		t.Errorf("query token: %d %q", status, body.Code)
+	}
+}
+
+func TestAuthHandlerAccounts(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	auth := newTestAuthHandler()
+	session := sessions.Create("bob")
+	readToken, _, err := tokenStore.Create("bob", "read", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadToken, _, err := tokenStore.Create("bob", "upload", []string{scopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		session string
+		csrf    string
+		bearer  string
+		status  int
+		code    string
+	}{
+		{"anonymous", "/change", "", "", "", http.StatusUnauthorized, "login_required"},
+		{"unknown session", "/change", "nope", session.CSRFToken, "", http.StatusUnauthorized, "login_required"},
+		{"no csrf token", "/change", session.ID, "", "", http.StatusForbidden, "csrf_invalid"},
+		{"wrong csrf token", "/change", session.ID, "x" + session.CSRFToken, "", http.StatusForbidden, "csrf_invalid"},
+		{"signed in", "/change", session.ID, session.CSRFToken, "", http.StatusOK, ""},
+		{"unknown api token", "/read", "", "", apiTokenPrefix + "bogus", http.StatusUnauthorized, "token_invalid"},
+		{"api token", "/read", "", "", readToken, http.StatusOK, ""},
+		{"api token scope", "/read", "", "", uploadToken, http.StatusForbidden, "token_scope"},
+		{"api token on page route", "/change", "", "", readToken, http.StatusForbidden, "token_scope"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, nil)
+		req.Header.Set("Origin", "http://example.com")
+		if tt.session != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.session})
+		}
+		if tt.csrf != "" {
+			req.Header.Set("X-CSRF-Token", tt.csrf)
+		}
+		if tt.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		status, body := serveJson(t, auth, req)
+		if status != tt.status || body.Code != tt.code {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, status, body.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestAuthHandlerRedirectsPages(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	mux := http.NewServeMux()
+	mux.Handle("/page", NewErrorHandler(func(rsp http.ResponseWriter, req *http.Request) error { return nil }))
+	auth := NewAuthHandler(mux)
+	auth.RequireLogin("/page")
+
+	rec := httptest.NewRecorder()
+	auth.ServeHTTP(rec, httptest.NewRequest("GET", "/page?x=1", nil))
+	if rec.Code != http.StatusSeeOther || !strings.Contains(rec.Header().Get("Location"), "next=%2Fpage%3Fx%3D1") {
+		t.Errorf("got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+// View routes are open to read tokens only; a token's account does not widen what the token may do:
+func TestAuthHandlerTokenScopesOnViewRoutes(t *testing.T) {
+	setupTestStores(t)
+	setupTestAccounts(t, `{"users":[{"name":"gm","passwordHash":"`+testPasswordHash+`","role":"viewer"}],
+		"albums":{"family":{"viewers":["gm"]}}}`)
+	writeTestPic(t, "family/a.txt", []byte("private"))
+	defer func(u string, fs http.Handler) { picsURL, picsFileServer = u, fs }(picsURL, picsFileServer)
+	picsURL, picsFileServer = "/pics/", http.FileServer(http.Dir(picsDir))
+
+	mux := http.NewServeMux()
+	mux.Handle(picsURL, http.StripPrefix(picsURL, NewErrorHandler(picsFileHandler)))
+	mux.Handle("/unlisted", NewJsonHandler(func(*http.Request) (interface{}, error) { return "ok", nil }))
+	auth := NewAuthHandler(mux)
+	auth.AllowToken(scopeRead, picsURL)
+
+	token := func(scopes ...string) string {
+		secret, _, err := tokenStore.Create("gm", "test", scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"read token", "/pics/family/a.txt", token(scopeRead), http.StatusOK},
+		{"upload token", "/pics/family/a.txt", token(scopeUpload), http.StatusForbidden},
+		{"delete token", "/pics/family/a.txt", token(scopeDelete), http.StatusForbidden},
+		{"route without a scope", "/unlisted", token(scopeRead, scopeUpload, scopeDelete), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		auth.ServeHTTP(rec, req)
+		if rec.Code != tt.status || (rec.Code == http.StatusOK) != (rec.Body.String() == "private") {
+			t.Errorf("%s: %d %q, want %d", tt.name, rec.Code, rec.Body.String(), tt.status)
+		}
+	}
+}
+
+func TestLoadAccounts(t *testing.T) {
+	bad := map[string]string{
+		"not JSON":        `{`,
+		"no name":         `{"users":[{"passwordHash":"` + testPasswordHash + `"}]}`,
+		"plain password":  `{"users":[{"name":"ryan","passwordHash":"secret"}]}`,
+		"unknown role":    `{"users":[{"name":"ryan","passwordHash":"` + testPasswordHash + `","role":"owner"}]}`,
+		"unknown viewer":  `{"users":[],"albums":{"family":{"viewers":["ryna"]}}}`,
+		"hidden album":    `{"users":[],"albums":{".trash":{"public":true}}}`,
+		"null album ACL":  `{"users":[],"albums":{"family":null}}`,
+		"unknown contrib": `{"users":[],"albums":{"family":{"contributors":["bob"]}}}`,
+	}
+	dir := t.TempDir()
+	for name, content := range bad {
+		p := path.Join(dir, "users.json")
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAccounts(p); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, err := LoadAccounts(path.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file loaded")
+	}
+
+	setupTestAccounts(t, `{"users":[
+		{"name":"ryan","passwordHash":"`+testPasswordHash+`","role":"Admin"},
+		{"name":"bob","passwordHash":"`+testPasswordHash+`"}],
+		"albums":{"/family/":{"viewers":["bob"]}}}`)
+	if accounts.roles["ryan"] != roleAdmin || accounts.roles["bob"] != roleContributor {
+		t.Errorf("roles %v", accounts.roles)
+	}
+	if acl := accounts.acls["family"]; acl == nil || acl.Viewers[0] != "bob" {
+		t.Errorf("ACLs %v", accounts.acls)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"ryan", "secret", true},
+		{"ryan", "Secret", false},
+		{"ryan", "", false},
+		{"nobody", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if u, ok := accounts.Authenticate(tt.user, tt.password); ok != tt.ok || (ok && u.Name != tt.user) {
+			t.Errorf("Authenticate(%q, %q) = %+v, %v", tt.user, tt.password, u, ok)
+		}
+	}
+}
+
+func TestHashPasswordCommand(t *testing.T) {
+	hash, err := hashPasswordCommand([]byte("hunter2\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("hunter2")); err != nil {
+		t.Errorf("hash does not match; %s", err)
+	}
+	if _, err := hashPasswordCommand([]byte("\n")); err == nil {
+		t.Error("hashed an empty password")
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	s := NewSessionStore()
+	a, b := s.Create("ryan"), s.Create("ryan")
+	if a.ID == b.ID || a.CSRFToken == b.CSRFToken || a.ID == a.CSRFToken {
+		t.Error("tokens reused")
+	}
+	if got := s.Get(a.ID); got != a {
+		t.Errorf("Get = %+v", got)
+	}
+	if s.Get("") != nil || s.Get("nope") != nil {
+		t.Error("found a session that does not exist")
+	}
+	s.Delete(a.ID)
+	if s.Get(a.ID) != nil || s.Get(b.ID) != b {
+		t.Error("Delete removed the wrong session")
+	}
+
+	b.Expires = time.Now().Add(-time.Second)
+	if s.Get(b.ID) != nil {
+		t.Error("expired session returned")
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	defer func(r string) { rootURL = r }(rootURL)
+	rootURL = "/"
+	for next, want := range map[string]string{"/albums/x/": "/albums/x/", "": "/", "//evil.com/": "/", "/\\evil.com": "/",
+		"https://evil.com/": "/", "javascript:alert(1)": "/"} {
+		if got := safeNext(next); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestLoginLogout(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	defer func(tm *template.Template, r string) { templates, rootURL = tm, r }(templates, rootURL)
+	templates = template.Must(template.New("login.html").Parse(`{{.Error}}`))
+	template.Must(templates.New("logout.html").Parse(`{{.User}}`))
+	rootURL = "/"
+
+	serve := func(handler func(http.ResponseWriter, *http.Request) error, req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		NewErrorHandler(handler).ServeHTTP(rec, req)
+		return rec
+	}
+	cookie := func(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+
+	rec := serve(loginHandler, httptest.NewRequest("GET", "/login", nil))
+	loginCSRF := cookie(rec, loginCSRFCookieName)
+	if rec.Code != http.StatusOK || loginCSRF == nil || loginCSRF.Value == "" || !loginCSRF.HttpOnly {
+		t.Fatalf("login form: %d %+v", rec.Code, loginCSRF)
+	}
+
+	post := func(form url.Values, withCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if withCookie {
+			req.AddCookie(loginCSRF)
+		}
+		return serve(loginHandler, req)
+	}
+	form := url.Values{"user": {"bob"}, "password": {"secret"}, "csrf": {loginCSRF.Value}, "next": {"/albums/x/"}}
+	if rec := post(form, false); rec.Code != http.StatusForbidden {
+		t.Errorf("without the CSRF cookie: %d", rec.Code)
+	}
+	wrong := url.Values{"user": {"bob"}, "password": {"wrong"}, "csrf": {loginCSRF.Value}}
+	if rec := post(wrong, true); rec.Code != http.StatusUnauthorized || cookie(rec, sessionCookieName) != nil {
+		t.Errorf("wrong password: %d", rec.Code)
+	}
+
+	rec = post(form, true)
+	c := cookie(rec, sessionCookieName)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/albums/x/" || c == nil {
+		t.Fatalf("sign-in: %d %q %+v", rec.Code, rec.Header().Get("Location"), c)
+	}
+	session := sessions.Get(c.Value)
+	if session == nil || session.User != "bob" {
+		t.Fatalf("session %+v", session)
+	}
+
+	// Signing out needs the session's CSRF token:
+	logout := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/logout", nil)
+		req.Header.Set("X-CSRF-Token", token)
+		return serve(logoutHandler, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, session)))
+	}
+	if rec := logout(loginCSRF.Value); rec.Code != http.StatusForbidden || sessions.Get(session.ID) == nil {
+		t.Errorf("sign-out with the wrong token: %d", rec.Code)
+	}
+	rec = logout(session.CSRFToken)
+	if c := cookie(rec, sessionCookieName); rec.Code != http.StatusSeeOther || c == nil || c.MaxAge >= 0 {
+		t.Errorf("sign-out: %d %+v", rec.Code, c)
+	}
+	if sessions.Get(session.ID) != nil {
+		t.Error("session survived signing out")
+	}
+}
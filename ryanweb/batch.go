@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Body of a batch request; either JSON or form-encoded with repeated keys:
+type BatchRequest struct {
+	Filenames []string      `json:"filenames"`
+	Renames   []BatchRename `json:"renames"`
+	Album     string        `json:"album"`
+}
+
+type BatchRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Outcome of one item of a batch operation:
+type BatchItemResult struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	NewName string `json:"newName,omitempty"`
+	TrashID string `json:"trashId,omitempty"`
+}
+
+type BatchResult struct {
+	Success bool              `json:"success"`
+	Items   []BatchItemResult `json:"items"`
+}
+
+func parseBatchRequest(req *http.Request) (br BatchRequest, err error) {
+	if req.Method != "POST" {
+		return br, NewHttpError(http.StatusMethodNotAllowed, "Batch operations require POST method", fmt.Errorf("Batch operations require POST method"))
+	}
+
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&br); err != nil {
+			return br, NewHttpError(http.StatusBadRequest, "Error parsing JSON request body", err)
+		}
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return br, NewHttpError(http.StatusBadRequest, "Error parsing form data", err)
+	}
+	br.Filenames = req.Form["filename"]
+	froms, tos := req.Form["from"], req.Form["to"]
+	if len(froms) != len(tos) {
+		return br, NewHttpError(http.StatusBadRequest, "Expecting equal numbers of from and to form values", fmt.Errorf("%d from values but %d to values", len(froms), len(tos)))
+	}
+	for i := range froms {
+		br.Renames = append(br.Renames, BatchRename{From: froms[i], To: tos[i]})
+	}
+	br.Album = req.Form.Get("album")
+	return
+}
+
+// Validates a client-supplied file path relative to `picsDir`, returning a message describing the problem if any:
+func checkPicName(name string) string {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "Invalid file name"
+	}
+	if hasHiddenComponent(name) {
+		return "File names may not start with '.'"
+	}
+	return ""
+}
+
+// Validates a client-supplied album path relative to `picsDir`:
+func checkAlbumName(album string) string {
+	if album == "" || path.IsAbs(album) || path.Clean(album) != album {
+		return "Invalid album name"
+	}
+	for _, part := range strings.Split(album, "/") {
+		if part == ".." || isHiddenName(part) {
+			return "Invalid album name"
+		}
+	}
+	return ""
+}
+
+// Renames a picture along with its thumbnail and index entries; `to` may include an album path:
+func renamePic(from, to string) error {
+	toPath := path.Join(picsDir, to)
+	if _, err := os.Lstat(toPath); err == nil {
+		return os.ErrExist
+	}
+	if err := os.Rename(path.Join(picsDir, from), toPath); err != nil {
+		return err
+	}
+
+	// The thumbnail is only a cache; drop it if it cannot be moved:
+	thumbTo := path.Join(thumbsDir, to)
+	os.MkdirAll(path.Dir(thumbTo), 0775)
+	if err := os.Rename(path.Join(thumbsDir, from), thumbTo); err != nil {
+		os.Remove(path.Join(thumbsDir, from))
+	}
+
+	if hash, ok := hashIndex.HashOf(from); ok {
+		hashIndex.Remove(from)
+		hashIndex.Add(to, hash)
+	}
+	if meta, ok := metaCache.Get(from); ok {
+		metaCache.Remove(from)
+		metaCache.Put(to, meta)
+	}
+	searchIndex.Invalidate()
+	if err := tagStore.Rename(from, to); err != nil {
+		log.Printf("Could not move tags of '%s' to '%s'; %s\n", from, to, err)
+	}
+	picIndex.Update(from)
+	picIndex.Update(to)
+	return nil
+}
+
+// Moves a picture to the trash and drops its index entries:
+func deletePic(name, deletedBy string) (TrashItem, error) {
+	item, err := trashFile(name, deletedBy)
+	if err != nil {
+		return item, err
+	}
+	forgetPic(name)
+	picIndex.Update(name)
+
+	// Keep the tags with the trashed file so a restore brings them back:
+	if snap, err := tagStore.Forget(name); err != nil {
+		log.Printf("Could not drop tags of '%s'; %s\n", name, err)
+	} else if snap != nil {
+		item.Labels = snap
+		if err := writeTrashItem(item); err != nil {
+			log.Printf("Could not record tags of trashed '%s'; %s\n", name, err)
+		}
+	}
+	return item, nil
+}
+
+// Restores a picture from the trash and brings its index entries back:
+func undeletePic(id string) (TrashItem, error) {
+	item, err := restoreTrash(id)
+	if err != nil {
+		return item, err
+	}
+	if hash, err := hashFile(path.Join(picsDir, item.Name)); err == nil {
+		hashIndex.Add(item.Name, hash)
+	}
+	picIndex.Update(item.Name)
+	queuePicMeta(item.Name)
+	if item.Labels != nil {
+		if err := tagStore.Restore(item.Labels); err != nil {
+			log.Printf("Could not restore tags of '%s'; %s\n", item.Name, err)
+		}
+	}
+	return item, nil
+}
+
+// A validated batch step and how to take it back:
+type batchStep struct {
+	result *BatchItemResult
+	do     func() error
+	undo   func() error
+}
+
+// Runs all steps if all of them validated; on the first failure, undoes the steps already taken:
+func runBatch(results []BatchItemResult, steps []batchStep) BatchResult {
+	for _, r := range results {
+		if r.Message != "" {
+			// Validation failed; nothing was touched:
+			for i := range results {
+				if results[i].Message == "" {
+					results[i].Message = "Not attempted"
+				}
+			}
+			return BatchResult{Success: false, Items: results}
+		}
+	}
+
+	for i, step := range steps {
+		if err := step.do(); err != nil {
+			log.Printf("Batch step for '%s' failed; %s\n", step.result.Name, err)
+			step.result.Message = err.Error()
+
+			// Roll back, most recent first:
+			for j := i - 1; j >= 0; j-- {
+				steps[j].result.Success = false
+				if err := steps[j].undo(); err != nil {
+					log.Printf("Could not roll back batch step for '%s'; %s\n", steps[j].result.Name, err)
+					steps[j].result.Message = "Completed, but could not be rolled back"
+				} else {
+					steps[j].result.Message = "Rolled back"
+				}
+			}
+			for j := i + 1; j < len(steps); j++ {
+				steps[j].result.Message = "Not attempted"
+			}
+			return BatchResult{Success: false, Items: results}
+		}
+		step.result.Success = true
+	}
+
+	return BatchResult{Success: true, Items: results}
+}
+
+// Checks that the requestor may change both the albums pictures come from and those they go to;
+// done before looking at the files so that nothing is revealed about albums they cannot see:
+func checkPermissions(req *http.Request, results []BatchItemResult) {
+	for i := range results {
+		r := &results[i]
+		if r.Message != "" {
+			continue
+		}
+		if !canEditAlbum(req, albumOf(r.Name)) || (r.NewName != "" && !canEditAlbum(req, albumOf(r.NewName))) {
+			r.Message = "Permission denied"
+		}
+	}
+}
+
+// Checks for names that are missing or mentioned twice:
+func checkSources(results []BatchItemResult) {
+	seen := make(map[string]bool)
+	for i := range results {
+		r := &results[i]
+		if r.Message != "" {
+			continue
+		}
+		if seen[r.Name] {
+			r.Message = "File named more than once"
+		} else if _, err := os.Lstat(path.Join(picsDir, r.Name)); err != nil {
+			r.Message = "File not found"
+		}
+		seen[r.Name] = true
+	}
+}
+
+// JSON handler for `/batch/delete`:
+func batchDeleteJsonHandler(req *http.Request) (interface{}, error) {
+	br, err := parseBatchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(br.Filenames) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting filename values", fmt.Errorf("No filenames in batch delete"))
+	}
+	by := requestor(req)
+
+	results := make([]BatchItemResult, len(br.Filenames))
+	for i, name := range br.Filenames {
+		results[i] = BatchItemResult{Name: name, Message: checkPicName(name)}
+	}
+	checkPermissions(req, results)
+	checkSources(results)
+
+	steps := make([]batchStep, len(results))
+	for i := range results {
+		r := &results[i]
+		steps[i] = batchStep{
+			result: r,
+			do: func() error {
+				item, err := deletePic(r.Name, by)
+				r.TrashID = item.ID
+				return err
+			},
+			undo: func() error {
+				_, err := undeletePic(r.TrashID)
+				return err
+			},
+		}
+	}
+
+	return runBatch(results, steps), nil
+}
+
+// JSON handler for `/batch/rename`:
+func batchRenameJsonHandler(req *http.Request) (interface{}, error) {
+	br, err := parseBatchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(br.Renames) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting from and to values", fmt.Errorf("No renames in batch rename"))
+	}
+
+	results := make([]BatchItemResult, len(br.Renames))
+	for i, rn := range br.Renames {
+		msg := checkPicName(rn.From)
+		if msg == "" {
+			msg = checkPicName(rn.To)
+		}
+		results[i] = BatchItemResult{Name: rn.From, NewName: rn.To, Message: msg}
+	}
+	checkPermissions(req, results)
+	checkSources(results)
+	checkTargets(results)
+
+	return runBatch(results, renameSteps(results)), nil
+}
+
+// JSON handler for `/batch/move`:
+func batchMoveJsonHandler(req *http.Request) (interface{}, error) {
+	br, err := parseBatchRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(br.Filenames) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting filename values", fmt.Errorf("No filenames in batch move"))
+	}
+	if msg := checkAlbumName(br.Album); msg != "" {
+		return nil, NewHttpError(http.StatusBadRequest, msg, fmt.Errorf("Invalid album '%s'", br.Album))
+	}
+	if err := requireEditAlbum(req, br.Album); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchItemResult, len(br.Filenames))
+	for i, name := range br.Filenames {
+		results[i] = BatchItemResult{Name: name, NewName: path.Join(br.Album, path.Base(name)), Message: checkPicName(name)}
+	}
+	checkPermissions(req, results)
+	checkSources(results)
+	checkTargets(results)
+
+	// Create the album directory up front:
+	albumPath := path.Join(picsDir, br.Album)
+	if fi, err := os.Stat(albumPath); err == nil && !fi.IsDir() {
+		return nil, NewHttpError(http.StatusBadRequest, "Album name is taken by a file", fmt.Errorf("'%s' is not a directory", albumPath))
+	}
+	if err := os.MkdirAll(albumPath, 0775); err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "Unable to create album", err)
+	}
+
+	return runBatch(results, renameSteps(results)), nil
+}
+
+// Checks for targets that already exist or are named twice:
+func checkTargets(results []BatchItemResult) {
+	seen := make(map[string]bool)
+	for i := range results {
+		r := &results[i]
+		if r.Message != "" {
+			continue
+		}
+		if seen[r.NewName] {
+			r.Message = "Target named more than once"
+		} else if _, err := os.Lstat(path.Join(picsDir, r.NewName)); err == nil {
+			r.Message = "Target already exists"
+		}
+		seen[r.NewName] = true
+	}
+}
+
+func renameSteps(results []BatchItemResult) []batchStep {
+	steps := make([]batchStep, len(results))
+	for i := range results {
+		r := &results[i]
+		steps[i] = batchStep{
+			result: r,
+			do:     func() error { return renamePic(r.Name, r.NewName) },
+			undo:   func() error { return renamePic(r.NewName, r.Name) },
+		}
+	}
+	return steps
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Posts a form-encoded batch request to `handler`:
+func testBatch(t *testing.T, handler JsonHandlerFunc, form url.Values) BatchResult {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/batch/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	v, err := handler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.(BatchResult)
+}
+
+// Reports the content of the named picture, or "" if it does not exist:
+func readTestPic(t *testing.T, rel string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path.Join(picsDir, rel))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCheckBatchNames(t *testing.T) {
+	for name, ok := range map[string]bool{"a.jpg": true, "album/a.jpg": true, "": false, "/a.jpg": false, "../a.jpg": false,
+		"..": false, "album/../a.jpg": false, "album//a.jpg": false, ".tags.json": false, ".trash/a.jpg": false} {
+		if got := checkPicName(name); (got == "") != ok {
+			t.Errorf("checkPicName(%q) = %q", name, got)
+		}
+	}
+	for album, ok := range map[string]bool{"album": true, "2024/summer": true, "": false, "/album": false, "..": false,
+		"album/": false, "a/../b": false, ".trash": false, "album/.hidden": false} {
+		if got := checkAlbumName(album); (got == "") != ok {
+			t.Errorf("checkAlbumName(%q) = %q", album, got)
+		}
+	}
+}
+
+func TestParseBatchRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/batch/rename", strings.NewReader(`{"renames":[{"from":"a.jpg","to":"b.jpg"}],"album":"x"}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	br, err := parseBatchRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BatchRequest{Renames: []BatchRename{{"a.jpg", "b.jpg"}}, Album: "x"}); !reflect.DeepEqual(br, want) {
+		t.Errorf("JSON: got %+v, want %+v", br, want)
+	}
+
+	form := url.Values{"filename": {"a.jpg", "b.jpg"}, "from": {"c.jpg", "d.jpg"}, "to": {"e.jpg", "f.jpg"}, "album": {"x"}}
+	req = httptest.NewRequest("POST", "/batch/rename", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if br, err = parseBatchRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	want := BatchRequest{Filenames: []string{"a.jpg", "b.jpg"}, Renames: []BatchRename{{"c.jpg", "e.jpg"}, {"d.jpg", "f.jpg"}}, Album: "x"}
+	if !reflect.DeepEqual(br, want) {
+		t.Errorf("form: got %+v, want %+v", br, want)
+	}
+
+	tests := []struct {
+		name, method, contentType, body string
+	}{
+		{"GET", "GET", "", ""},
+		{"bad JSON", "POST", "application/json", "{"},
+		{"unpaired to", "POST", "application/x-www-form-urlencoded", "from=a.jpg&to=b.jpg&to=c.jpg"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/batch/rename", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		if _, err := parseBatchRequest(req); err == nil {
+			t.Errorf("%s: parsed", tt.name)
+		}
+	}
+}
+
+func TestBatchRenameValidation(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "a.jpg", []byte("a"))
+	writeTestPic(t, "b.jpg", []byte("b"))
+	writeTestPic(t, "c.jpg", []byte("c"))
+
+	// One bad item fails the whole batch before anything is touched:
+	result := testBatch(t, batchRenameJsonHandler, url.Values{"from": {"a.jpg", "b.jpg"}, "to": {"x.jpg", "c.jpg"}})
+	if result.Success || result.Items[0].Message != "Not attempted" || result.Items[1].Message != "Target already exists" {
+		t.Errorf("got %+v", result)
+	}
+	if readTestPic(t, "a.jpg") != "a" || readTestPic(t, "x.jpg") != "" || readTestPic(t, "c.jpg") != "c" {
+		t.Error("files changed by a batch that failed validation")
+	}
+
+	tests := []struct {
+		from, to []string
+		message  string
+	}{
+		{[]string{"nope.jpg"}, []string{"x.jpg"}, "File not found"},
+		{[]string{"a.jpg", "a.jpg"}, []string{"x.jpg", "y.jpg"}, "File named more than once"},
+		{[]string{"a.jpg", "b.jpg"}, []string{"x.jpg", "x.jpg"}, "Target named more than once"},
+		{[]string{"a.jpg"}, []string{"../x.jpg"}, "Invalid file name"},
+	}
+	for _, tt := range tests {
+		result := testBatch(t, batchRenameJsonHandler, url.Values{"from": tt.from, "to": tt.to})
+		if last := result.Items[len(result.Items)-1]; result.Success || last.Message != tt.message {
+			t.Errorf("%v -> %v: got %+v, want %q", tt.from, tt.to, result, tt.message)
+		}
+	}
+
+	// And a good batch goes through, moving tags along:
+	if err := tagStore.AddTags([]string{"a.jpg"}, []string{"beach"}); err != nil {
+		t.Fatal(err)
+	}
+	result = testBatch(t, batchRenameJsonHandler, url.Values{"from": {"a.jpg", "b.jpg"}, "to": {"b.jpg.new", "a.jpg.new"}})
+	if !result.Success || !result.Items[0].Success || !result.Items[1].Success {
+		t.Errorf("got %+v", result)
+	}
+	if readTestPic(t, "b.jpg.new") != "a" || readTestPic(t, "a.jpg.new") != "b" || readTestPic(t, "a.jpg") != "" {
+		t.Error("files not renamed")
+	}
+	if tags := tagStore.Tags("b.jpg.new"); !reflect.DeepEqual(tags, []string{"beach"}) {
+		t.Errorf("tags of renamed picture %v", tags)
+	}
+}
+
+func TestBatchRenameRollsBack(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "a.jpg", []byte("a"))
+	writeTestPic(t, "b.jpg", []byte("b"))
+	writeTestPic(t, "c.jpg", []byte("c"))
+	if err := tagStore.AddTags([]string{"a.jpg"}, []string{"beach"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// b.jpg validated, but is gone by the time it is renamed:
+	results := []BatchItemResult{{Name: "a.jpg", NewName: "x.jpg"}, {Name: "b.jpg", NewName: "y.jpg"}, {Name: "c.jpg", NewName: "z.jpg"}}
+	if err := os.Remove(path.Join(picsDir, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	result := runBatch(results, renameSteps(results))
+	if result.Success {
+		t.Fatal("batch succeeded")
+	}
+	if r := result.Items[0]; r.Success || r.Message != "Rolled back" {
+		t.Errorf("first item %+v", r)
+	}
+	if r := result.Items[1]; r.Success || r.Message == "" {
+		t.Errorf("failed item %+v", r)
+	}
+	if r := result.Items[2]; r.Success || r.Message != "Not attempted" {
+		t.Errorf("last item %+v", r)
+	}
+	if readTestPic(t, "a.jpg") != "a" || readTestPic(t, "x.jpg") != "" || readTestPic(t, "c.jpg") != "c" || readTestPic(t, "z.jpg") != "" {
+		t.Error("files not rolled back")
+	}
+	if tags := tagStore.Tags("a.jpg"); !reflect.DeepEqual(tags, []string{"beach"}) {
+		t.Errorf("tags after roll back %v", tags)
+	}
+}
+
+func TestBatchMoveAndDelete(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "a.jpg", []byte("a"))
+	writeTestPic(t, "b.jpg", []byte("b"))
+
+	for _, album := range []string{"", "../out", ".trash"} {
+		req := httptest.NewRequest("POST", "/batch/move", strings.NewReader(url.Values{"filename": {"a.jpg"}, "album": {album}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if _, err := batchMoveJsonHandler(req); err == nil {
+			t.Errorf("moved into %q", album)
+		}
+	}
+	result := testBatch(t, batchMoveJsonHandler, url.Values{"filename": {"a.jpg", "b.jpg"}, "album": {"2024/summer"}})
+	if !result.Success || result.Items[0].NewName != "2024/summer/a.jpg" {
+		t.Errorf("move: got %+v", result)
+	}
+	if readTestPic(t, "2024/summer/a.jpg") != "a" || readTestPic(t, "2024/summer/b.jpg") != "b" {
+		t.Error("files not moved")
+	}
+
+	result = testBatch(t, batchDeleteJsonHandler, url.Values{"filename": {"2024/summer/a.jpg", "2024/summer/b.jpg"}})
+	if !result.Success || result.Items[0].TrashID == "" || result.Items[1].TrashID == "" {
+		t.Fatalf("delete: got %+v", result)
+	}
+	if readTestPic(t, "2024/summer/a.jpg") != "" {
+		t.Error("deleted file still there")
+	}
+	if _, err := undeletePic(result.Items[0].TrashID); err != nil {
+		t.Fatal(err)
+	}
+	if readTestPic(t, "2024/summer/a.jpg") != "a" {
+		t.Error("file not restored")
+	}
+}
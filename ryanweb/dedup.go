@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// What to do when an upload's content is identical to an existing picture:
+type dedupMode int
+
+const (
+	// Discard the upload and report the existing file:
+	dedupReject dedupMode = iota
+	// Store the content once and hard-link the uploaded name to it. Unlike a symlink, the link survives the original
+	// being trashed, renamed or moved:
+	dedupAlias
+)
+
+func parseDedupMode(s string) (dedupMode, error) {
+	switch strings.ToLower(s) {
+	case "reject":
+		return dedupReject, nil
+	case "alias", "link":
+		// "link" once made symlinks, which dangled once the original moved:
+		return dedupAlias, nil
+	default:
+		return dedupReject, fmt.Errorf(`unknown duplicate mode '%s'; expected "reject", "link" or "alias"`, s)
+	}
+}
+
+// Content-addressed index of the files in `picsDir`:
+type HashIndex struct {
+	lock   sync.RWMutex
+	byHash map[string]string
+	byName map[string]string
+}
+
+func NewHashIndex() *HashIndex {
+	return &HashIndex{
+		byHash: make(map[string]string),
+		byName: make(map[string]string),
+	}
+}
+
+// Returns the name of the first file known with the given hash:
+func (x *HashIndex) Lookup(hash string) (name string, ok bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	name, ok = x.byHash[hash]
+	return
+}
+
+// Returns the hash of the named file:
+func (x *HashIndex) HashOf(name string) (hash string, ok bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	hash, ok = x.byName[name]
+	return
+}
+
+func (x *HashIndex) Add(name, hash string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if old, ok := x.byName[name]; ok && old != hash {
+		// The file's content changed:
+		x.remove(name)
+	}
+	x.byName[name] = hash
+	if _, ok := x.byHash[hash]; !ok {
+		x.byHash[hash] = name
+	}
+}
+
+func (x *HashIndex) Remove(name string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.remove(name)
+}
+
+func (x *HashIndex) remove(name string) {
+	hash, ok := x.byName[name]
+	if !ok {
+		return
+	}
+	delete(x.byName, name)
+	if x.byHash[hash] != name {
+		return
+	}
+
+	// Promote another file with the same content, if any:
+	delete(x.byHash, hash)
+	for n, h := range x.byName {
+		if h == hash {
+			x.byHash[hash] = n
+			break
+		}
+	}
+}
+
+// Rebuilds the index from the files currently in `picsDir` and its albums:
+func (x *HashIndex) Rebuild(dir string) error {
+	byHash := make(map[string]string)
+	byName := make(map[string]string)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isHiddenName(fi.Name()) && p != dir {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		name := relPicPath(dir, p)
+		hash, err := hashFile(p)
+		if err != nil {
+			log.Printf("Could not hash '%s'; %s\n", name, err)
+			return nil
+		}
+
+		byName[name] = hash
+		if _, ok := byHash[hash]; !ok {
+			byHash[hash] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	x.lock.Lock()
+	x.byHash, x.byName = byHash, byName
+	x.lock.Unlock()
+	return nil
+}
+
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Names starting with '.' are reserved for our own temporary and bookkeeping files:
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
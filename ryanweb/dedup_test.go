@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseDedupMode(t *testing.T) {
+	for s, want := range map[string]dedupMode{"reject": dedupReject, "alias": dedupAlias, "Link": dedupAlias} {
+		if got, err := parseDedupMode(s); err != nil || got != want {
+			t.Errorf("parseDedupMode(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := parseDedupMode("symlink"); err == nil {
+		t.Error("parsed symlink")
+	}
+}
+
+func TestStoreUploadDuplicates(t *testing.T) {
+	setupTestStores(t)
+	defer func(d dedupMode) { dedup = d }(dedup)
+	content := []byte("picture data")
+
+	dedup = dedupReject
+	if r, err := storeUpload("a.jpg", bytes.NewReader(content)); err != nil || r.Action != "stored" {
+		t.Fatalf("first upload: %+v %v", r, err)
+	}
+	if r, err := storeUpload("a.jpg", bytes.NewReader(content)); err != nil || r.Action != "unchanged" {
+		t.Errorf("same upload again: %+v %v", r, err)
+	}
+	if r, err := storeUpload("b.jpg", bytes.NewReader(content)); err != nil || r.Action != "rejected" || r.DuplicateOf != "a.jpg" {
+		t.Errorf("rejected duplicate: %+v %v", r, err)
+	}
+	if _, err := os.Lstat(path.Join(picsDir, "b.jpg")); !os.IsNotExist(err) {
+		t.Errorf("rejected duplicate was stored; %v", err)
+	}
+
+	dedup = dedupAlias
+	if err := os.Mkdir(path.Join(picsDir, "album"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := storeUpload("album/c.jpg", bytes.NewReader(content)); err != nil || r.Action != "aliased" || r.DuplicateOf != "a.jpg" {
+		t.Fatalf("aliased duplicate: %+v %v", r, err)
+	}
+	a, err := os.Lstat(path.Join(picsDir, "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := os.Lstat(path.Join(picsDir, "album/c.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Mode().IsRegular() || !os.SameFile(a, c) {
+		t.Errorf("album/c.jpg is %v, not a hard link to a.jpg", c.Mode())
+	}
+
+	// The alias outlives the original being trashed, and is found by content afterwards:
+	if _, err := trashFile("a.jpg", "ryan"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(picsDir, "album/c.jpg")); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("alias reads %q %v after trashing the original", b, err)
+	}
+	if err := hashIndex.Rebuild(picsDir); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := storeUpload("d.jpg", bytes.NewReader(content)); err != nil || r.Action != "aliased" || r.DuplicateOf != "album/c.jpg" {
+		t.Errorf("duplicate of the alias: %+v %v", r, err)
+	}
+}
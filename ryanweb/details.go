@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type DetailsViewModel struct {
+	Name        string
+	Breadcrumbs []BreadcrumbViewModel
+	PicURL      string
+	ThumbURL    string
+	Mime        string
+	Size        int64
+	LastMod     string
+	Dimensions  string
+	Duration    string
+	Codecs      string
+	Hash        string
+	Taken       string
+	Camera      string
+	Lens        string
+	Exposure    string
+	Location    string
+	Altitude    string
+	Caption     string
+	UserCaption string
+	Rating      int
+	Tags        []string
+	Albums      []string
+}
+
+// Summarizes exposure settings, e.g. "1/120 s, f/1.8, ISO 100, 4.4 mm":
+func formatExposure(meta PicMeta) string {
+	parts := make([]string, 0, 4)
+	if meta.ExposureTime != "" {
+		parts = append(parts, meta.ExposureTime+" s")
+	}
+	if meta.FNumber > 0 {
+		parts = append(parts, "f/"+strconv.FormatFloat(meta.FNumber, 'f', -1, 64))
+	}
+	if meta.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", meta.ISO))
+	}
+	if meta.FocalLength > 0 {
+		parts = append(parts, strconv.FormatFloat(meta.FocalLength, 'f', -1, 64)+" mm")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// HTML handler for `/details/<path>`:
+func detailsHandler(rsp http.ResponseWriter, req *http.Request) error {
+	rel, ok := safeRelPath(removePrefix(req.URL.Path, detailsURL))
+	if !ok || rel == "" {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("Refusing path '%s'", req.URL.Path))
+	}
+	if err := requireViewPic(req, rel); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path.Join(picsDir, rel))
+	if err != nil || fi.IsDir() {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("No file '%s'", rel))
+	}
+
+	// Computes the metadata now if the background queue has not got to it yet:
+	meta, err := refreshPicMeta(rel)
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, "Could not read file metadata", err)
+	}
+	meta = privatePicMeta(meta)
+
+	model := DetailsViewModel{
+		Name:        path.Base(rel),
+		Breadcrumbs: breadcrumbs(albumOf(rel)),
+		PicURL:      pjoin(picsURL, rel),
+		Mime:        getMimeType(rel),
+		Size:        fi.Size(),
+		LastMod:     fi.ModTime().String(),
+		Hash:        meta.Hash,
+		Camera:      meta.Camera,
+		Lens:        meta.Lens,
+		Exposure:    formatExposure(meta),
+		Caption:     meta.Caption,
+		UserCaption: tagStore.Caption(rel),
+		Rating:      meta.Rating,
+		Tags:        tagStore.Tags(rel),
+		Albums:      tagStore.AlbumsOf(rel),
+	}
+	if hasThumbnail(rel) {
+		model.ThumbURL = pjoin(thumbsURL, rel)
+	}
+	if meta.Width > 0 {
+		model.Dimensions = fmt.Sprintf("%dx%d", meta.Width, meta.Height)
+	}
+	if meta.Duration > 0 {
+		model.Duration = meta.Duration.String()
+		model.Codecs = describeCodecs(meta)
+	}
+	if !meta.Taken.IsZero() {
+		model.Taken = meta.Taken.String()
+	}
+	if meta.GPS != nil {
+		model.Location = fmt.Sprintf("%.6f, %.6f", meta.GPS.Lat, meta.GPS.Lon)
+		if meta.GPS.Alt != 0 {
+			model.Altitude = fmt.Sprintf("%.0f m", meta.GPS.Alt)
+		}
+	}
+
+	return renderTemplate(rsp, http.StatusOK, "details.html", model)
+}
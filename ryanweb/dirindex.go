@@ -0,0 +1,398 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/fsnotify/fsnotify"
+)
+
+// In-memory index of `picsDir` and its album subdirectories, kept current by filesystem notifications.
+// Entries are keyed by their path relative to `picsDir`; the root album is "".
+type DirIndex struct {
+	lock    sync.RWMutex
+	dir     string
+	watcher *fsnotify.Watcher
+	// Album path -> entry name -> entry:
+	albums map[string]map[string]os.FileInfo
+	// When we last saw each entry's size or modification time change:
+	changed map[string]time.Time
+	// Files we wrote ourselves and so know to be complete, as of when we finished:
+	complete map[string]os.FileInfo
+}
+
+func NewDirIndex(dir string) *DirIndex {
+	return &DirIndex{
+		dir:      dir,
+		albums:   map[string]map[string]os.FileInfo{"": {}},
+		changed:  make(map[string]time.Time),
+		complete: make(map[string]os.FileInfo),
+	}
+}
+
+func sameFileInfo(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// Reads the tree rooted at album `root`, skipping hidden files and directories:
+func (x *DirIndex) walk(root string) (map[string]map[string]os.FileInfo, error) {
+	albums := make(map[string]map[string]os.FileInfo)
+	err := filepath.Walk(path.Join(x.dir, root), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Entries may vanish while we walk:
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel := relPicPath(x.dir, p)
+		if rel == root {
+			albums[rel] = make(map[string]os.FileInfo)
+			return nil
+		}
+		if isHiddenName(fi.Name()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.IsDir() {
+			albums[rel] = make(map[string]os.FileInfo)
+		}
+		if entries, ok := albums[albumOf(rel)]; ok {
+			entries[fi.Name()] = fi
+		}
+		return nil
+	})
+	return albums, err
+}
+
+// Converts an absolute path under `dir` to a path relative to it:
+func relPicPath(dir, p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+}
+
+// Re-reads the whole tree, queueing metadata refreshes for anything that changed behind our back:
+func (x *DirIndex) Rescan() error {
+	albums, err := x.walk("")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	x.lock.Lock()
+	old := x.albums
+	x.albums = albums
+	for album, entries := range albums {
+		for name, fi := range entries {
+			if prev, ok := old[album][name]; ok && !sameFileInfo(prev, fi) {
+				x.changed[path.Join(album, name)] = now
+			}
+		}
+	}
+	for rel := range x.changed {
+		if _, ok := x.lookup(rel); !ok {
+			delete(x.changed, rel)
+		}
+	}
+	for rel := range x.complete {
+		if _, ok := x.lookup(rel); !ok {
+			delete(x.complete, rel)
+		}
+	}
+	x.lock.Unlock()
+
+	x.watchAlbums(albums)
+	for album, entries := range albums {
+		for name, fi := range entries {
+			if prev, ok := old[album][name]; (!ok || !sameFileInfo(prev, fi)) && !fi.IsDir() {
+				queuePicMeta(path.Join(album, name))
+			}
+		}
+	}
+	for album, entries := range old {
+		for name, fi := range entries {
+			if _, ok := albums[album][name]; !ok && !fi.IsDir() {
+				forgetPic(path.Join(album, name))
+			}
+		}
+	}
+	return nil
+}
+
+// Must be called with the lock held:
+func (x *DirIndex) lookup(rel string) (os.FileInfo, bool) {
+	fi, ok := x.albums[albumOf(rel)][path.Base(rel)]
+	return fi, ok
+}
+
+// Watches the directories of the given albums; fsnotify is not recursive:
+func (x *DirIndex) watchAlbums(albums map[string]map[string]os.FileInfo) {
+	if x.watcher == nil {
+		return
+	}
+	for album := range albums {
+		if err := x.watcher.Add(path.Join(x.dir, album)); err != nil {
+			log.Printf("Could not watch album '%s'; %s\n", album, err)
+		}
+	}
+}
+
+// Refreshes a single entry, given its path relative to `picsDir`:
+func (x *DirIndex) Update(rel string) {
+	if rel == "" || hasHiddenComponent(rel) {
+		return
+	}
+	album, name := albumOf(rel), path.Base(rel)
+
+	// Make sure the containing album is known first, e.g. after a batch move created it:
+	x.lock.RLock()
+	_, known := x.albums[album]
+	x.lock.RUnlock()
+	if !known {
+		x.Update(album)
+		return
+	}
+
+	fi, err := os.Lstat(path.Join(x.dir, rel))
+	if err == nil && fi.IsDir() {
+		x.lock.RLock()
+		_, known := x.albums[rel]
+		x.lock.RUnlock()
+		if !known {
+			x.addTree(rel, fi)
+			return
+		}
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	entries := x.albums[album]
+	if entries == nil {
+		return
+	}
+	if err != nil {
+		delete(entries, name)
+		delete(x.changed, rel)
+		delete(x.complete, rel)
+
+		// Drop a removed album along with everything in it:
+		for a := range x.albums {
+			if a == rel || strings.HasPrefix(a, rel+"/") {
+				delete(x.albums, a)
+			}
+		}
+		return
+	}
+	if prev, ok := entries[name]; ok && !sameFileInfo(prev, fi) {
+		x.changed[rel] = time.Now()
+	}
+	entries[name] = fi
+}
+
+// Adds a newly appeared album directory and everything already inside it:
+func (x *DirIndex) addTree(rel string, fi os.FileInfo) {
+	albums, err := x.walk(rel)
+	if err != nil {
+		log.Printf("Could not read album '%s'; %s\n", rel, err)
+		return
+	}
+
+	x.lock.Lock()
+	for a, entries := range albums {
+		x.albums[a] = entries
+	}
+	if parent, ok := x.albums[albumOf(rel)]; ok {
+		parent[fi.Name()] = fi
+	}
+	x.lock.Unlock()
+
+	x.watchAlbums(albums)
+	for a, entries := range albums {
+		for name, fi := range entries {
+			if !fi.IsDir() {
+				queuePicMeta(path.Join(a, name))
+			}
+		}
+	}
+}
+
+// Refreshes an entry we just finished writing ourselves, exempting it from in-progress detection until it changes again:
+func (x *DirIndex) Complete(rel string) {
+	x.Update(rel)
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if fi, ok := x.lookup(rel); ok {
+		x.complete[rel] = fi
+	}
+}
+
+// Reports whether the album exists:
+func (x *DirIndex) HasAlbum(album string) bool {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	_, ok := x.albums[album]
+	return ok
+}
+
+// Returns a copy of an album's entries that are not presumed mid-upload, in no particular order:
+func (x *DirIndex) Settled(album string) []os.FileInfo {
+	now, open := time.Now(), openFilesSnapshot()
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	entries := x.albums[album]
+	fis := make([]os.FileInfo, 0, len(entries))
+	for name, fi := range entries {
+		if x.settled(path.Join(album, name), fi, now, open) {
+			fis = append(fis, fi)
+		}
+	}
+	return fis
+}
+
+// Reports whether an entry is not presumed mid-upload; must be called with the lock held:
+func (x *DirIndex) settled(rel string, fi os.FileInfo, now time.Time, open map[string]bool) bool {
+	if c, ok := x.complete[rel]; ok && sameFileInfo(c, fi) {
+		return true
+	}
+	return !inProgress(rel, fi, x.changed[rel], now, open)
+}
+
+// Returns the paths of all files in all albums:
+func (x *DirIndex) AllFiles() []string {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	files := make([]string, 0)
+	for album, entries := range x.albums {
+		for name, fi := range entries {
+			if !fi.IsDir() {
+				files = append(files, path.Join(album, name))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Returns the paths of all files in all albums that are not presumed mid-upload, and whether any were left out:
+func (x *DirIndex) SettledFiles() (files []string, pending bool) {
+	now, open := time.Now(), openFilesSnapshot()
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	files = make([]string, 0)
+	for album, entries := range x.albums {
+		for name, fi := range entries {
+			if fi.IsDir() {
+				continue
+			}
+			if rel := path.Join(album, name); x.settled(rel, fi, now, open) {
+				files = append(files, rel)
+			} else {
+				pending = true
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, pending
+}
+
+// Picks the newest image or video in an album, or failing that in its sub-albums, for its cover; "" if there is none.
+// Sub-albums for which `visible` is false are passed over:
+func (x *DirIndex) Cover(album string, visible func(album string) bool) string {
+	fis := x.Settled(album)
+	sort.Sort(ByDate{fis, sortDescending})
+	for _, fi := range fis {
+		if !fi.IsDir() && hasThumbnail(fi.Name()) {
+			return path.Join(album, fi.Name())
+		}
+	}
+	for _, fi := range fis {
+		if sub := path.Join(album, fi.Name()); fi.IsDir() && visible(sub) {
+			if cover := x.Cover(sub, visible); cover != "" {
+				return cover
+			}
+		}
+	}
+	return ""
+}
+
+// Follows filesystem notifications for the tree, plus a full rescan every `rescan` as a safety net:
+func (x *DirIndex) Watch(rescan time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(x.dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	x.lock.Lock()
+	x.watcher = w
+	albums := x.albums
+	x.lock.Unlock()
+	x.watchAlbums(albums)
+
+	go func() {
+		tick := time.Tick(rescan)
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				x.handleEvent(ev)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// Events may have been dropped (e.g. queue overflow); resync:
+				log.Printf("Directory watch error; rescanning: %s\n", err)
+				if err := x.Rescan(); err != nil {
+					log.Printf("Could not rescan '%s'; %s\n", x.dir, err)
+				}
+			case <-tick:
+				if err := x.Rescan(); err != nil {
+					log.Printf("Could not rescan '%s'; %s\n", x.dir, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (x *DirIndex) handleEvent(ev fsnotify.Event) {
+	rel := relPicPath(x.dir, ev.Name)
+	if rel == "" || hasHiddenComponent(rel) {
+		return
+	}
+
+	x.Update(rel)
+	switch {
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		if _, err := os.Lstat(ev.Name); os.IsNotExist(err) {
+			forgetPic(rel)
+		}
+	case ev.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		if fi, err := os.Lstat(ev.Name); err == nil && !fi.IsDir() {
+			queuePicMeta(rel)
+		}
+	}
+}
+
+// Drops index entries for a picture that no longer exists:
+func forgetPic(rel string) {
+	hashIndex.Remove(rel)
+	metaCache.Remove(rel)
+	searchIndex.Invalidate()
+}
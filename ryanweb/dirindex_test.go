@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/fsnotify/fsnotify"
+)
+
+// Writes a file under `picsDir` without telling the index:
+func writeUnindexedPic(t *testing.T, rel, data string) {
+	t.Helper()
+	p := path.Join(picsDir, rel)
+	if err := os.MkdirAll(path.Dir(p), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(data), 0664); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Empties the metadata queue, returning what was in it:
+func drainMetaQueue() map[string]bool {
+	queued := make(map[string]bool)
+	for len(metaQueue) > 0 {
+		queued[<-metaQueue] = true
+	}
+	return queued
+}
+
+func entryNames(fis []os.FileInfo) []string {
+	names := extractNames(fis)
+	sort.Strings(names)
+	return names
+}
+
+func TestDirIndexUpdate(t *testing.T) {
+	setupTestStores(t)
+	defer drainMetaQueue()
+	writeUnindexedPic(t, "a.jpg", "a")
+	writeUnindexedPic(t, ".tags.json", "{}")
+	picIndex.Update("a.jpg")
+	picIndex.Update(".tags.json")
+	if got := picIndex.AllFiles(); !reflect.DeepEqual(got, []string{"a.jpg"}) {
+		t.Errorf("after adding a file: %v", got)
+	}
+
+	// A file in albums we have not seen brings the whole new tree in:
+	writeUnindexedPic(t, "2024/summer/b.jpg", "b")
+	writeUnindexedPic(t, "2024/summer/c.jpg", "c")
+	writeUnindexedPic(t, "2024/summer/.hidden/d.jpg", "d")
+	drainMetaQueue()
+	picIndex.Update("2024/summer/b.jpg")
+	if !picIndex.HasAlbum("2024") || !picIndex.HasAlbum("2024/summer") || picIndex.HasAlbum("2024/summer/.hidden") {
+		t.Error("new albums not indexed")
+	}
+	if got := entryNames(picIndex.Settled("2024/summer")); !reflect.DeepEqual(got, []string{"b.jpg", "c.jpg"}) {
+		t.Errorf("new album holds %v", got)
+	}
+	if got := entryNames(picIndex.Settled("")); !reflect.DeepEqual(got, []string{"2024", "a.jpg"}) {
+		t.Errorf("root holds %v", got)
+	}
+	if queued := drainMetaQueue(); !queued["2024/summer/b.jpg"] || !queued["2024/summer/c.jpg"] || len(queued) != 2 {
+		t.Errorf("queued %v", queued)
+	}
+
+	// Removing an album drops its sub-albums too:
+	if err := os.RemoveAll(path.Join(picsDir, "2024")); err != nil {
+		t.Fatal(err)
+	}
+	picIndex.Update("2024")
+	if picIndex.HasAlbum("2024") || picIndex.HasAlbum("2024/summer") {
+		t.Error("removed albums still indexed")
+	}
+	if got := picIndex.AllFiles(); !reflect.DeepEqual(got, []string{"a.jpg"}) {
+		t.Errorf("after removing the album: %v", got)
+	}
+
+	if err := os.Remove(path.Join(picsDir, "a.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	picIndex.Update("a.jpg")
+	if got := picIndex.AllFiles(); len(got) != 0 {
+		t.Errorf("after removing the file: %v", got)
+	}
+}
+
+func TestDirIndexRescan(t *testing.T) {
+	setupTestStores(t)
+	defer drainMetaQueue()
+	writeUnindexedPic(t, "a.jpg", "a")
+	writeUnindexedPic(t, "b.jpg", "b")
+	writeUnindexedPic(t, "album/c.jpg", "c")
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if got := picIndex.AllFiles(); !reflect.DeepEqual(got, []string{"a.jpg", "album/c.jpg", "b.jpg"}) {
+		t.Errorf("first scan: %v", got)
+	}
+	if queued := drainMetaQueue(); len(queued) != 3 {
+		t.Errorf("first scan queued %v", queued)
+	}
+
+	// Only what changed behind our back is queued again; what vanished is forgotten:
+	metaCache.Put("b.jpg", PicMeta{Version: picMetaVersion})
+	hashIndex.Add("b.jpg", "hash-b")
+	writeUnindexedPic(t, "a.jpg", "changed")
+	writeUnindexedPic(t, "album/d.jpg", "d")
+	if err := os.Remove(path.Join(picsDir, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if queued := drainMetaQueue(); !reflect.DeepEqual(queued, map[string]bool{"a.jpg": true, "album/d.jpg": true}) {
+		t.Errorf("second scan queued %v", queued)
+	}
+	if _, ok := metaCache.Get("b.jpg"); ok {
+		t.Error("metadata of removed file kept")
+	}
+	if _, ok := hashIndex.HashOf("b.jpg"); ok {
+		t.Error("hash of removed file kept")
+	}
+
+	// A file seen to change has just been written to, so is presumed mid-upload:
+	picIndex.lock.RLock()
+	_, changed := picIndex.changed["a.jpg"]
+	picIndex.lock.RUnlock()
+	if !changed {
+		t.Error("change to a.jpg not noted")
+	}
+}
+
+func TestDirIndexHandleEvent(t *testing.T) {
+	setupTestStores(t)
+	defer drainMetaQueue()
+	writeUnindexedPic(t, "a.jpg", "a")
+	picIndex.handleEvent(fsnotify.Event{Name: path.Join(picsDir, "a.jpg"), Op: fsnotify.Create})
+	picIndex.handleEvent(fsnotify.Event{Name: path.Join(picsDir, ".tags.json"), Op: fsnotify.Create})
+	if got := picIndex.AllFiles(); !reflect.DeepEqual(got, []string{"a.jpg"}) {
+		t.Errorf("after create: %v", got)
+	}
+	if queued := drainMetaQueue(); !reflect.DeepEqual(queued, map[string]bool{"a.jpg": true}) {
+		t.Errorf("create queued %v", queued)
+	}
+
+	metaCache.Put("a.jpg", PicMeta{Version: picMetaVersion})
+	if err := os.Rename(path.Join(picsDir, "a.jpg"), path.Join(picsDir, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	picIndex.handleEvent(fsnotify.Event{Name: path.Join(picsDir, "a.jpg"), Op: fsnotify.Rename})
+	picIndex.handleEvent(fsnotify.Event{Name: path.Join(picsDir, "b.jpg"), Op: fsnotify.Create})
+	if got := picIndex.AllFiles(); !reflect.DeepEqual(got, []string{"b.jpg"}) {
+		t.Errorf("after rename: %v", got)
+	}
+	if _, ok := metaCache.Get("a.jpg"); ok {
+		t.Error("metadata of renamed file kept under its old name")
+	}
+}
+
+func TestDirIndexWatchesNewAlbums(t *testing.T) {
+	setupTestStores(t)
+	defer drainMetaQueue()
+	// Handle events here rather than in `Watch`'s goroutine, which would outlive the test:
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	picIndex.watcher = w
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	handleUntil := func(what string, cond func() bool) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for !cond() {
+			select {
+			case ev := <-w.Events:
+				picIndex.handleEvent(ev)
+			case err := <-w.Errors:
+				t.Fatal(err)
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	// fsnotify is not recursive, so albums must be watched as they appear:
+	if err := os.Mkdir(path.Join(picsDir, "album"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	handleUntil("album", func() bool { return picIndex.HasAlbum("album") })
+	writeUnindexedPic(t, "album/a.jpg", "a")
+	handleUntil("album/a.jpg", func() bool { return reflect.DeepEqual(picIndex.AllFiles(), []string{"album/a.jpg"}) })
+	if err := os.Remove(path.Join(picsDir, "album/a.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	handleUntil("removal of album/a.jpg", func() bool { return len(picIndex.AllFiles()) == 0 })
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal EXIF reader: locates the APP1 segment of a JPEG and decodes its TIFF image file directories.
+
+var errNoExif = errors.New("exif: no EXIF data")
+
+// TIFF tags we care about:
+const (
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagDateTime         = 0x0132
+	tagDateTimeOriginal = 0x9003
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagFocalLength      = 0x920A
+	tagLensMake         = 0xA433
+	tagLensModel        = 0xA434
+)
+
+// GPS IFD tags:
+const (
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// TIFF field types:
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+var tiffTypeSizes = map[uint16]int{
+	tiffByte: 1, tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffRational: 8,
+	tiffUndefined: 1, tiffSLong: 4, tiffSRational: 8,
+}
+
+// A raw TIFF directory entry:
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Data  []byte
+	order binary.ByteOrder
+}
+
+func (e tiffEntry) String() string {
+	return strings.TrimRight(string(e.Data), "\x00 ")
+}
+
+// Returns the i'th value of an integer field:
+func (e tiffEntry) Uint(i int) (uint32, bool) {
+	switch e.Type {
+	case tiffByte, tiffUndefined:
+		if i < len(e.Data) {
+			return uint32(e.Data[i]), true
+		}
+	case tiffShort:
+		if 2*i+2 <= len(e.Data) {
+			return uint32(e.order.Uint16(e.Data[2*i:])), true
+		}
+	case tiffLong, tiffSLong:
+		if 4*i+4 <= len(e.Data) {
+			return e.order.Uint32(e.Data[4*i:]), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the i'th value of a rational field as numerator and denominator:
+func (e tiffEntry) Rat(i int) (num, den int64, ok bool) {
+	if 8*i+8 > len(e.Data) {
+		return 0, 0, false
+	}
+	switch e.Type {
+	case tiffRational:
+		return int64(e.order.Uint32(e.Data[8*i:])), int64(e.order.Uint32(e.Data[8*i+4:])), true
+	case tiffSRational:
+		return int64(int32(e.order.Uint32(e.Data[8*i:]))), int64(int32(e.order.Uint32(e.Data[8*i+4:]))), true
+	}
+	return 0, 0, false
+}
+
+// Returns the i'th value of a rational field as a float:
+func (e tiffEntry) Float(i int) (float64, bool) {
+	num, den, ok := e.Rat(i)
+	if !ok || den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+type tiffIFD map[uint16]tiffEntry
+
+// Decoded EXIF directories:
+type exifDirs struct {
+	IFD0 tiffIFD
+	Exif tiffIFD
+	GPS  tiffIFD
+}
+
+func parseTIFF(b []byte) (*exifDirs, error) {
+	if len(b) < 8 {
+		return nil, errNoExif
+	}
+
+	var order binary.ByteOrder
+	switch string(b[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("exif: bad TIFF byte order")
+	}
+	if order.Uint16(b[2:4]) != 42 {
+		return nil, errors.New("exif: bad TIFF magic")
+	}
+
+	dirs := &exifDirs{}
+	var err error
+	if dirs.IFD0, err = parseIFD(b, order, order.Uint32(b[4:8])); err != nil {
+		return nil, err
+	}
+	if e, ok := dirs.IFD0[tagExifIFD]; ok {
+		if off, ok := e.Uint(0); ok {
+			dirs.Exif, _ = parseIFD(b, order, off)
+		}
+	}
+	if e, ok := dirs.IFD0[tagGPSIFD]; ok {
+		if off, ok := e.Uint(0); ok {
+			dirs.GPS, _ = parseIFD(b, order, off)
+		}
+	}
+	return dirs, nil
+}
+
+func parseIFD(b []byte, order binary.ByteOrder, offset uint32) (tiffIFD, error) {
+	if int64(offset)+2 > int64(len(b)) {
+		return nil, errors.New("exif: IFD offset out of range")
+	}
+	n := int(order.Uint16(b[offset:]))
+	pos := int(offset) + 2
+	if pos+12*n > len(b) {
+		return nil, errors.New("exif: IFD truncated")
+	}
+
+	ifd := make(tiffIFD, n)
+	for i := 0; i < n; i, pos = i+1, pos+12 {
+		tag := order.Uint16(b[pos:])
+		typ := order.Uint16(b[pos+2:])
+		count := order.Uint32(b[pos+4:])
+		size, ok := tiffTypeSizes[typ]
+		if !ok {
+			continue
+		}
+
+		// Values of up to 4 bytes are stored inline; larger ones at an offset:
+		total := int64(size) * int64(count)
+		var data []byte
+		if total <= 4 {
+			data = b[pos+8 : pos+8+int(total)]
+		} else {
+			off := int64(order.Uint32(b[pos+8:]))
+			if off+total > int64(len(b)) {
+				continue
+			}
+			data = b[off : off+total]
+		}
+		ifd[tag] = tiffEntry{Type: typ, Count: count, Data: data, order: order}
+	}
+	return ifd, nil
+}
+
+// Raw metadata segments of a JPEG; any may be nil:
+type jpegMeta struct {
+	// TIFF payload of the EXIF APP1 segment:
+	Exif []byte
+	// XMP packet from its APP1 segment:
+	XMP []byte
+	// Photoshop image resources from the APP13 segment, holding IPTC data:
+	Photoshop []byte
+}
+
+var (
+	jpegExifPrefix      = []byte("Exif\x00\x00")
+	jpegXMPPrefix       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegPhotoshopPrefix = []byte("Photoshop 3.0\x00")
+)
+
+// Collects the metadata segments of a JPEG stream, stopping at the start of scan:
+func readJPEGMeta(r io.Reader) (*jpegMeta, error) {
+	br := bufio.NewReader(r)
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:2]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return nil, errors.New("exif: not a JPEG")
+	}
+
+	meta := &jpegMeta{}
+	for {
+		if _, err := io.ReadFull(br, hdr[:4]); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, errors.New("exif: bad JPEG marker")
+		}
+		marker := hdr[1]
+		length := int(binary.BigEndian.Uint16(hdr[2:4])) - 2
+		if length < 0 {
+			return nil, errors.New("exif: bad JPEG segment length")
+		}
+
+		// Metadata segments all precede the start of scan:
+		if marker == 0xDA || marker == 0xD9 {
+			return meta, nil
+		}
+		if marker != 0xE1 && marker != 0xED {
+			if _, err := br.Discard(length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(br, seg); err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(seg, jpegExifPrefix) && meta.Exif == nil:
+			meta.Exif = seg[len(jpegExifPrefix):]
+		case marker == 0xE1 && bytes.HasPrefix(seg, jpegXMPPrefix) && meta.XMP == nil:
+			meta.XMP = seg[len(jpegXMPPrefix):]
+		case marker == 0xED && bytes.HasPrefix(seg, jpegPhotoshopPrefix):
+			// Large resource blocks may be split over several APP13 segments:
+			meta.Photoshop = append(meta.Photoshop, seg[len(jpegPhotoshopPrefix):]...)
+		}
+	}
+}
+
+// EXIF timestamps have no zone; interpret them as local time:
+func parseExifTime(s string) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", s, time.Local)
+	return t, err == nil
+}
+
+// When the picture was taken, preferring DateTimeOriginal over the IFD0 DateTime:
+func (d *exifDirs) Taken() (time.Time, bool) {
+	if e, ok := d.Exif[tagDateTimeOriginal]; ok {
+		if t, ok := parseExifTime(e.String()); ok {
+			return t, true
+		}
+	}
+	if e, ok := d.IFD0[tagDateTime]; ok {
+		return parseExifTime(e.String())
+	}
+	return time.Time{}, false
+}
+
+// The camera's make and model, e.g. "Google Pixel 7"; models usually already start with the make:
+func (d *exifDirs) Camera() string {
+	maker, model := d.IFD0[tagMake].String(), d.IFD0[tagModel].String()
+	if maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		return model
+	}
+	if model == "" {
+		return maker
+	}
+	return maker + " " + model
+}
+
+func (d *exifDirs) Lens() string {
+	maker, model := d.Exif[tagLensMake].String(), d.Exif[tagLensModel].String()
+	if maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		return model
+	}
+	return strings.TrimSpace(maker + " " + model)
+}
+
+// Exposure time as photographers write it, e.g. "1/120" or "2.5":
+func (d *exifDirs) ExposureTime() string {
+	num, den, ok := d.Exif[tagExposureTime].Rat(0)
+	if !ok || num <= 0 || den <= 0 {
+		return ""
+	}
+	if num < den {
+		return fmt.Sprintf("1/%d", (den+num/2)/num)
+	}
+	return strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+}
+
+func (d *exifDirs) FNumber() float64 {
+	f, _ := d.Exif[tagFNumber].Float(0)
+	return f
+}
+
+func (d *exifDirs) ISO() int {
+	iso, _ := d.Exif[tagISO].Uint(0)
+	return int(iso)
+}
+
+// Focal length in millimetres:
+func (d *exifDirs) FocalLength() float64 {
+	f, _ := d.Exif[tagFocalLength].Float(0)
+	return f
+}
+
+// Converts a degrees, minutes, seconds triple to signed decimal degrees:
+func gpsDegrees(e tiffEntry, ref string, negativeRef string) (float64, bool) {
+	var dms [3]float64
+	for i := range dms {
+		v, ok := e.Float(i)
+		if !ok {
+			return 0, false
+		}
+		dms[i] = v
+	}
+	deg := dms[0] + dms[1]/60 + dms[2]/3600
+	if strings.EqualFold(ref, negativeRef) {
+		deg = -deg
+	}
+	return deg, true
+}
+
+// Where the picture was taken, if recorded:
+func (d *exifDirs) Location() (*GeoPoint, bool) {
+	lat, ok := gpsDegrees(d.GPS[tagGPSLatitude], d.GPS[tagGPSLatitudeRef].String(), "S")
+	if !ok {
+		return nil, false
+	}
+	lon, ok := gpsDegrees(d.GPS[tagGPSLongitude], d.GPS[tagGPSLongitudeRef].String(), "W")
+	if !ok {
+		return nil, false
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, false
+	}
+
+	p := &GeoPoint{Lat: lat, Lon: lon}
+	if alt, ok := d.GPS[tagGPSAltitude].Float(0); ok {
+		// A reference of 1 means below sea level:
+		if ref, _ := d.GPS[tagGPSAltitudeRef].Uint(0); ref == 1 {
+			alt = -alt
+		}
+		p.Alt = alt
+	}
+	return p, true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// One entry of a test TIFF directory:
+type testTag struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, tiffASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(order binary.ByteOrder, tag uint16, v uint16) testTag {
+	b := make([]byte, 2)
+	order.PutUint16(b, v)
+	return testTag{tag, tiffShort, 1, b}
+}
+
+func ratTag(order binary.ByteOrder, tag uint16, nums ...uint32) testTag {
+	b := make([]byte, 4*len(nums))
+	for i, n := range nums {
+		order.PutUint32(b[4*i:], n)
+	}
+	return testTag{tag, tiffRational, uint32(len(nums) / 2), b}
+}
+
+// Lays out a TIFF with IFD0 and, if not nil, EXIF and GPS directories pointed to from it:
+func testTIFF(order binary.ByteOrder, ifd0, exif, gps []testTag) []byte {
+	ifd0 = append([]testTag(nil), ifd0...)
+	if exif != nil {
+		ifd0 = append(ifd0, testTag{tagExifIFD, tiffLong, 1, nil})
+	}
+	if gps != nil {
+		ifd0 = append(ifd0, testTag{tagGPSIFD, tiffLong, 1, nil})
+	}
+	ifds := [][]testTag{ifd0, exif, gps}
+
+	var offsets [3]uint32
+	end := uint32(8)
+	for i, ifd := range ifds {
+		if ifd != nil {
+			offsets[i] = end
+			end += 2 + 12*uint32(len(ifd)) + 4
+		}
+	}
+	for i, t := range ifd0 {
+		switch t.tag {
+		case tagExifIFD:
+			ifd0[i].data = make([]byte, 4)
+			order.PutUint32(ifd0[i].data, offsets[1])
+		case tagGPSIFD:
+			ifd0[i].data = make([]byte, 4)
+			order.PutUint32(ifd0[i].data, offsets[2])
+		}
+	}
+
+	b := make([]byte, end)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+	for i, ifd := range ifds {
+		if ifd == nil {
+			continue
+		}
+		pos := offsets[i]
+		order.PutUint16(b[pos:], uint16(len(ifd)))
+		pos += 2
+		for _, t := range ifd {
+			order.PutUint16(b[pos:], t.tag)
+			order.PutUint16(b[pos+2:], t.typ)
+			order.PutUint32(b[pos+4:], t.count)
+			if len(t.data) <= 4 {
+				copy(b[pos+8:], t.data)
+			} else {
+				order.PutUint32(b[pos+8:], uint32(len(b)))
+				b = append(b, t.data...)
+			}
+			pos += 12
+		}
+	}
+	return b
+}
+
+func testPhotoTIFF(order binary.ByteOrder) []byte {
+	return testTIFF(order,
+		[]testTag{asciiTag(tagMake, "Google"), asciiTag(tagModel, "Pixel 7"), asciiTag(tagDateTime, "2024:05:18 09:00:00")},
+		[]testTag{
+			asciiTag(tagDateTimeOriginal, "2024:05:17 14:03:22"),
+			ratTag(order, tagExposureTime, 10, 1200),
+			ratTag(order, tagFNumber, 18, 10),
+			shortTag(order, tagISO, 100),
+			ratTag(order, tagFocalLength, 681, 100),
+			asciiTag(tagLensModel, "Pixel 7 back camera"),
+		},
+		[]testTag{
+			asciiTag(tagGPSLatitudeRef, "S"),
+			ratTag(order, tagGPSLatitude, 33, 1, 51, 1, 54, 1),
+			asciiTag(tagGPSLongitudeRef, "E"),
+			ratTag(order, tagGPSLongitude, 151, 1, 12, 1, 36, 1),
+			{tagGPSAltitudeRef, tiffByte, 1, []byte{1}},
+			ratTag(order, tagGPSAltitude, 5, 2),
+		})
+}
+
+func TestParseTIFF(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		dirs, err := parseTIFF(testPhotoTIFF(order))
+		if err != nil {
+			t.Fatalf("%v: %s", order, err)
+		}
+		if taken, ok := dirs.Taken(); !ok || !taken.Equal(time.Date(2024, 5, 17, 14, 3, 22, 0, time.Local)) {
+			t.Errorf("%v: taken %v %v", order, taken, ok)
+		}
+		if c := dirs.Camera(); c != "Google Pixel 7" {
+			t.Errorf("%v: camera %q", order, c)
+		}
+		if l := dirs.Lens(); l != "Pixel 7 back camera" {
+			t.Errorf("%v: lens %q", order, l)
+		}
+		if e := dirs.ExposureTime(); e != "1/120" {
+			t.Errorf("%v: exposure %q", order, e)
+		}
+		if f := dirs.FNumber(); f != 1.8 {
+			t.Errorf("%v: f-number %v", order, f)
+		}
+		if iso := dirs.ISO(); iso != 100 {
+			t.Errorf("%v: ISO %v", order, iso)
+		}
+		if f := dirs.FocalLength(); f != 6.81 {
+			t.Errorf("%v: focal length %v", order, f)
+		}
+		p, ok := dirs.Location()
+		if !ok || math.Abs(p.Lat+33.865) > 1e-9 || math.Abs(p.Lon-151.21) > 1e-9 || p.Alt != -2.5 {
+			t.Errorf("%v: location %+v %v", order, p, ok)
+		}
+	}
+}
+
+func TestExifFields(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		name string
+		ifd0 []testTag
+		exif []testTag
+		gps  []testTag
+		want map[string]interface{}
+	}{
+		{"make in model", []testTag{asciiTag(tagMake, "Canon"), asciiTag(tagModel, "Canon EOS R5")}, nil, nil,
+			map[string]interface{}{"camera": "Canon EOS R5"}},
+		{"make only", []testTag{asciiTag(tagMake, "Canon  ")}, nil, nil,
+			map[string]interface{}{"camera": "Canon"}},
+		{"taken from IFD0", []testTag{asciiTag(tagDateTime, "2020:01:02 03:04:05")}, []testTag{asciiTag(tagDateTimeOriginal, "0000:00:00 00:00:00")}, nil,
+			map[string]interface{}{"taken": time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)}},
+		{"long exposure", nil, []testTag{ratTag(le, tagExposureTime, 25, 10)}, nil,
+			map[string]interface{}{"exposure": "2.5"}},
+		{"rounded exposure", nil, []testTag{ratTag(le, tagExposureTime, 3, 1000)}, nil,
+			map[string]interface{}{"exposure": "1/333"}},
+		{"zero exposure", nil, []testTag{ratTag(le, tagExposureTime, 0, 1)}, nil,
+			map[string]interface{}{"exposure": ""}},
+		{"zero denominator", nil, []testTag{ratTag(le, tagFNumber, 18, 0), ratTag(le, tagExposureTime, 1, 0)}, nil,
+			map[string]interface{}{"fnumber": 0.0, "exposure": ""}},
+		{"wrong type", nil, []testTag{asciiTag(tagISO, "100"), shortTag(le, tagFNumber, 2)}, nil,
+			map[string]interface{}{"iso": 0, "fnumber": 0.0}},
+		{"latitude out of range", nil, nil, []testTag{ratTag(le, tagGPSLatitude, 95, 1, 0, 1, 0, 1), ratTag(le, tagGPSLongitude, 1, 1, 0, 1, 0, 1)},
+			map[string]interface{}{"location": false}},
+		{"short coordinates", nil, nil, []testTag{ratTag(le, tagGPSLatitude, 5, 1), ratTag(le, tagGPSLongitude, 1, 1, 0, 1, 0, 1)},
+			map[string]interface{}{"location": false}},
+		{"west", nil, nil, []testTag{ratTag(le, tagGPSLatitude, 0, 1, 30, 1, 0, 1), asciiTag(tagGPSLongitudeRef, "w"), ratTag(le, tagGPSLongitude, 1, 2, 0, 1, 0, 1)},
+			map[string]interface{}{"location": true, "lat": 0.5, "lon": -0.5}},
+	}
+	for _, tt := range tests {
+		dirs, err := parseTIFF(testTIFF(le, tt.ifd0, tt.exif, tt.gps))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		p, ok := dirs.Location()
+		taken, _ := dirs.Taken()
+		got := map[string]interface{}{
+			"camera": dirs.Camera(), "taken": taken, "exposure": dirs.ExposureTime(),
+			"fnumber": dirs.FNumber(), "iso": dirs.ISO(), "location": ok,
+		}
+		if ok {
+			got["lat"], got["lon"] = p.Lat, p.Lon
+		}
+		for k, want := range tt.want {
+			if !reflect.DeepEqual(got[k], want) {
+				t.Errorf("%s: %s = %v, want %v", tt.name, k, got[k], want)
+			}
+		}
+	}
+}
+
+func TestParseTIFFMalformed(t *testing.T) {
+	le := binary.LittleEndian
+	valid := testPhotoTIFF(le)
+	badOffset := append([]byte(nil), valid...)
+	le.PutUint32(badOffset[4:], uint32(len(valid)))
+	truncated := append([]byte(nil), valid...)
+	le.PutUint16(truncated[8:], 0xFFFF)
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("II*\x00")},
+		{"byte order", append([]byte("XX"), valid[2:]...)},
+		{"magic", append([]byte("II+\x00"), valid[4:]...)},
+		{"IFD offset", badOffset},
+		{"IFD entries", truncated},
+	} {
+		if dirs, err := parseTIFF(tt.b); err == nil {
+			t.Errorf("%s: parsed as %+v", tt.name, dirs)
+		}
+	}
+
+	// Bad entries and sub-directories are skipped:
+	b := testTIFF(le, []testTag{asciiTag(tagMake, "Nikon Corporation"), asciiTag(tagModel, "Z6"), {tagISO, 99, 1, []byte{1}}}, nil, nil)
+	le.PutUint32(b[8+2+8:], 1<<31)
+	dirs, err := parseTIFF(testTIFF(le, []testTag{{tagExifIFD, tiffLong, 1, []byte{0xFF, 0xFF, 0, 0}}, {tagGPSIFD, tiffShort, 1, []byte{1, 0}}}, nil, nil))
+	if err != nil || dirs.Exif != nil || dirs.GPS != nil {
+		t.Errorf("bad sub-directories: %+v %v", dirs, err)
+	}
+	if dirs, err = parseTIFF(b); err != nil || dirs.Camera() != "Z6" || len(dirs.IFD0) != 1 {
+		t.Errorf("bad entries: %+v %v", dirs, err)
+	}
+
+	// No truncation of a valid TIFF panics:
+	for n := range valid {
+		if dirs, err := parseTIFF(valid[:n]); err == nil {
+			dirs.Taken()
+			dirs.Camera()
+			dirs.ExposureTime()
+			dirs.Location()
+		}
+	}
+}
+
+// A JPEG segment with its marker and length:
+func jpegSegment(marker byte, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	seg := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(body)+2))
+	return append(seg, body...)
+}
+
+func TestReadJPEGMeta(t *testing.T) {
+	exif := testPhotoTIFF(binary.BigEndian)
+	jpeg := bytes.Join([][]byte{
+		{0xFF, 0xD8},
+		jpegSegment(0xE0, []byte("JFIF\x00\x01\x02")),
+		jpegSegment(0xE1, jpegExifPrefix, exif),
+		jpegSegment(0xE1, jpegXMPPrefix, []byte("<xmp/>")),
+		jpegSegment(0xE1, jpegExifPrefix, []byte("second")),
+		jpegSegment(0xED, jpegPhotoshopPrefix, []byte("8BIM-one")),
+		jpegSegment(0xED, jpegPhotoshopPrefix, []byte("-two")),
+		jpegSegment(0xDA, []byte{1, 2, 3}),
+		[]byte("scan data that is never read"),
+	}, nil)
+
+	meta, err := readJPEGMeta(bytes.NewReader(jpeg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(meta.Exif, exif) || string(meta.XMP) != "<xmp/>" || string(meta.Photoshop) != "8BIM-one-two" {
+		t.Errorf("got %+v", meta)
+	}
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"not a JPEG", []byte("\x89PNG\r\n")},
+		{"bad marker", []byte{0xFF, 0xD8, 0x00, 0xE1, 0, 2}},
+		{"bad length", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 1}},
+		{"no start of scan", jpeg[:len(jpeg)-len(jpegSegment(0xDA, []byte{1, 2, 3}))-len("scan data that is never read")]},
+		{"truncated segment", jpeg[:30]},
+		{"truncated skipped segment", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x10, 0}},
+	} {
+		if meta, err := readJPEGMeta(bytes.NewReader(tt.b)); err == nil {
+			t.Errorf("%s: read %+v", tt.name, meta)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Map tiles for the `/map` page; the server only produces the data drawn over them:
+var tileURL, tileAttribution string
+
+// Pictures closer together than this many pixels on screen are clustered:
+const geoClusterPixels = 64
+
+// Maximum zoom level of slippy map tiles:
+const geoMaxZoom = 22
+
+// GeoJSON types for `/geo.json`:
+type GeoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []GeoFeature `json:"features"`
+}
+
+type GeoFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoGeometry            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoGeometry struct {
+	Type string `json:"type"`
+	// Longitude, latitude as GeoJSON orders them:
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// A geotagged picture:
+type geoPic struct {
+	Name  string
+	Point GeoPoint
+	When  time.Time
+}
+
+// Projects to Web Mercator pixel coordinates at the given zoom, as map tiles are laid out:
+func mercatorPixel(p GeoPoint, zoom int) (x, y float64) {
+	scale := 256 * math.Exp2(float64(zoom))
+	lat := math.Max(-85.05112878, math.Min(85.05112878, p.Lat))
+	sin := math.Sin(lat * math.Pi / 180)
+	x = (p.Lon + 180) / 360 * scale
+	y = (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * scale
+	return
+}
+
+// A `west,south,east,north` bounding box in degrees:
+type geoBounds struct {
+	West, South, East, North float64
+}
+
+func parseGeoBounds(s string) (*geoBounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox '%s' is not west,south,east,north", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bbox '%s' is not west,south,east,north", s)
+		}
+		v[i] = f
+	}
+	return &geoBounds{West: v[0], South: v[1], East: v[2], North: v[3]}, nil
+}
+
+func (b *geoBounds) Contains(p GeoPoint) bool {
+	if p.Lat < b.South || p.Lat > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return p.Lon >= b.West && p.Lon <= b.East
+	}
+	// Crosses the antimeridian:
+	return p.Lon >= b.West || p.Lon <= b.East
+}
+
+// Lists the pictures that carry a location, newest first:
+func geotaggedPics() []geoPic {
+	pics := make([]geoPic, 0)
+	metas := metaCache.All()
+	// Uploads still in progress are left off the map until they settle:
+	files, _ := picIndex.SettledFiles()
+	for _, name := range files {
+		meta, ok := metas[name]
+		if !ok || meta.GPS == nil {
+			continue
+		}
+		when := meta.Taken
+		if when.IsZero() {
+			when = meta.ModTime
+		}
+		pics = append(pics, geoPic{Name: name, Point: *meta.GPS, When: when})
+	}
+	sort.Slice(pics, func(i, j int) bool { return pics[i].When.After(pics[j].When) })
+	return pics
+}
+
+func geoPicFeature(p geoPic) GeoFeature {
+	props := map[string]interface{}{
+		"name":       p.Name,
+		"picUrl":     pjoin(picsURL, p.Name),
+		"detailsUrl": pjoin(detailsURL, p.Name),
+	}
+	if hasThumbnail(p.Name) {
+		props["thumbUrl"] = pjoin(thumbsURL, p.Name)
+	}
+	if !p.When.IsZero() {
+		props["taken"] = p.When.Format(time.RFC3339)
+	}
+	return GeoFeature{
+		Type:       "Feature",
+		Geometry:   GeoGeometry{Type: "Point", Coordinates: [2]float64{p.Point.Lon, p.Point.Lat}},
+		Properties: props,
+	}
+}
+
+// Groups pictures by grid cells of `geoClusterPixels` at the given zoom; cells holding one picture stay plain pictures:
+func clusterGeoPics(pics []geoPic, zoom int) []GeoFeature {
+	type cell struct{ x, y int64 }
+	cells := make(map[cell][]geoPic)
+	order := make([]cell, 0)
+	for _, p := range pics {
+		x, y := mercatorPixel(p.Point, zoom)
+		c := cell{int64(x / geoClusterPixels), int64(y / geoClusterPixels)}
+		if _, ok := cells[c]; !ok {
+			order = append(order, c)
+		}
+		cells[c] = append(cells[c], p)
+	}
+
+	features := make([]GeoFeature, 0, len(order))
+	for _, c := range order {
+		members := cells[c]
+		if len(members) == 1 {
+			features = append(features, geoPicFeature(members[0]))
+			continue
+		}
+
+		// Place the cluster at its members' centroid and show the newest member's thumbnail:
+		var lat, lon float64
+		b := geoBounds{West: 180, South: 90, East: -180, North: -90}
+		for _, p := range members {
+			lat += p.Point.Lat
+			lon += p.Point.Lon
+			b.West, b.East = math.Min(b.West, p.Point.Lon), math.Max(b.East, p.Point.Lon)
+			b.South, b.North = math.Min(b.South, p.Point.Lat), math.Max(b.North, p.Point.Lat)
+		}
+		n := float64(len(members))
+		f := geoPicFeature(members[0])
+		f.Geometry.Coordinates = [2]float64{lon / n, lat / n}
+		f.Properties["cluster"] = true
+		f.Properties["count"] = len(members)
+		f.Properties["bbox"] = [4]float64{b.West, b.South, b.East, b.North}
+		features = append(features, f)
+	}
+	return features
+}
+
+// Coordinates are withheld entirely when privacy mode hides locations:
+func requireGeoEnabled() error {
+	if privacy != privacyOff {
+		return NewHttpError(http.StatusNotFound, "Locations are hidden by privacy mode", fmt.Errorf("Map requested with privacy mode on"))
+	}
+	return nil
+}
+
+// JSON handler for `/geo.json`; clusters by `zoom` if given and limits to `bbox` if given:
+func geoJsonHandler(req *http.Request) (interface{}, error) {
+	if err := requireGeoEnabled(); err != nil {
+		return nil, err
+	}
+
+	v := req.URL.Query()
+	zoom := -1
+	if s := v.Get("zoom"); s != "" {
+		z, err := strconv.Atoi(s)
+		if err != nil || z < 0 || z > geoMaxZoom {
+			return nil, NewHttpError(http.StatusBadRequest, "Invalid zoom query value", fmt.Errorf("zoom '%s' is not between 0 and %d", s, geoMaxZoom))
+		}
+		zoom = z
+	}
+	var bounds *geoBounds
+	if s := v.Get("bbox"); s != "" {
+		var err error
+		if bounds, err = parseGeoBounds(s); err != nil {
+			return nil, NewHttpError(http.StatusBadRequest, "Invalid bbox query value", err)
+		}
+	}
+
+	pics := geotaggedPics()
+	inside := pics[:0]
+	for _, p := range pics {
+		if (bounds == nil || bounds.Contains(p.Point)) && canViewAlbum(req, albumOf(p.Name)) {
+			inside = append(inside, p)
+		}
+	}
+	pics = inside
+
+	fc := GeoFeatureCollection{Type: "FeatureCollection", Features: make([]GeoFeature, 0, len(pics))}
+	if zoom < 0 {
+		for _, p := range pics {
+			fc.Features = append(fc.Features, geoPicFeature(p))
+		}
+	} else {
+		fc.Features = clusterGeoPics(pics, zoom)
+	}
+	return fc, nil
+}
+
+type MapViewModel struct {
+	GeoURL          string
+	IndexURL        string
+	TileURL         string
+	TileAttribution string
+}
+
+// HTML handler for `/map`:
+func mapHandler(rsp http.ResponseWriter, req *http.Request) error {
+	if err := requireGeoEnabled(); err != nil {
+		return err
+	}
+
+	return renderTemplate(rsp, http.StatusOK, "map.html", MapViewModel{
+		GeoURL:          geoURL,
+		IndexURL:        rootURL,
+		TileURL:         tileURL,
+		TileAttribution: tileAttribution,
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMercatorPixel(t *testing.T) {
+	tests := []struct {
+		p    GeoPoint
+		zoom int
+		x, y float64
+	}{
+		{GeoPoint{Lat: 0, Lon: 0}, 0, 128, 128},
+		{GeoPoint{Lat: 0, Lon: -180}, 1, 0, 256},
+		{GeoPoint{Lat: 0, Lon: 180}, 1, 512, 256},
+		// Clamped to the square Web Mercator world:
+		{GeoPoint{Lat: 90, Lon: 0}, 0, 128, 0},
+		{GeoPoint{Lat: -90, Lon: 0}, 0, 128, 256},
+	}
+	for _, tt := range tests {
+		x, y := mercatorPixel(tt.p, tt.zoom)
+		if math.Abs(x-tt.x) > 1e-6 || math.Abs(y-tt.y) > 1e-6 {
+			t.Errorf("mercatorPixel(%+v, %d) = %v, %v, want %v, %v", tt.p, tt.zoom, x, y, tt.x, tt.y)
+		}
+	}
+}
+
+func TestGeoBoundsContains(t *testing.T) {
+	if _, err := parseGeoBounds("1,2,3"); err == nil {
+		t.Error("parsed three values")
+	}
+	if _, err := parseGeoBounds("1,2,3,north"); err == nil {
+		t.Error("parsed a word")
+	}
+	seattle, sydney, fiji := GeoPoint{Lat: 47.6, Lon: -122.3}, GeoPoint{Lat: -33.9, Lon: 151.2}, GeoPoint{Lat: -17.7, Lon: 178.1}
+	tests := []struct {
+		bbox string
+		in   []GeoPoint
+		out  []GeoPoint
+	}{
+		{"-130, 40, -120, 50", []GeoPoint{seattle}, []GeoPoint{sydney, fiji}},
+		// Crosses the antimeridian:
+		{"150,-40,-170,0", []GeoPoint{sydney, fiji}, []GeoPoint{seattle}},
+	}
+	for _, tt := range tests {
+		b, err := parseGeoBounds(tt.bbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range tt.in {
+			if !b.Contains(p) {
+				t.Errorf("%s does not contain %+v", tt.bbox, p)
+			}
+		}
+		for _, p := range tt.out {
+			if b.Contains(p) {
+				t.Errorf("%s contains %+v", tt.bbox, p)
+			}
+		}
+	}
+}
+
+func TestClusterGeoPics(t *testing.T) {
+	now := time.Now()
+	// Newest first, as from `geotaggedPics`; the two in Seattle are a few hundred meters apart:
+	pics := []geoPic{
+		{Name: "pier.jpg", Point: GeoPoint{Lat: 47.606, Lon: -122.342}, When: now},
+		{Name: "opera.jpg", Point: GeoPoint{Lat: -33.857, Lon: 151.215}, When: now.Add(-time.Hour)},
+		{Name: "market.jpg", Point: GeoPoint{Lat: 47.609, Lon: -122.340}, When: now.Add(-2 * time.Hour)},
+	}
+
+	features := clusterGeoPics(pics, 5)
+	if len(features) != 2 {
+		t.Fatalf("got %d features at zoom 5, want 2", len(features))
+	}
+	c := features[0]
+	if c.Properties["cluster"] != true || c.Properties["count"] != 2 || c.Properties["name"] != "pier.jpg" {
+		t.Errorf("cluster properties %+v", c.Properties)
+	}
+	if lon, lat := c.Geometry.Coordinates[0], c.Geometry.Coordinates[1]; math.Abs(lat-47.6075) > 1e-9 || math.Abs(lon+122.341) > 1e-9 {
+		t.Errorf("cluster at %v, want the centroid", c.Geometry.Coordinates)
+	}
+	if bbox := c.Properties["bbox"]; bbox != [4]float64{-122.342, 47.606, -122.340, 47.609} {
+		t.Errorf("cluster bbox %v", bbox)
+	}
+	if p := features[1]; p.Properties["cluster"] != nil || p.Properties["name"] != "opera.jpg" || p.Geometry.Coordinates != [2]float64{151.215, -33.857} {
+		t.Errorf("lone picture %+v", p)
+	}
+
+	// Close enough in, every picture stands alone:
+	if features := clusterGeoPics(pics, geoMaxZoom); len(features) != 3 {
+		t.Errorf("got %d features at zoom %d, want 3", len(features), geoMaxZoom)
+	}
+}
+
+func TestGeoJsonHandler(t *testing.T) {
+	setupTestStores(t)
+	defer func(d time.Duration) { settleTime = d }(settleTime)
+	settleTime = time.Minute
+	setupTestAccounts(t, `{"users":[{"name":"ryan","passwordHash":"`+testPasswordHash+`","role":"admin"}],
+		"albums":{"family":{"viewers":["ryan"]}}}`)
+
+	hourAgo := time.Now().Add(-time.Hour)
+	files := map[string]time.Time{"pier.jpg": hourAgo, "opera.jpg": hourAgo, "family/home.jpg": hourAgo, "uploading.jpg": time.Now(), "plain.jpg": hourAgo}
+	for name, mtime := range files {
+		p := path.Join(picsDir, name)
+		if err := os.MkdirAll(path.Dir(p), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0664); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		meta := PicMeta{Version: picMetaVersion, ModTime: mtime}
+		if name != "plain.jpg" {
+			meta.GPS = &GeoPoint{Lat: 47.6, Lon: -122.3}
+		}
+		if name == "opera.jpg" {
+			meta.GPS = &GeoPoint{Lat: -33.9, Lon: 151.2}
+		}
+		metaCache.Put(name, meta)
+	}
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Anonymous visitors see neither the restricted album nor the upload in progress:
+	names := func(query string) map[string]bool {
+		v, err := geoJsonHandler(httptest.NewRequest("GET", "/geo.json"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]bool)
+		for _, f := range v.(GeoFeatureCollection).Features {
+			got[f.Properties["name"].(string)] = true
+		}
+		return got
+	}
+	if got := names(""); len(got) != 2 || !got["pier.jpg"] || !got["opera.jpg"] {
+		t.Errorf("got %v, want pier.jpg and opera.jpg", got)
+	}
+	if got := names("?bbox=-130,40,-120,50"); len(got) != 1 || !got["pier.jpg"] {
+		t.Errorf("got %v within Seattle, want pier.jpg", got)
+	}
+
+	for _, query := range []string{"?zoom=23", "?zoom=-1", "?zoom=x", "?bbox=1,2,3"} {
+		if _, err := geoJsonHandler(httptest.NewRequest("GET", "/geo.json"+query, nil)); err == nil {
+			t.Errorf("%s accepted", query)
+		}
+	}
+
+	defer func(p privacyMode) { privacy = p }(privacy)
+	privacy = privacyLocation
+	if _, err := geoJsonHandler(httptest.NewRequest("GET", "/geo.json", nil)); err == nil {
+		t.Error("locations served in privacy mode")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+)
+
+import (
+	"github.com/JamesDunne/go-ryan/resize"
+)
+
+// Animated thumbnails for GIFs. Frames are composited onto the logical screen as a viewer would show them,
+// then cropped and shrunk like any other thumbnail.
+
+// Limits on animated thumbnails; beyond them we settle for a still of the first frame:
+const (
+	// Larger sources are not fully decoded:
+	gifMaxFileSize = 16 << 20
+	// Nor are sources whose frames would decode to more pixels than this in all; a tiny file may declare a huge
+	// screen or thousands of frames:
+	gifMaxPixels = 32 << 20
+	// Longer animations are sampled down to this many frames:
+	gifMaxFrames = 50
+	// Animated thumbnails encoding to more than this are discarded:
+	gifMaxThumbBytes = 512 << 10
+)
+
+// Counts the frames of a GIF by walking its blocks, without decompressing any image data:
+func countGIFFrames(r *bufio.Reader) (int, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, errors.New("gif: not a GIF")
+	}
+	if header[10]&0x80 != 0 {
+		// Skip the global color table:
+		if _, err := r.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	frames := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case 0x21:
+			// Extension: a label then data sub-blocks:
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+		case 0x2C:
+			// Image descriptor, then any local color table and the LZW minimum code size ahead of the data sub-blocks:
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return 0, err
+			}
+			skip := 1
+			if desc[8]&0x80 != 0 {
+				skip += 3 << (desc[8]&0x07 + 1)
+			}
+			if _, err := r.Discard(skip); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B:
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%02x", b)
+		}
+
+		// Skip the data sub-blocks up to the zero-length terminator:
+		for {
+			n, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if n == 0 {
+				break
+			}
+			if _, err := r.Discard(int(n)); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// Writes the thumbnail for the GIF at `picPath` to `thumbPath`:
+func makeGIFThumbnail(picPath, thumbPath string) error {
+	f, err := os.Open(picPath)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "could not open original image to make thumbnail of", fmt.Errorf("cannot open image file at '%s'", picPath))
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "could not open original image to make thumbnail of", err)
+	}
+
+	// Check the sizes the file declares before decoding anything:
+	config, err := gif.DecodeConfig(f)
+	if err != nil {
+		return NewHttpError(http.StatusBadRequest, "image is not a proper GIF", fmt.Errorf("image file is not a GIF: '%s'", picPath))
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > gifMaxPixels {
+		return NewHttpError(http.StatusBadRequest, "image is too large to make a thumbnail of", fmt.Errorf("GIF screen of '%s' is %dx%d", picPath, config.Width, config.Height))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return NewHttpError(http.StatusInternalServerError, "could not read original image", err)
+	}
+	frames, countErr := countGIFFrames(bufio.NewReader(f))
+	if countErr != nil {
+		log.Printf("Could not count frames of '%s'; %s\n", picPath, countErr)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return NewHttpError(http.StatusInternalServerError, "could not read original image", err)
+	}
+
+	var buf bytes.Buffer
+	if fi.Size() <= gifMaxFileSize && countErr == nil && pixels*int64(frames) <= gifMaxPixels {
+		if g, err := gif.DecodeAll(f); err == nil {
+			if err := gif.EncodeAll(&buf, animatedGIFThumbnail(g)); err != nil || buf.Len() > gifMaxThumbBytes {
+				buf.Reset()
+			}
+		} else {
+			log.Printf("Could not decode all frames of '%s'; %s\n", picPath, err)
+		}
+	}
+
+	if buf.Len() == 0 {
+		// Fall back to a still of the first frame:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return NewHttpError(http.StatusInternalServerError, "could not read original image", err)
+		}
+		first, err := gif.Decode(f)
+		if err != nil {
+			return NewHttpError(http.StatusBadRequest, "image is not a proper GIF", fmt.Errorf("image file is not a GIF: '%s'", picPath))
+		}
+		if err := gif.Encode(&buf, stillGIFThumbnail(first), nil); err != nil {
+			return NewHttpError(http.StatusInternalServerError, "error while encoding GIF", fmt.Errorf("failed encoding GIF for '%s': %s", thumbPath, err))
+		}
+	}
+
+	// Create the thumbnail file, mirroring the album structure; written whole so no partial thumbnail is ever served:
+	os.MkdirAll(path.Dir(thumbPath), 0775)
+	if err := ioutil.WriteFile(thumbPath, buf.Bytes(), 0664); err != nil {
+		os.Remove(thumbPath)
+		return NewHttpError(http.StatusInternalServerError, "could not create thumbnail file", fmt.Errorf("could not create thumbnail file at '%s'; %s", thumbPath, err))
+	}
+	return nil
+}
+
+// Shrinks every frame of an animation, sampling long ones down to `gifMaxFrames` while keeping their total running time:
+func animatedGIFThumbnail(g *gif.GIF) *gif.GIF {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if screen.Empty() {
+		screen = g.Image[0].Bounds()
+	}
+	crop := squareBounds(screen)
+	step := (len(g.Image) + gifMaxFrames - 1) / gifMaxFrames
+
+	out := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config:    image.Config{Width: thumbSize, Height: thumbSize},
+	}
+	canvas := image.NewRGBA(screen)
+	var saved *image.RGBA
+	delay := 0
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			// Keep what is under this frame to restore afterwards:
+			if saved == nil {
+				saved = image.NewRGBA(screen)
+			}
+			copy(saved.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if i < len(g.Delay) {
+			delay += g.Delay[i]
+		}
+
+		if (i+1)%step == 0 || i == len(g.Image)-1 {
+			small := resize.Resize(canvas, crop, thumbSize, thumbSize)
+			out.Image = append(out.Image, toPaletted(small, gifPalette(frame.Palette)))
+			out.Delay = append(out.Delay, delay)
+			// Each output frame is a full picture; clear it before drawing the next:
+			out.Disposal = append(out.Disposal, gif.DisposalBackground)
+			delay = 0
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			// Browsers clear to transparent rather than to the background color:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, saved.Pix)
+		}
+	}
+	return out
+}
+
+func stillGIFThumbnail(img image.Image) *image.Paletted {
+	small := resize.Resize(img, squareBounds(img.Bounds()), thumbSize, thumbSize)
+	if p, ok := img.(*image.Paletted); ok {
+		return toPaletted(small, gifPalette(p.Palette))
+	}
+	return toPaletted(small, gifPalette(nil))
+}
+
+// The source palette, with room made for transparency since shrinking may blend transparent pixels in:
+func gifPalette(p color.Palette) color.Palette {
+	if len(p) == 0 {
+		return webSafePalette
+	}
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	if len(p) < 256 {
+		return append(append(color.Palette{}, p...), color.RGBA{})
+	}
+	// A full palette without transparency gives up its last color:
+	q := append(color.Palette{}, p...)
+	q[len(q)-1] = color.RGBA{}
+	return q
+}
+
+// Web-safe colors plus transparency, for frames without a palette of their own:
+var webSafePalette = func() color.Palette {
+	p := make(color.Palette, 0, 217)
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				p = append(p, color.RGBA{uint8(r * 51), uint8(g * 51), uint8(b * 51), 0xFF})
+			}
+		}
+	}
+	return append(p, color.RGBA{})
+}()
+
+func toPaletted(img image.Image, p color.Palette) *image.Paletted {
+	dst := image.NewPaletted(img.Bounds(), p)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, img.Bounds().Min)
+	return dst
+}
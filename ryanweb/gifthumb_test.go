@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Encodes an animation of `frames` solid frames, each `w`x`h`, on a logical screen of `sw`x`sh`:
+func testGIF(t *testing.T, frames, w, h, sw, sh int, localPalettes bool) []byte {
+	t.Helper()
+	g := &gif.GIF{Config: image.Config{Width: sw, Height: sh}}
+	palette := color.Palette{color.Black, color.White}
+	if !localPalettes {
+		g.Config.ColorModel = palette
+	}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, w, h), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"one frame", testGIF(t, 1, 4, 4, 4, 4, false), 1},
+		{"global palette", testGIF(t, 7, 4, 4, 4, 4, false), 7},
+		{"local palettes", testGIF(t, 3, 2, 2, 8, 8, true), 3},
+	}
+	for _, tt := range tests {
+		got, err := countGIFFrames(bufio.NewReader(bytes.NewReader(tt.data)))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: countGIFFrames = %d, %v; want %d", tt.name, got, err, tt.want)
+		}
+	}
+
+	good := testGIF(t, 2, 4, 4, 4, 4, false)
+	for _, bad := range [][]byte{nil, []byte("GIF89a"), []byte("PNG89a\x01\x00\x01\x00\x00\x00\x00;"), good[:len(good)-1]} {
+		if n, err := countGIFFrames(bufio.NewReader(bytes.NewReader(bad))); err == nil {
+			t.Errorf("countGIFFrames(%q) = %d, want an error", bad, n)
+		}
+	}
+}
+
+func writeTestGIF(t *testing.T, data []byte) (picPath, thumbPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	picPath, thumbPath = path.Join(dir, "pic.gif"), path.Join(dir, "thumbs", "pic.gif")
+	if err := ioutil.WriteFile(picPath, data, 0664); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func thumbFrames(t *testing.T, thumbPath string) int {
+	t.Helper()
+	f, err := os.Open(thumbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(g.Image)
+}
+
+func TestMakeGIFThumbnail(t *testing.T) {
+	picPath, thumbPath := writeTestGIF(t, testGIF(t, 4, 200, 100, 200, 100, false))
+	if err := makeGIFThumbnail(picPath, thumbPath); err != nil {
+		t.Fatal(err)
+	}
+	if n := thumbFrames(t, thumbPath); n != 4 {
+		t.Errorf("animated thumbnail has %d frames, want 4", n)
+	}
+}
+
+// Small files that would decode to huge images get a still of the first frame instead:
+func TestMakeGIFThumbnailTooManyPixels(t *testing.T) {
+	picPath, thumbPath := writeTestGIF(t, testGIF(t, 20, 1, 1, 2000, 2000, false))
+	if err := makeGIFThumbnail(picPath, thumbPath); err != nil {
+		t.Fatal(err)
+	}
+	if n := thumbFrames(t, thumbPath); n != 1 {
+		t.Errorf("thumbnail has %d frames, want a still", n)
+	}
+}
+
+func TestMakeGIFThumbnailHugeScreen(t *testing.T) {
+	picPath, thumbPath := writeTestGIF(t, testGIF(t, 1, 1, 1, 60000, 60000, false))
+	err := makeGIFThumbnail(picPath, thumbPath)
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("makeGIFThumbnail = %v, want a bad request", err)
+	}
+	if _, err := os.Stat(thumbPath); !os.IsNotExist(err) {
+		t.Errorf("thumbnail was written anyway")
+	}
+}
@@ -1,22 +1,54 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 )
 
+// An error to report to the client: the status, a machine-readable code, a message fit for users, and the underlying
+// error for the log.
 type HttpError struct {
 	StatusCode  int
+	Code        string
 	UserMessage string
 	TheError    error
 }
 
+// Codes for each status, used unless an error is given a more specific one:
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusGone:                "gone",
+	http.StatusTooManyRequests:     "too_many_requests",
+	http.StatusInternalServerError: "internal",
+}
+
 func NewHttpError(status int, userMessage string, err error) HttpError {
-	return HttpError{StatusCode: status, UserMessage: userMessage, TheError: err}
+	code, ok := statusErrorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	return HttpError{StatusCode: status, Code: code, UserMessage: userMessage, TheError: err}
+}
+
+// The same error with a more specific code:
+func (e HttpError) WithCode(code string) HttpError {
+	e.Code = code
+	return e
 }
 
 func (e HttpError) Error() string {
+	if e.TheError == nil {
+		return e.UserMessage
+	}
 	return e.TheError.Error()
 }
 
@@ -24,43 +56,146 @@ func (e HttpError) String() string {
 	return e.UserMessage
 }
 
-func getErrorDetails(panicked interface{}, stackTrace string) (statusCode int, userMessage string, logError string) {
+// Lets `errors.Is` see through to the underlying error, e.g. `os.ErrNotExist`:
+func (e HttpError) Unwrap() error {
+	return e.TheError
+}
+
+// Matches the kinds of error below, e.g. `errors.Is(err, ErrNotFound)`, by status; errors given a more specific code
+// still match their status's kind, while a kind with a specific code matches only that code:
+func (e HttpError) Is(target error) bool {
+	t, ok := target.(HttpError)
+	if !ok || t.TheError != nil {
+		return false
+	}
+	if t.Code == "" || t.Code == statusErrorCodes[t.StatusCode] {
+		return t.StatusCode == e.StatusCode
+	}
+	return t.Code == e.Code
+}
+
+// Kinds of error to test for with `errors.Is`:
+var (
+	ErrBadRequest   = HttpError{StatusCode: http.StatusBadRequest, Code: "bad_request"}
+	ErrUnauthorized = HttpError{StatusCode: http.StatusUnauthorized, Code: "unauthorized"}
+	ErrForbidden    = HttpError{StatusCode: http.StatusForbidden, Code: "forbidden"}
+	ErrNotFound     = HttpError{StatusCode: http.StatusNotFound, Code: "not_found"}
+	ErrConflict     = HttpError{StatusCode: http.StatusConflict, Code: "conflict"}
+	ErrGone         = HttpError{StatusCode: http.StatusGone, Code: "gone"}
+	ErrInternal     = HttpError{StatusCode: http.StatusInternalServerError, Code: "internal"}
+)
+
+// Works out what to tell the client about an error; errors that are not `HttpError`s are bugs and told as such:
+func errorResponse(err error) HttpError {
+	var herr HttpError
+	if errors.As(err, &herr) {
+		return herr
+	}
+	return NewHttpError(http.StatusInternalServerError, "500 Internal Server Error", err)
+}
+
+// Logs an error returned by a handler; client mistakes are routine, anything else is worth a closer look:
+func logError(req *http.Request, err error) {
+	herr := errorResponse(err)
+	if herr.StatusCode < 500 {
+		log.Printf("%d %s %s: %s\n", herr.StatusCode, req.Method, req.URL.Path, err)
+		return
+	}
+	log.Printf("ERROR: %s %s: %s\n", req.Method, req.URL.Path, err)
+}
+
+// Handlers are not meant to panic; if one does anyway, it is a bug to log with its stack and report as a 500:
+func panicError(req *http.Request, panicked interface{}, stackTrace string) error {
+	log.Printf("PANIC: %s %s: %v\n  STACK: %s", req.Method, req.URL.Path, panicked, stackTrace)
 	if herr, ok := panicked.(HttpError); ok {
-		logError = fmt.Sprintf("%s\n  STACK: %s", herr.Error(), stackTrace)
-		userMessage = herr.UserMessage
-		statusCode = herr.StatusCode
-	} else if err, ok := panicked.(error); ok {
-		logError = fmt.Sprintf("%s\n  STACK: %s", err.Error(), stackTrace)
-		userMessage = "500 Internal Server Error"
-		statusCode = http.StatusInternalServerError
-	} else {
-		logError = fmt.Sprintf("%s\n STACK: %s", panicked, stackTrace)
-		userMessage = "500 Internal Server Error"
-		statusCode = http.StatusInternalServerError
+		return herr
+	}
+	return NewHttpError(http.StatusInternalServerError, "500 Internal Server Error", fmt.Errorf("panic: %v", panicked))
+}
+
+func writeTextError(rsp http.ResponseWriter, err error) {
+	herr := errorResponse(err)
+	http.Error(rsp, herr.UserMessage, herr.StatusCode)
+}
+
+func writeJsonError(rsp http.ResponseWriter, err error) {
+	herr := errorResponse(err)
+	rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rsp.WriteHeader(herr.StatusCode)
+	bytes, _ := json.Marshal(struct {
+		Success bool   `json:"success"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{
+		Success: false,
+		Code:    herr.Code,
+		Message: herr.UserMessage,
+	})
+	rsp.Write(bytes)
+}
+
+// Responds with an error the way `handler` reports its own errors:
+func writeErrorFor(rsp http.ResponseWriter, handler http.Handler, err error) {
+	if _, ok := handler.(JsonHandler); ok {
+		writeJsonError(rsp, err)
+		return
 	}
-	return
+	writeTextError(rsp, err)
+}
+
+// An HTML or file handler that reports failure by returning an error:
+type ErrorHandlerFunc func(http.ResponseWriter, *http.Request) error
+
+// Notes whether a handler has started its response, after which an error can only be logged:
+type startedResponseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedResponseWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *startedResponseWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Keeps the underlying writer's fast path for serving files:
+func (w *startedResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.started = true
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *startedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 type ErrorHandler struct {
-	handler http.HandlerFunc
+	handler ErrorHandlerFunc
 }
 
-func NewErrorHandler(handler http.HandlerFunc) ErrorHandler {
+func NewErrorHandler(handler ErrorHandlerFunc) ErrorHandler {
 	return ErrorHandler{handler: handler}
 }
 
 func (h ErrorHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
-	// Catch any panics from the handler:
+	var err error
+	w := &startedResponseWriter{ResponseWriter: rsp}
+	// Catch any panics from the handler as a last resort:
 	pnk, stackTrace := try(func() {
-		h.handler(rsp, req)
+		err = h.handler(w, req)
 	})
-
-	// Log errors and return desired HTTP status code:
 	if pnk != nil {
-		statusCode, userMessage, logError := getErrorDetails(pnk, stackTrace)
+		err = panicError(req, pnk, stackTrace)
+	}
 
-		log.Printf("ERROR: %s\n", logError)
-		http.Error(rsp, userMessage, statusCode)
-		return
+	// Log errors and return desired HTTP status code, unless the handler already sent one:
+	if err != nil {
+		logError(req, err)
+		if !w.started {
+			writeTextError(rsp, err)
+		}
 	}
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHttpErrorIs(t *testing.T) {
+	csrf := NewHttpError(http.StatusForbidden, "Bad token", nil).WithCode("csrf_invalid")
+	notFound := NewHttpError(http.StatusNotFound, "Album not found", os.ErrNotExist)
+	wrapped := fmt.Errorf("while listing: %w", notFound)
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		want   bool
+	}{
+		{"same status", notFound, ErrNotFound, true},
+		{"other status", notFound, ErrForbidden, false},
+		{"wrapped", wrapped, ErrNotFound, true},
+		{"underlying error", wrapped, os.ErrNotExist, true},
+		{"specific code matches its status", csrf, ErrForbidden, true},
+		{"specific code", csrf, HttpError{StatusCode: http.StatusForbidden, Code: "csrf_invalid"}, true},
+		{"other specific code", csrf, HttpError{StatusCode: http.StatusForbidden, Code: "cross_site"}, false},
+		{"generic error and specific kind", NewHttpError(http.StatusForbidden, "No", nil), HttpError{StatusCode: http.StatusForbidden, Code: "csrf_invalid"}, false},
+		// Errors with an underlying error are not kinds to match against:
+		{"not a kind", notFound, NewHttpError(http.StatusNotFound, "", errors.New("x")), false},
+		{"not an HttpError", errors.New("x"), ErrInternal, false},
+	}
+	for _, tt := range tests {
+		if got := errors.Is(tt.err, tt.target); got != tt.want {
+			t.Errorf("%s: errors.Is = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+type jsonError struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func serveJson(t *testing.T, handler http.Handler, req *http.Request) (int, jsonError) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var body jsonError
+	if rec.Code != http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("error body %q is not JSON; %s", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, body
+}
+
+func TestJsonHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler JsonHandlerFunc
+		status  int
+		code    string
+		message string
+	}{
+		{"http error", func(*http.Request) (interface{}, error) {
+			return nil, NewHttpError(http.StatusNotFound, "Album not found", errors.New("No album 'x'"))
+		}, http.StatusNotFound, "not_found", "Album not found"},
+		{"specific code", func(*http.Request) (interface{}, error) {
+			return nil, NewHttpError(http.StatusGone, "Expired", nil).WithCode("share_expired")
+		}, http.StatusGone, "share_expired", "Expired"},
+		{"wrapped", func(*http.Request) (interface{}, error) {
+			return nil, fmt.Errorf("context: %w", NewHttpError(http.StatusForbidden, "No", nil))
+		}, http.StatusForbidden, "forbidden", "No"},
+		// Other errors are bugs; their details stay in the log:
+		{"plain error", func(*http.Request) (interface{}, error) {
+			return nil, errors.New("secret detail")
+		}, http.StatusInternalServerError, "internal", "500 Internal Server Error"},
+		{"panic", func(*http.Request) (interface{}, error) {
+			var m map[string]int
+			m["x"]++
+			return nil, nil
+		}, http.StatusInternalServerError, "internal", "500 Internal Server Error"},
+		{"panicked http error", func(*http.Request) (interface{}, error) {
+			panic(NewHttpError(http.StatusBadRequest, "Bad", nil))
+		}, http.StatusBadRequest, "bad_request", "Bad"},
+	}
+	for _, tt := range tests {
+		status, body := serveJson(t, NewJsonHandler(tt.handler), httptest.NewRequest("GET", "/x", nil))
+		if status != tt.status || body.Success || body.Code != tt.code || body.Message != tt.message {
+			t.Errorf("%s: %d %+v, want %d %s %q", tt.name, status, body, tt.status, tt.code, tt.message)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	NewJsonHandler(func(*http.Request) (interface{}, error) {
+		return map[string]int{"n": 1}, nil
+	}).ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"n":1}` {
+		t.Errorf("success: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestErrorHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler ErrorHandlerFunc
+		status  int
+		body    string
+	}{
+		{"http error", func(http.ResponseWriter, *http.Request) error {
+			return NewHttpError(http.StatusForbidden, "You may not", nil)
+		}, http.StatusForbidden, "You may not\n"},
+		{"plain error", func(http.ResponseWriter, *http.Request) error {
+			return errors.New("secret detail")
+		}, http.StatusInternalServerError, "500 Internal Server Error\n"},
+		{"panic", func(http.ResponseWriter, *http.Request) error {
+			panic("oops")
+		}, http.StatusInternalServerError, "500 Internal Server Error\n"},
+		// Once the response has started, errors can only be logged:
+		{"error after writing", func(rsp http.ResponseWriter, req *http.Request) error {
+			rsp.WriteHeader(http.StatusOK)
+			rsp.Write([]byte("partial"))
+			return errors.New("late failure")
+		}, http.StatusOK, "partial"},
+		{"ok", func(rsp http.ResponseWriter, req *http.Request) error {
+			rsp.Write([]byte("fine"))
+			return nil
+		}, http.StatusOK, "fine"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		NewErrorHandler(tt.handler).ServeHTTP(rec, httptest.NewRequest("GET", "/x", nil))
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, rec.Code, rec.Body.String(), tt.status, tt.body)
+		}
+	}
+}
+
+func TestWriteErrorFor(t *testing.T) {
+	err := NewHttpError(http.StatusTooManyRequests, "Slow down", nil).WithCode("rate_limited")
+
+	rec := httptest.NewRecorder()
+	writeErrorFor(rec, NewJsonHandler(nil), err)
+	if !strings.Contains(rec.Body.String(), `"code":"rate_limited"`) || rec.Code != http.StatusTooManyRequests {
+		t.Errorf("JSON route: %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	writeErrorFor(rec, NewErrorHandler(nil), err)
+	if rec.Body.String() != "Slow down\n" || rec.Code != http.StatusTooManyRequests {
+		t.Errorf("page route: %d %q", rec.Code, rec.Body.String())
+	}
+}
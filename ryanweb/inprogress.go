@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Files whose size or modification time changed more recently than this are presumed mid-upload:
+var settleTime time.Duration
+
+// Name patterns SFTP and download clients use while a transfer is in progress:
+var partialPatterns = []string{"*.filepart", "*.part", "*.partial", "*.tmp", "*.crdownload", "*.cyberducktmp", "*.!sync"}
+
+// Whether to also consult the OS for files currently open for writing:
+var checkOpenFiles bool
+
+func parsePartialPatterns(s string) []string {
+	patterns := make([]string, 0)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+func isPartialName(name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range partialPatterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a file, given its path relative to `picsDir`, appears to still be being written. `open` is the
+// set of paths open for writing, as from `openForWriting`, or nil if not checked:
+func inProgress(rel string, fi os.FileInfo, lastChanged time.Time, now time.Time, open map[string]bool) bool {
+	if fi.IsDir() {
+		return false
+	}
+	if isPartialName(fi.Name()) {
+		return true
+	}
+
+	// Stability window; clients that preserve timestamps set an old mtime, so also use when we saw it change:
+	if now.Sub(fi.ModTime()) < settleTime || now.Sub(lastChanged) < settleTime {
+		return true
+	}
+
+	return open[path.Join(picsDir, rel)]
+}
+
+// The files open for writing when that is checked; nil otherwise. Scanning /proc can be slow, so call this before
+// taking any locks:
+func openFilesSnapshot() map[string]bool {
+	if !checkOpenFiles {
+		return nil
+	}
+	return openForWriting()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParsePartialPatterns(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{"*.part", []string{"*.part"}},
+		{" *.part , ,*.tmp,", []string{"*.part", "*.tmp"}},
+	}
+	for _, tt := range tests {
+		if got := parsePartialPatterns(tt.s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePartialPatterns(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIsPartialName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.jpg", false},
+		{"a.jpg.filepart", true},
+		{"a.JPG.PART", true},
+		{"a.partial", true},
+		{"a.jpg.crdownload", true},
+		{"a.!sync", true},
+		{"party.jpg", false},
+		{"a.part.jpg", false},
+		{"tmp", false},
+	}
+	for _, tt := range tests {
+		if got := isPartialName(tt.name); got != tt.want {
+			t.Errorf("isPartialName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	defer func(d time.Duration, dir string) { settleTime, picsDir = d, dir }(settleTime, picsDir)
+	settleTime, picsDir = 10*time.Second, "/pics"
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	entry := func(name string, mtime time.Time, dir bool) os.FileInfo {
+		return (&cursorKey{Name: name, ModTime: mtime.UnixNano(), Dir: dir}).FileInfo()
+	}
+	tests := []struct {
+		name    string
+		fi      os.FileInfo
+		changed time.Time
+		open    map[string]bool
+		want    bool
+	}{
+		{"settled", entry("a.jpg", old, false), time.Time{}, nil, false},
+		{"partial name", entry("a.jpg.part", old, false), time.Time{}, nil, true},
+		{"recently modified", entry("a.jpg", now.Add(-time.Second), false), time.Time{}, nil, true},
+		{"old mtime but recently changed", entry("a.jpg", old, false), now.Add(-time.Second), nil, true},
+		{"changed a while ago", entry("a.jpg", old, false), now.Add(-time.Minute), nil, false},
+		{"open for writing", entry("a.jpg", old, false), time.Time{}, map[string]bool{"/pics/album/a.jpg": true}, true},
+		{"other file open", entry("a.jpg", old, false), time.Time{}, map[string]bool{"/pics/album/b.jpg": true}, false},
+		{"directory", entry("new.part", now, true), now, map[string]bool{"/pics/album/new.part": true}, false},
+	}
+	for _, tt := range tests {
+		if got := inProgress(path.Join("album", tt.fi.Name()), tt.fi, tt.changed, now, tt.open); got != tt.want {
+			t.Errorf("%s: inProgress = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDirIndexSettled(t *testing.T) {
+	setupTestStores(t)
+	defer func(d time.Duration) { settleTime = d }(settleTime)
+	settleTime = time.Minute
+
+	// Written before the index first sees them, so only their times count:
+	hourAgo := time.Now().Add(-time.Hour)
+	for name, mtime := range map[string]time.Time{"done.jpg": hourAgo, "upload.jpg.filepart": hourAgo, "fresh.jpg": time.Now(), "ours.jpg": time.Now()} {
+		p := path.Join(picsDir, name)
+		if err := ioutil.WriteFile(p, []byte(name), 0664); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	// Files we wrote ourselves are complete as soon as we say so:
+	picIndex.Complete("ours.jpg")
+
+	settled := func() []string {
+		names := extractNames(picIndex.Settled(""))
+		sort.Strings(names)
+		return names
+	}
+	if got, want := settled(), []string{"done.jpg", "ours.jpg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("settled %q, want %q", got, want)
+	}
+	if got, pending := picIndex.SettledFiles(); !reflect.DeepEqual(got, []string{"done.jpg", "ours.jpg"}) || !pending {
+		t.Errorf("settled files %q, pending %v", got, pending)
+	}
+
+	// Until they change again:
+	if err := ioutil.WriteFile(path.Join(picsDir, "ours.jpg"), []byte("more"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	picIndex.Update("ours.jpg")
+	if got, want := settled(), []string{"done.jpg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("settled %q after a change, want %q", got, want)
+	}
+}
@@ -6,7 +6,8 @@ import (
 	"net/http"
 )
 
-type JsonHandlerFunc func(*http.Request) interface{}
+// A handler whose result is marshaled to JSON; failures are returned as errors:
+type JsonHandlerFunc func(*http.Request) (interface{}, error)
 
 type JsonHandler struct {
 	handler JsonHandlerFunc
@@ -18,32 +19,26 @@ func NewJsonHandler(handler JsonHandlerFunc) JsonHandler {
 
 func (h JsonHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
 	var result interface{}
+	var err error
 
 	// We're guaranteed that we want to return a JSON result:
 	rsp.Header().Add("Content-Type", "application/json; charset=utf-8")
 
-	// Try to run the handler logic and catch any panics:
+	// Run the handler logic, catching any panics as a last resort:
 	pnk, stackTrace := try(func() {
-		result = h.handler(req)
+		result, err = h.handler(req)
 	})
-
-	// Handle the panic:
 	if pnk != nil {
-		statusCode, userMessage, logError := getErrorDetails(pnk, stackTrace)
+		err = panicError(req, pnk, stackTrace)
+	}
 
+	// Handle the error:
+	if err != nil {
 		// Log the private error details:
-		log.Printf("ERROR: %s\n", logError)
+		logError(req, err)
 
 		// Error response:
-		rsp.WriteHeader(statusCode)
-		bytes, _ := json.Marshal(struct {
-			Success bool   `json:"success"`
-			Message string `json:"message"`
-		}{
-			Success: false,
-			Message: userMessage,
-		})
-		rsp.Write(bytes)
+		writeJsonError(rsp, err)
 		return
 	}
 
@@ -62,7 +57,7 @@ func (h JsonHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
 
 		// Canned response:
 		rsp.WriteHeader(http.StatusInternalServerError)
-		rsp.Write([]byte(`{"success":false,"message":"There was an error attempting to marshal the response object to JSON."}`))
+		rsp.Write([]byte(`{"success":false,"code":"internal","message":"There was an error attempting to marshal the response object to JSON."}`))
 		return
 	}
 
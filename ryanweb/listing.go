@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filtering and paging options for `/list`:
+type ListQuery struct {
+	Album   string
+	SortBy  sortBy
+	SortDir sortDirection
+	Detail  bool
+	Limit   int
+	Offset  int
+	Cursor  *cursorKey
+	Type    string
+	Prefix  string
+	Tags    []string
+	Since   time.Time
+	Until   time.Time
+}
+
+// Reports whether any paging option was given, in which case the response includes paging info:
+func (q ListQuery) Paged() bool {
+	return q.Limit > 0 || q.Offset > 0 || q.Cursor != nil
+}
+
+// Position of an entry in the sort order, encoded opaquely into `nextCursor`:
+type cursorKey struct {
+	Dir     bool   `json:"d,omitempty"`
+	ModTime int64  `json:"t"`
+	Size    int64  `json:"s"`
+	Name    string `json:"n"`
+}
+
+func newCursorKey(fi os.FileInfo) *cursorKey {
+	return &cursorKey{Dir: fi.IsDir(), ModTime: fi.ModTime().UnixNano(), Size: fi.Size(), Name: fi.Name()}
+}
+
+func (k *cursorKey) String() string {
+	b, _ := json.Marshal(k)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursorKey(s string) (*cursorKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	k := new(cursorKey)
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Lets a cursor key be compared against real entries by the sorters:
+func (k *cursorKey) FileInfo() os.FileInfo { return cursorFileInfo{k} }
+
+type cursorFileInfo struct{ k *cursorKey }
+
+func (c cursorFileInfo) Name() string       { return c.k.Name }
+func (c cursorFileInfo) Size() int64        { return c.k.Size }
+func (c cursorFileInfo) ModTime() time.Time { return time.Unix(0, c.k.ModTime) }
+func (c cursorFileInfo) IsDir() bool        { return c.k.Dir }
+func (c cursorFileInfo) Sys() interface{}   { return nil }
+func (c cursorFileInfo) Mode() os.FileMode {
+	if c.k.Dir {
+		return os.ModeDir
+	}
+	return 0
+}
+
+// Accepts RFC 3339 timestamps, plain dates or Unix seconds:
+func parseListTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse time '%s'", s)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func parseListQuery(req *http.Request) (q ListQuery, err error) {
+	v := req.URL.Query()
+
+	badRequest := func(name string, err error) error {
+		return NewHttpError(http.StatusBadRequest, fmt.Sprintf("Invalid %s query value", name), err)
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, badRequest("limit", fmt.Errorf("limit '%s' is not a non-negative integer", s))
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, badRequest("offset", fmt.Errorf("offset '%s' is not a non-negative integer", s))
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.Cursor, err = parseCursorKey(s); err != nil {
+			return q, badRequest("cursor", err)
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = parseListTime(s); err != nil {
+			return q, badRequest("since", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.Until, err = parseListTime(s); err != nil {
+			return q, badRequest("until", err)
+		}
+	}
+	if s := v.Get("sort"); s != "" {
+		if _, ok := sortByNames[s]; !ok {
+			return q, badRequest("sort", fmt.Errorf("unknown sort '%s'", s))
+		}
+	}
+	if s := v.Get("dir"); s != "" && s != "asc" && s != "desc" {
+		return q, badRequest("dir", fmt.Errorf("unknown sort direction '%s'", s))
+	}
+	q.SortBy, q.SortDir = parseSort(v.Get("sort"), v.Get("dir"))
+	if q.Album, err = getAlbum(req); err != nil {
+		return q, err
+	}
+
+	q.Detail, _ = strconv.ParseBool(v.Get("detail"))
+	q.Type = v.Get("type")
+	q.Prefix = v.Get("prefix")
+	for _, t := range v["tag"] {
+		tag, err := normalizeTag(t)
+		if err != nil {
+			return q, badRequest("tag", err)
+		}
+		q.Tags = append(q.Tags, tag)
+	}
+	return q, nil
+}
+
+// Keeps the entries matching the query's filters, preserving order:
+func filterPics(fis []os.FileInfo, q ListQuery) []os.FileInfo {
+	filtered := make([]os.FileInfo, 0, len(fis))
+	for _, fi := range fis {
+		if q.Prefix != "" && !strings.HasPrefix(fi.Name(), q.Prefix) {
+			continue
+		}
+		if q.Type != "" && (fi.IsDir() || !strings.HasPrefix(getMimeType(fi.Name()), q.Type)) {
+			continue
+		}
+		if !q.Since.IsZero() && fi.ModTime().Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !fi.ModTime().Before(q.Until) {
+			continue
+		}
+		if !hasTags(path.Join(q.Album, fi.Name()), q.Tags) {
+			continue
+		}
+		filtered = append(filtered, fi)
+	}
+	return filtered
+}
+
+// Reports whether the picture carries all of the given tags:
+func hasTags(name string, tags []string) bool {
+	for _, t := range tags {
+		if !tagStore.HasTag(name, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Cuts one page out of sorted entries, returning the cursor for the next page or nil if this is the last:
+func pagePics(fis []os.FileInfo, less func(a, b os.FileInfo) bool, q ListQuery) ([]os.FileInfo, *cursorKey) {
+	start := q.Offset
+	if q.Cursor != nil {
+		// Resume strictly after the cursor's position, even if that entry no longer exists:
+		key := q.Cursor.FileInfo()
+		start = sort.Search(len(fis), func(i int) bool { return less(key, fis[i]) })
+	}
+	if start > len(fis) {
+		start = len(fis)
+	}
+
+	end := len(fis)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+
+	page := fis[start:end]
+	if end < len(fis) && len(page) > 0 {
+		return page, newCursorKey(page[len(page)-1])
+	}
+	return page, nil
+}
+
+// Per-file details returned by `/list?detail=1`:
+type FileDetail struct {
+	Name        string            `json:"name"`
+	IsDir       bool              `json:"isDir,omitempty"`
+	Size        int64             `json:"size"`
+	Mime        string            `json:"mime"`
+	ModTime     string            `json:"mtime"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Orientation string            `json:"orientation,omitempty"`
+	Hash        string            `json:"hash,omitempty"`
+	Thumbs      map[string]string `json:"thumbs,omitempty"`
+	Duration    float64           `json:"duration,omitempty"`
+	Rotation    int               `json:"rotation,omitempty"`
+	VideoCodec  string            `json:"videoCodec,omitempty"`
+	AudioCodec  string            `json:"audioCodec,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+
+	// Photographic metadata:
+	Taken        string    `json:"taken,omitempty"`
+	Camera       string    `json:"camera,omitempty"`
+	Lens         string    `json:"lens,omitempty"`
+	ExposureTime string    `json:"exposureTime,omitempty"`
+	FNumber      float64   `json:"fNumber,omitempty"`
+	ISO          int       `json:"iso,omitempty"`
+	FocalLength  float64   `json:"focalLength,omitempty"`
+	GPS          *GeoPoint `json:"gps,omitempty"`
+	Caption      string    `json:"caption,omitempty"`
+	Rating       int       `json:"rating,omitempty"`
+}
+
+func orientation(width, height int) string {
+	switch {
+	case width == 0 || height == 0:
+		return ""
+	case width > height:
+		return "landscape"
+	case height > width:
+		return "portrait"
+	default:
+		return "square"
+	}
+}
+
+// Builds details for entries of `album` from the metadata cache; files not yet cached are queued and reported with basic details only:
+func extractDetails(album string, fis []os.FileInfo) []FileDetail {
+	details := make([]FileDetail, 0, len(fis))
+	for _, fi := range fis {
+		d := FileDetail{
+			Name:    fi.Name(),
+			IsDir:   fi.IsDir(),
+			Size:    fi.Size(),
+			Mime:    getMimeType(fi.Name()),
+			ModTime: fi.ModTime().UTC().Format(time.RFC3339),
+		}
+		if fi.IsDir() {
+			details = append(details, d)
+			continue
+		}
+		rel := path.Join(album, fi.Name())
+
+		if hasThumbnail(rel) {
+			d.Thumbs = map[string]string{
+				thumbPresetName: pjoin(siteHost, pjoin(thumbsURL, rel)),
+			}
+		}
+
+		d.Tags = tagStore.Tags(rel)
+
+		if meta, ok := metaCache.Get(rel); ok && meta.Fresh(fi) {
+			meta = privatePicMeta(meta)
+			d.Hash = meta.Hash
+			d.Width, d.Height = meta.Width, meta.Height
+			d.Orientation = orientation(meta.Width, meta.Height)
+			d.Duration = meta.Duration.Seconds()
+			d.Rotation = meta.Rotation
+			d.VideoCodec, d.AudioCodec = meta.VideoCodec, meta.AudioCodec
+			if !meta.Taken.IsZero() {
+				d.Taken = meta.Taken.Format(time.RFC3339)
+			}
+			d.Camera, d.Lens = meta.Camera, meta.Lens
+			d.ExposureTime, d.FNumber, d.ISO, d.FocalLength = meta.ExposureTime, meta.FNumber, meta.ISO, meta.FocalLength
+			d.GPS, d.Caption, d.Rating = meta.GPS, meta.Caption, meta.Rating
+		} else {
+			queuePicMeta(rel)
+		}
+
+		details = append(details, d)
+	}
+	return details
+}
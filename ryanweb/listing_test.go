@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCursorKeyRoundTrip(t *testing.T) {
+	keys := []cursorKey{
+		{Name: "a.jpg", ModTime: 1, Size: 2},
+		{Dir: true, Name: "album", ModTime: time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC).UnixNano()},
+		{Name: "ünïcode & \"quotes\".png", ModTime: -5, Size: 1 << 40},
+	}
+	for _, k := range keys {
+		got, err := parseCursorKey(k.String())
+		if err != nil || *got != k {
+			t.Errorf("%+v came back as %+v, %v", k, got, err)
+		}
+	}
+}
+
+func TestParseCursorKeyMalformed(t *testing.T) {
+	for _, s := range []string{
+		"!!",
+		"e30=",                   // padded
+		"bm90IGpzb24",            // "not json"
+		"WzEsMiwzXQ",             // [1,2,3]
+		"eyJ0IjoieCJ9",           // {"t":"x"}
+		"eyJuIjoiYSIsInQiOjF9XQ", // trailing garbage
+	} {
+		if k, err := parseCursorKey(s); err == nil {
+			t.Errorf("%q parsed as %+v", s, k)
+		}
+	}
+}
+
+func TestParseListTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"2024-05-17T10:00:00Z", time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC), true},
+		{"2024-05-17", time.Date(2024, 5, 17, 0, 0, 0, 0, time.UTC), true},
+		{"1715940000", time.Unix(1715940000, 0), true},
+		{"yesterday", time.Time{}, false},
+		{"2024-13-01", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseListTime(tt.s)
+		if (err == nil) != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseListTime(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+// Files with the given names, sorted by name:
+func testEntries(names ...string) []os.FileInfo {
+	fis := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		fis[i] = (&cursorKey{Name: name, ModTime: int64(i)}).FileInfo()
+	}
+	sort.Sort(ByName{fis, sortAscending})
+	return fis
+}
+
+func TestPagePics(t *testing.T) {
+	fis := testEntries("a", "b", "c", "d", "e")
+	less := entryLess(func(fis []os.FileInfo) sort.Interface { return ByName{fis, sortAscending} })
+	tests := []struct {
+		name   string
+		q      ListQuery
+		want   []string
+		cursor string
+	}{
+		{"all", ListQuery{}, []string{"a", "b", "c", "d", "e"}, ""},
+		{"first page", ListQuery{Limit: 2}, []string{"a", "b"}, "b"},
+		{"offset", ListQuery{Offset: 2, Limit: 2}, []string{"c", "d"}, "d"},
+		{"last page", ListQuery{Offset: 3, Limit: 2}, []string{"d", "e"}, ""},
+		{"past the end", ListQuery{Offset: 9, Limit: 2}, []string{}, ""},
+		{"cursor", ListQuery{Cursor: &cursorKey{Name: "b"}, Limit: 2}, []string{"c", "d"}, "d"},
+		{"cursor overrides offset", ListQuery{Cursor: &cursorKey{Name: "b"}, Offset: 4, Limit: 2}, []string{"c", "d"}, "d"},
+		{"deleted cursor entry", ListQuery{Cursor: &cursorKey{Name: "bb"}, Limit: 2}, []string{"c", "d"}, "d"},
+		{"cursor at the end", ListQuery{Cursor: &cursorKey{Name: "e"}, Limit: 2}, []string{}, ""},
+		{"cursor past the end", ListQuery{Cursor: &cursorKey{Name: "z"}}, []string{}, ""},
+	}
+	for _, tt := range tests {
+		page, next := pagePics(fis, less, tt.q)
+		if got := extractNames(page); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: page %v, want %v", tt.name, got, tt.want)
+		}
+		cursor := ""
+		if next != nil {
+			cursor = next.Name
+		}
+		if cursor != tt.cursor {
+			t.Errorf("%s: next cursor %q, want %q", tt.name, cursor, tt.cursor)
+		}
+	}
+}
+
+// Following the cursors visits every entry exactly once, in order:
+func TestPagePicsWalk(t *testing.T) {
+	fis := testEntries("a", "b", "c", "d", "e", "f", "g")
+	less := entryLess(func(fis []os.FileInfo) sort.Interface { return ByName{fis, sortAscending} })
+	var seen []string
+	q := ListQuery{Limit: 2}
+	for i := 0; i < len(fis); i++ {
+		page, next := pagePics(fis, less, q)
+		seen = append(seen, extractNames(page)...)
+		if next == nil {
+			break
+		}
+		// Cursors travel through query strings:
+		if q.Cursor, _ = parseCursorKey(next.String()); q.Cursor == nil {
+			t.Fatal("bad cursor")
+		}
+	}
+	if want := extractNames(fis); !reflect.DeepEqual(seen, want) {
+		t.Errorf("walked %v, want %v", seen, want)
+	}
+}
+
+func TestListDetails(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "trip/a.jpg", []byte("a"))
+	writeTestPic(t, "trip/b.png", []byte("b"))
+	writeTestPic(t, "trip/sub/c.jpg", []byte("c"))
+	fi, err := os.Stat(path.Join(picsDir, "trip/a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+	metaCache.Put("trip/a.jpg", PicMeta{Version: picMetaVersion, Size: fi.Size(), ModTime: fi.ModTime(), Hash: "abc",
+		Width: 30, Height: 40, Taken: taken, Camera: "Canon", GPS: &GeoPoint{Lat: 47.6, Lon: -122.3}})
+	if err := tagStore.AddTags([]string{"trip/a.jpg"}, []string{"beach"}); err != nil {
+		t.Fatal(err)
+	}
+	for len(metaQueue) > 0 {
+		<-metaQueue
+	}
+
+	details := func() map[string]FileDetail {
+		v, err := listJsonHandler(httptest.NewRequest("GET", "/list?album=trip&detail=1", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, ok := reflect.ValueOf(v).FieldByName("Files").Interface().([]FileDetail)
+		if !ok {
+			t.Fatalf("files are %T", reflect.ValueOf(v).FieldByName("Files").Interface())
+		}
+		got := make(map[string]FileDetail)
+		for _, d := range files {
+			got[d.Name] = d
+		}
+		return got
+	}
+	got := details()
+	if len(got) != 3 {
+		t.Fatalf("got %d entries, want 3", len(got))
+	}
+	a := got["a.jpg"]
+	if a.Size != 1 || a.Mime != "image/jpeg" || a.Hash != "abc" || a.Width != 30 || a.Orientation != "portrait" ||
+		a.Taken != "2024-05-17T10:00:00Z" || a.Camera != "Canon" || a.GPS == nil || a.Thumbs[thumbPresetName] == "" {
+		t.Errorf("cached picture %+v", a)
+	}
+	if !reflect.DeepEqual(a.Tags, []string{"beach"}) {
+		t.Errorf("tags %v", a.Tags)
+	}
+	if sub := got["sub"]; !sub.IsDir || sub.Thumbs != nil {
+		t.Errorf("album %+v", sub)
+	}
+
+	// Not cached yet: basic details only, and queued for the background scan:
+	if b := got["b.png"]; b.Mime != "image/png" || b.Hash != "" || b.Thumbs != nil {
+		t.Errorf("uncached picture %+v", b)
+	}
+	if len(metaQueue) != 1 || <-metaQueue != "trip/b.png" {
+		t.Error("uncached picture not queued")
+	}
+
+	defer func(p privacyMode) { privacy = p }(privacy)
+	privacy = privacyLocation
+	if a := details()["a.jpg"]; a.GPS != nil || a.Camera != "Canon" {
+		t.Errorf("location privacy: %+v", a)
+	}
+	privacy = privacyAll
+	if a := details()["a.jpg"]; a.GPS != nil || a.Camera != "" {
+		t.Errorf("full privacy: %+v", a)
+	}
+	for len(metaQueue) > 0 {
+		<-metaQueue
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	for _, tt := range []struct {
+		w, h int
+		want string
+	}{{0, 10, ""}, {10, 0, ""}, {40, 30, "landscape"}, {30, 40, "portrait"}, {30, 30, "square"}} {
+		if got := orientation(tt.w, tt.h); got != tt.want {
+			t.Errorf("orientation(%d, %d) = %q, want %q", tt.w, tt.h, got, tt.want)
+		}
+	}
+}
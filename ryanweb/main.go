@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
 	"image"
 	"image/jpeg"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
@@ -18,6 +24,7 @@ import (
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 )
 
 import (
@@ -31,9 +38,34 @@ var proxyRoot, siteHost string
 var templates *template.Template
 
 // Configured URLs based on commandline arguments:
-var rootURL, picsURL, thumbsURL, deleteURL, uploadURL, listURL string
+var rootURL, picsURL, thumbsURL, deleteURL, uploadURL, listURL, restoreURL, batchURL, albumsURL, searchURL, detailsURL, mapURL, geoURL string
 var picsDir, thumbsDir string
 
+// Content hashes of the files in `picsDir` and what to do with duplicate uploads:
+var hashIndex = NewHashIndex()
+var dedup dedupMode
+
+// In-memory listing of `picsDir`:
+var picIndex *DirIndex
+
+// Cached derived metadata (perceptual hashes etc.) for the files in `picsDir`:
+var metaCache *MetaCache
+
+// User-assigned tags and virtual albums:
+var tagStore *TagStore
+
+// Renders a template in full before sending anything, so that a failure can still be reported with an error status:
+func renderTemplate(rsp http.ResponseWriter, status int, name string, model interface{}) error {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, model); err != nil {
+		return NewHttpError(http.StatusInternalServerError, "500 Internal Server Error", fmt.Errorf("Could not render '%s'; %s", name, err))
+	}
+	rsp.Header().Add("Content-Type", "text/html; charset=utf-8")
+	rsp.WriteHeader(status)
+	buf.WriteTo(rsp)
+	return nil
+}
+
 func canonicalPath(path string) string {
 	abs, err := filepath.Abs(path)
 	if err != nil {
@@ -46,122 +78,349 @@ func canonicalPath(path string) string {
 	return abs
 }
 
-// Reads the /pics/ directory:
-func getPics() []os.FileInfo {
-	// Open the directory to read its contents:
-	f, err := os.Open(picsDir)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-
-	// Read the directory entries:
-	fis, err := f.Readdir(0)
-	if err != nil {
-		panic(err)
-	}
-
+// Lists an album of the /pics/ directory from the in-memory index:
+func getPics(album string, by sortBy, dir sortDirection) []os.FileInfo {
 	// Remove the opened files from the list (presume they are in mid-upload via SFTP):
+	fis := picIndex.Settled(album)
 
 	// Sort the entries by the desired mode:
-	sort.Sort(ByDate{fis, sortDescending})
+	sort.Sort(sortOrder(album, by, dir)(fis))
 
 	return fis
 }
 
 func getMimeType(filename string) string {
-	return mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+	ext := strings.ToLower(path.Ext(filename))
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return mimeType
+	}
+	// Not every system's MIME table knows video types:
+	return videoMimeTypes[ext]
 }
 
 type FileViewModel struct {
-	Name     string
-	Size     int64
-	Mime     string
-	LastMod  string
-	PicURL   string
-	ThumbURL string
+	Name       string
+	Path       string
+	IsDir      bool
+	AlbumURL   string
+	Size       int64
+	Mime       string
+	LastMod    string
+	Taken      string
+	Dimensions string
+	PicURL     string
+	ThumbURL   string
+	DetailsURL string
+	IsVideo    bool
+	Duration   string
+	Codecs     string
+}
+
+type DuplicateViewModel struct {
+	Name        string
+	DuplicateOf string
 }
 
 type IndexViewModel struct {
-	DeleteURL string
-	UploadURL string
-	Files     []FileViewModel
+	Album       string
+	Breadcrumbs []BreadcrumbViewModel
+	DeleteURL   string
+	RestoreURL  string
+	BatchURL    string
+	UploadURL   string
+	SearchURL   string
+	MapURL      string
+	// Signed-in user; "" when signed out:
+	User      string
+	LoginURL  string
+	LogoutURL string
+	CSRFToken string
+	// Whether upload and delete are available:
+	CanEdit    bool
+	Duplicates []DuplicateViewModel
+	Sort       string
+	Dir        string
+	SortURLs   map[string]string
+	Files      []FileViewModel
+}
+
+// Builds column header links for the page at `pageURL`; clicking the current sort column flips its direction:
+func sortURLs(pageURL string, by sortBy, dir sortDirection) map[string]string {
+	urls := make(map[string]string, len(sortByNames))
+	for name, b := range sortByNames {
+		q := url.Values{"sort": {name}}
+		if b == by {
+			if dir == sortAscending {
+				q.Set("dir", sortDescending.String())
+			} else {
+				q.Set("dir", sortAscending.String())
+			}
+		}
+		urls[name] = pageURL + "?" + q.Encode()
+	}
+	return urls
 }
 
 // HTML handler for `/`:
-func indexHandler(rsp http.ResponseWriter, req *http.Request) {
+func indexHandler(rsp http.ResponseWriter, req *http.Request) error {
 	if req.URL.Path != rootURL {
 		http.Error(rsp, "404 Not Found", http.StatusNotFound)
-		return
+		return nil
+	}
+
+	return renderIndex(rsp, req, "")
+}
+
+// Renders the index page for an album; the root album is "":
+func renderIndex(rsp http.ResponseWriter, req *http.Request, album string) error {
+	q := req.URL.Query()
+	by, dir := parseSort(q.Get("sort"), q.Get("dir"))
+
+	if err := requireViewAlbum(req, album); err != nil {
+		return err
 	}
 
 	var fis []os.FileInfo
-	// Read the directory:
-	fis = getPics()
+	// Read the directory, leaving out albums the requestor may not see:
+	fis = visibleEntries(req, album, getPics(album, by, dir))
 
-	// Successful response:
-	rsp.Header().Add("Content-Type", "text/html; charset=utf-8")
-	rsp.WriteHeader(http.StatusOK)
+	// Changes made from the page must carry this; it may need setting as a cookie:
+	csrfToken := pageCSRFToken(rsp, req)
 
 	// Convert the os.FileInfos to a more HTML-friendly model:
 	model := IndexViewModel{
-		DeleteURL: deleteURL,
-		UploadURL: uploadURL,
-		Files:     make([]FileViewModel, 0, len(fis)),
+		Album:       album,
+		Breadcrumbs: breadcrumbs(album),
+		DeleteURL:   deleteURL,
+		RestoreURL:  restoreURL,
+		BatchURL:    batchURL,
+		UploadURL:   uploadURL + "?" + url.Values{"album": {album}}.Encode(),
+		CSRFToken:   csrfToken,
+		SearchURL:   searchURL,
+		Sort:        by.String(),
+		Dir:         dir.String(),
+		SortURLs:    sortURLs(albumURL(album), by, dir),
+		Files:       make([]FileViewModel, 0, len(fis)),
+	}
+
+	model.CanEdit = canEditAlbum(req, album)
+	if session := currentSession(req); session != nil {
+		model.User = session.User
+	}
+	if accounts != nil {
+		model.LoginURL = loginURL + "?" + url.Values{"next": {req.URL.RequestURI()}}.Encode()
+		model.LogoutURL = logoutURL
+	}
+
+	// The map is unavailable when privacy mode hides locations:
+	if privacy == privacyOff {
+		model.MapURL = mapURL
+	}
+
+	// Report duplicates found by the last upload:
+	dups, ofs := q["dup"], q["of"]
+	for i := 0; i < len(dups) && i < len(ofs); i++ {
+		model.Duplicates = append(model.Duplicates, DuplicateViewModel{Name: dups[i], DuplicateOf: ofs[i]})
 	}
+	metas := metaCache.All()
 	for _, fi := range fis {
-		model.Files = append(model.Files, FileViewModel{
-			Name:     fi.Name(),
-			Size:     fi.Size(),
-			Mime:     getMimeType(fi.Name()),
-			LastMod:  fi.ModTime().String(),
-			PicURL:   pjoin(picsURL, fi.Name()),
-			ThumbURL: pjoin(thumbsURL, fi.Name()),
-		})
+		rel := path.Join(album, fi.Name())
+		fvm := FileViewModel{
+			Name:    fi.Name(),
+			Path:    rel,
+			IsDir:   fi.IsDir(),
+			Size:    fi.Size(),
+			Mime:    getMimeType(fi.Name()),
+			LastMod: fi.ModTime().String(),
+			PicURL:  pjoin(picsURL, rel),
+			IsVideo: !fi.IsDir() && isVideoName(rel),
+		}
+		if !fi.IsDir() {
+			fvm.DetailsURL = pjoin(detailsURL, rel)
+			if hasThumbnail(rel) {
+				fvm.ThumbURL = pjoin(thumbsURL, rel)
+			}
+		}
+		if fi.IsDir() {
+			// Albums link to their own page and borrow a picture from inside for their thumbnail:
+			fvm.AlbumURL = albumURL(rel)
+			visible := func(a string) bool { return canViewAlbum(req, a) }
+			if cover := picIndex.Cover(rel, visible); cover != "" {
+				fvm.ThumbURL = pjoin(thumbsURL, cover)
+			}
+		}
+		if meta, ok := metas[rel]; ok {
+			if !meta.Taken.IsZero() {
+				fvm.Taken = meta.Taken.String()
+			}
+			if meta.Width > 0 {
+				fvm.Dimensions = fmt.Sprintf("%dx%d", meta.Width, meta.Height)
+			}
+			if meta.Duration > 0 {
+				fvm.Duration = formatDuration(meta.Duration)
+			}
+			fvm.Codecs = describeCodecs(meta)
+		}
+		model.Files = append(model.Files, fvm)
 	}
 
 	// Execute the HTML template:
-	templates.ExecuteTemplate(rsp, "index.html", model)
+	return renderTemplate(rsp, http.StatusOK, "index.html", model)
+}
+
+// Outcome of storing a single uploaded file:
+type UploadResult struct {
+	Name        string `json:"name"`
+	Hash        string `json:"hash"`
+	Action      string `json:"action"`
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+}
+
+// Streams an uploaded file into `picsDir` under path `name`, hashing it along the way and deduplicating against existing content:
+func storeUpload(name string, r io.Reader) (UploadResult, error) {
+	destPath := path.Join(picsDir, name)
+	log.Printf("Accepting upload: '%s'\n", destPath)
+
+	// Write to a hidden temporary file first so we can decide what to do with it once we know its hash:
+	tf, err := ioutil.TempFile(picsDir, ".upload-")
+	if err != nil {
+		return UploadResult{}, NewHttpError(http.StatusInternalServerError, "Could not accept upload", fmt.Errorf("Could not create temporary file in '%s'; %s", picsDir, err.Error()))
+	}
+	tmpPath := tf.Name()
+	defer os.Remove(tmpPath)
+	tf.Chmod(0664)
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tf, h), r)
+	tf.Close()
+	if err != nil {
+		return UploadResult{}, NewHttpError(http.StatusInternalServerError, "Could not write upload data to local file", fmt.Errorf("Could not write to local file '%s'; %s", tmpPath, err))
+	}
+
+	result := UploadResult{Name: name, Hash: hex.EncodeToString(h.Sum(nil)), Action: "stored"}
+
+	existing, dup := hashIndex.Lookup(result.Hash)
+	if dup && existing == name {
+		// Same name, same content; nothing to do:
+		result.Action = "unchanged"
+		result.DuplicateOf = existing
+		return result, nil
+	}
+	if dup {
+		result.DuplicateOf = existing
+		if dedup == dedupReject {
+			log.Printf("Rejecting upload '%s': duplicate of '%s'\n", name, existing)
+			result.Action = "rejected"
+			return result, nil
+		}
+
+		// Make the link beside the temporary file, then move it into place so a file already at `destPath` is only
+		// replaced once the link exists:
+		existingPath := path.Join(picsDir, existing)
+		linkPath := tmpPath + ".link"
+		defer os.Remove(linkPath)
+		err := os.Link(existingPath, linkPath)
+		if err == nil {
+			err = os.Rename(linkPath, destPath)
+		}
+		if err == nil {
+			result.Action = "aliased"
+			hashIndex.Add(name, result.Hash)
+			picIndex.Complete(name)
+			return result, nil
+		}
+		// Hard links cannot cross filesystems, e.g. into an album mounted from elsewhere; keep the upload itself:
+		log.Printf("Could not link '%s' to '%s'; storing a copy instead; %s\n", destPath, existingPath, err)
+	}
+
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return UploadResult{}, NewHttpError(http.StatusInternalServerError, "Could not accept upload", fmt.Errorf("Could not move '%s' to '%s'; %s", tmpPath, destPath, err))
+	}
+	hashIndex.Add(name, result.Hash)
+	picIndex.Complete(name)
+	return result, nil
 }
 
 // HTML handler for `/upload`:
-func uploadHandler(rsp http.ResponseWriter, req *http.Request) {
+func uploadHandler(rsp http.ResponseWriter, req *http.Request) error {
 	if req.Method != "POST" {
-		panic(NewHttpError(http.StatusMethodNotAllowed, "Upload requires POST method", fmt.Errorf("Upload requires POST method")))
+		return NewHttpError(http.StatusMethodNotAllowed, "Upload requires POST method", fmt.Errorf("Upload requires POST method"))
+	}
+
+	// Uploads go into the album named in the query string:
+	album, err := getAlbum(req)
+	if err != nil {
+		return err
+	}
+	if err := requireEditAlbum(req, album); err != nil {
+		return err
 	}
 
 	reader, err := req.MultipartReader()
 	if err != nil {
-		panic(NewHttpError(http.StatusBadRequest, "Error parsing multipart form data", err))
+		return NewHttpError(http.StatusBadRequest, "Error parsing multipart form data", err)
 	}
 
 	// Keep reading the multipart form data and handle file uploads:
+	results := make([]UploadResult, 0, 1)
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return NewHttpError(http.StatusBadRequest, "Error parsing multipart form data", err)
+		}
 		if part.FileName() == "" {
 			continue
 		}
 
 		// Copy upload data to a local file:
-		destPath := path.Join(picsDir, part.FileName())
-		log.Printf("Accepting upload: '%s'\n", destPath)
-
-		f, err := os.Create(destPath)
+		name := path.Base(part.FileName())
+		if isHiddenName(name) {
+			return NewHttpError(http.StatusBadRequest, "Uploaded file names may not start with '.'", fmt.Errorf("Rejected hidden file name '%s'", name))
+		}
+		result, err := storeUpload(path.Join(album, name), part)
 		if err != nil {
-			panic(NewHttpError(http.StatusInternalServerError, "Could not accept upload", fmt.Errorf("Could not create local file '%s'; %s", destPath, err.Error())))
+			return err
 		}
-		defer f.Close()
+		results = append(results, result)
+	}
 
-		if _, err := io.Copy(f, part); err != nil {
-			panic(NewHttpError(http.StatusInternalServerError, "Could not write upload data to local file", fmt.Errorf("Could not write to local file '%s'; %s", destPath, err)))
+	// Compute derived metadata in the background:
+	for _, r := range results {
+		if r.Action != "rejected" {
+			queuePicMeta(r.Name)
 		}
 	}
 
-	// 302 to `/`:
-	http.Redirect(rsp, req, rootURL, http.StatusFound)
+	// Scripted clients get the per-file results:
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		rsp.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(rsp).Encode(struct {
+			Success bool           `json:"success"`
+			Files   []UploadResult `json:"files"`
+		}{
+			Success: true,
+			Files:   results,
+		})
+		return nil
+	}
+
+	// 302 back to the album, noting any duplicates found:
+	q := url.Values{}
+	for _, r := range results {
+		if r.DuplicateOf != "" {
+			q.Add("dup", r.Name)
+			q.Add("of", r.DuplicateOf)
+		}
+	}
+	redirectURL := albumURL(album)
+	if len(q) > 0 {
+		redirectURL += "?" + q.Encode()
+	}
+	http.Redirect(rsp, req, redirectURL, http.StatusFound)
+	return nil
 }
 
 func extractNames(fis []os.FileInfo) []string {
@@ -173,63 +432,151 @@ func extractNames(fis []os.FileInfo) []string {
 }
 
 // JSON handler for `/list.php`:
-func listJsonHandler(req *http.Request) (result interface{}) {
-	fis := getPics()
+func listJsonHandler(req *http.Request) (interface{}, error) {
+	q, err := parseListQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	fis := filterPics(visibleEntries(req, q.Album, getPics(q.Album, q.SortBy, q.SortDir)), q)
+
+	// Paging info is only included when paging options are given:
+	var total *int
+	nextCursor := ""
+	if q.Paged() {
+		n := len(fis)
+		total = &n
+
+		var next *cursorKey
+		fis, next = pagePics(fis, entryLess(sortOrder(q.Album, q.SortBy, q.SortDir)), q)
+		if next != nil {
+			nextCursor = next.String()
+		}
+	}
+
+	// Bare names by default; details on request:
+	var files interface{}
+	if q.Detail {
+		files = extractDetails(q.Album, fis)
+	} else {
+		files = extractNames(fis)
+	}
 
 	return struct {
-		BaseUrl string   `json:"baseUrl"`
-		Files   []string `json:"files"`
+		BaseUrl    string      `json:"baseUrl"`
+		Files      interface{} `json:"files"`
+		Total      *int        `json:"total,omitempty"`
+		NextCursor string      `json:"nextCursor,omitempty"`
 	}{
-		BaseUrl: pjoin(siteHost, picsURL),
-		Files:   extractNames(fis),
-	}
+		BaseUrl:    pjoin(siteHost, pjoin(picsURL, q.Album+"/")),
+		Files:      files,
+		Total:      total,
+		NextCursor: nextCursor,
+	}, nil
 }
 
 // JSON handler for `/delete`:
-func deleteJsonHandler(req *http.Request) (result interface{}) {
+func deleteJsonHandler(req *http.Request) (interface{}, error) {
 	if req.Method != "POST" {
-		panic(NewHttpError(http.StatusMethodNotAllowed, "Upload requires POST method", fmt.Errorf("Upload requires POST method")))
+		return nil, NewHttpError(http.StatusMethodNotAllowed, "Upload requires POST method", fmt.Errorf("Upload requires POST method"))
 	}
 
 	// Parse form data:
 	if err := req.ParseForm(); err != nil {
-		panic(NewHttpError(http.StatusBadRequest, "Error parsing form data", err))
+		return nil, NewHttpError(http.StatusBadRequest, "Error parsing form data", err)
 	}
 	filename := req.Form.Get("filename")
 	if filename == "" {
-		panic(NewHttpError(http.StatusBadRequest, "Expecting filename form value", fmt.Errorf("No filename POST value")))
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting filename form value", fmt.Errorf("No filename POST value"))
+	}
+
+	name, ok := safeRelPath(filename)
+	if !ok || name == "" {
+		return nil, NewHttpError(http.StatusBadRequest, "Unable to delete file", fmt.Errorf("Refusing to delete hidden file '%s'", filename))
+	}
+	if err := requireEditAlbum(req, albumOf(name)); err != nil {
+		return nil, err
 	}
 
-	// Remove the file:
-	destPath := path.Join(picsDir, path.Base(filename))
-	if err := os.Remove(destPath); err != nil {
-		panic(NewHttpError(http.StatusBadRequest, "Unable to delete file", fmt.Errorf("Unable to delete file '%s': %s", destPath, err)))
+	// Move the file to the trash:
+	item, err := deletePic(name, requestor(req))
+	if err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, "Unable to delete file", fmt.Errorf("Unable to trash file '%s': %s", name, err))
 	}
 
 	return struct {
-		Success bool `json:"success"`
+		Success bool   `json:"success"`
+		TrashID string `json:"trashId"`
 	}{
 		Success: true,
+		TrashID: item.ID,
+	}, nil
+}
+
+// Thumbnails are square crops of this many pixels on a side:
+const thumbSize = 96
+const thumbPresetName = "96x96"
+
+// Reports whether `/thumbs/` can render a thumbnail for the file:
+func hasThumbnail(name string) bool {
+	mimeType := getMimeType(name)
+	return mimeType == "image/jpeg" || mimeType == "image/gif" || isVideoName(name)
+}
+
+// Calculates the largest centered square within `b`:
+func squareBounds(b image.Rectangle) image.Rectangle {
+	dx, dy := b.Dx(), b.Dy()
+	if dx > dy {
+		offs := (dx - dy) / 2
+		b.Min.X += offs
+		b.Max.X -= offs
+	} else if dy > dx {
+		offs := (dy - dx) / 2
+		b.Min.Y += offs
+		b.Max.Y -= offs
+	} else {
+		// Already square.
 	}
+	return b
 }
 
 // File server for `/thumbs/*`:
-func thumbHandler(rsp http.ResponseWriter, req *http.Request) {
-	filename := removePrefix(req.URL.Path, thumbsURL)
+func thumbHandler(rsp http.ResponseWriter, req *http.Request) error {
+	filename, ok := safeRelPath(removePrefix(req.URL.Path, thumbsURL))
+	if !ok {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", fmt.Errorf("Refusing hidden path '%s'", req.URL.Path))
+	}
+	share, err := requestShare(req, filename)
+	if err != nil {
+		return err
+	}
+	if share == nil {
+		if err := requireViewPic(req, filename); err != nil {
+			return err
+		}
+	}
+	restrictCaching(rsp, filename, share != nil)
 
 	mimeType := getMimeType(filename)
-	if mimeType != "image/jpeg" {
-		panic(NewHttpError(http.StatusBadRequest, "mime type of thumbnail requested is not image/jpeg", fmt.Errorf("mime type of '%s' is '%s'", filename, mimeType)))
+	isVideo := isVideoName(filename)
+	if !hasThumbnail(filename) {
+		return NewHttpError(http.StatusBadRequest, "mime type of thumbnail requested is not image/jpeg, image/gif or a video", fmt.Errorf("mime type of '%s' is '%s'", filename, mimeType))
+	}
+	if isVideo {
+		// Video thumbnails are cached under the video's own name:
+		rsp.Header().Set("Content-Type", "image/jpeg")
 	}
 
 	// Locate the pic and the thumbnail:
-	picPath := path.Join(picsDir, filename)
+	picPath, err := resolvePicPath(filename)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "could not find original image to make thumbnail of", err)
+	}
 	thumbPath := path.Join(thumbsDir, filename)
 
 	// Check if the pic file exists:
 	picFI, err := os.Stat(picPath)
 	if err != nil {
-		panic(NewHttpError(http.StatusBadRequest, "could not find original image to make thumbnail of", fmt.Errorf("cannot find image at '%s'", picPath)))
+		return NewHttpError(http.StatusBadRequest, "could not find original image to make thumbnail of", fmt.Errorf("cannot find image at '%s'", picPath))
 	}
 
 	// Check if the thumbnail file exists:
@@ -238,48 +585,59 @@ func thumbHandler(rsp http.ResponseWriter, req *http.Request) {
 		// If the modtime on the thumbnail is after the pic, serve the thumbnail file:
 		if thumbFI.ModTime().After(picFI.ModTime()) {
 			http.ServeFile(rsp, req, thumbPath)
-			return
+			return nil
 		}
 	}
 
+	// Rendering is the expensive part:
+	if !allowThumbRender(rsp, req) {
+		return nil
+	}
+
+	if mimeType == "image/gif" {
+		// GIFs keep their animation:
+		if err := makeGIFThumbnail(picPath, thumbPath); err != nil {
+			return err
+		}
+		http.ServeFile(rsp, req, thumbPath)
+		return nil
+	}
+
 	// Create a new thumbnail:
 	{
-		// Open the original image:
-		pf, err := os.Open(picPath)
-		defer pf.Close()
-		if err != nil {
-			panic(NewHttpError(http.StatusNotFound, "could not open original image to make thumbnail of", fmt.Errorf("cannot open image file at '%s'", picPath)))
-		}
-		// Decode the JPEG:
-		img, err := jpeg.Decode(pf)
-		if err != nil {
-			panic(NewHttpError(http.StatusBadRequest, "image is not a proper JPEG", fmt.Errorf("image file is not a JPEG: '%s'", picPath)))
+		var img image.Image
+		if isVideo {
+			// Grab a poster frame from the video:
+			img, err = extractPoster(picPath, picFI.ModTime())
+			if err != nil {
+				return NewHttpError(http.StatusNotFound, "could not extract a frame from the video", err)
+			}
+		} else {
+			// Open the original image:
+			pf, err := os.Open(picPath)
+			defer pf.Close()
+			if err != nil {
+				return NewHttpError(http.StatusNotFound, "could not open original image to make thumbnail of", fmt.Errorf("cannot open image file at '%s'", picPath))
+			}
+			// Decode the JPEG:
+			img, err = jpeg.Decode(pf)
+			if err != nil {
+				return NewHttpError(http.StatusBadRequest, "image is not a proper JPEG", fmt.Errorf("image file is not a JPEG: '%s'", picPath))
+			}
 		}
 
-		// Create the thumbnail file:
+		// Create the thumbnail file, mirroring the album structure:
+		os.MkdirAll(path.Dir(thumbPath), 0775)
 		tf, err := os.Create(thumbPath)
 		defer tf.Close()
 		if err != nil {
-			panic(NewHttpError(http.StatusInternalServerError, "could not create thumbnail file", fmt.Errorf("could not create thumbnail file at '%s'; %s", thumbPath, err)))
+			return NewHttpError(http.StatusInternalServerError, "could not create thumbnail file", fmt.Errorf("could not create thumbnail file at '%s'; %s", thumbPath, err))
 		}
 
 		// Calculate the largest square bounds for a thumbnail to preserve aspect ratio
-		b := img.Bounds()
-		srcBounds := b
-		dx, dy := b.Dx(), b.Dy()
-		if dx > dy {
-			offs := (dx - dy) / 2
-			srcBounds.Min.X += offs
-			srcBounds.Max.X -= offs
-		} else if dy > dx {
-			offs := (dy - dx) / 2
-			srcBounds.Min.Y += offs
-			srcBounds.Max.Y -= offs
-		} else {
-			// Already square.
-		}
+		srcBounds := squareBounds(img.Bounds())
 
-		//log.Printf("'%s': resize %v to %v\n", filename, b, srcBounds)
+		//log.Printf("'%s': resize %v to %v\n", filename, img.Bounds(), srcBounds)
 
 		// Cut out the center square to a new image:
 		var boximg image.Image
@@ -288,31 +646,47 @@ func thumbHandler(rsp http.ResponseWriter, req *http.Request) {
 			boximg = img.SubImage(srcBounds)
 		case *image.YCbCr:
 			boximg = img.SubImage(srcBounds)
+		case interface {
+			SubImage(image.Rectangle) image.Image
+		}:
+			// Poster frames may come from PNG cover art:
+			boximg = img.SubImage(srcBounds)
+		default:
+			return NewHttpError(http.StatusInternalServerError, "could not crop image for thumbnail", fmt.Errorf("cannot crop %T for '%s'", img, filename))
 		}
 
 		//log.Printf("'%s': resized to %v\n", filename, boximg.Bounds())
 
 		// Apply resizing algorithm:
-		thumbImg := resize.Resize(boximg, boximg.Bounds(), 96, 96)
+		thumbImg := resize.Resize(boximg, boximg.Bounds(), thumbSize, thumbSize)
 
 		// Encode to JPEG:
 		//log.Printf("'%s': JPEG encode\n", filename)
 		err = jpeg.Encode(tf, thumbImg, &jpeg.Options{Quality: 90})
 
 		if err != nil {
-			panic(NewHttpError(http.StatusInternalServerError, "error while encoding JPEG", fmt.Errorf("failed encoding JPEG for '%s': %s", thumbPath, err)))
+			return NewHttpError(http.StatusInternalServerError, "error while encoding JPEG", fmt.Errorf("failed encoding JPEG for '%s': %s", thumbPath, err))
 		}
 	}
 
 	// Serve the thumbnail:
 	http.ServeFile(rsp, req, thumbPath)
-	return
+	return nil
 }
 
 func main() {
 	var socketType string
 	var socketAddr string
 	var templatesDir string
+	var dedupName string
+	var rescanInterval time.Duration
+	var partialNames string
+	var privacyName string
+	var ffmpegName string
+	var hashPassword bool
+	var tokensFile string
+	var sharesFile string
+	var trustedProxyList, readRate, uploadRate, thumbRate string
 
 	// TODO(jsd): Make this pair of arguments a little more elegant, like "unix:/path/to/socket" or "tcp://:8080"
 	flag.StringVar(&socketType, "l", "tcp", `type of socket to listen on; "unix" or "tcp" (default)`)
@@ -323,8 +697,82 @@ func main() {
 	flag.StringVar(&templatesDir, "tmpl", "./tmpl", "local filesystem path to HTML templates")
 	flag.StringVar(&picsDir, "pics", "./pics", "local filesystem path to store pictures")
 	flag.StringVar(&thumbsDir, "thumbs", "./thumbs", "local filesystem path to cache thumbnails")
+	flag.DurationVar(&rescanInterval, "rescan", 10*time.Minute, "how often to fully rescan the pics directory in case change notifications were missed")
+	flag.DurationVar(&settleTime, "settle", 5*time.Second, "hide files modified more recently than this, presuming they are mid-upload")
+	flag.StringVar(&partialNames, "partial", strings.Join(partialPatterns, ","), "comma-separated name patterns of files still being transferred")
+	flag.BoolVar(&checkOpenFiles, "check-open", false, "also hide files other processes have open for writing (Linux only)")
+	flag.DurationVar(&trashRetention, "trash-retention", 30*24*time.Hour, "how long deleted files are kept in the trash before being purged; 0 keeps them forever")
+	flag.StringVar(&dedupName, "dupes", "reject", `what to do with uploads identical to an existing picture; "reject" (default) or "alias" (hard link; "link" is accepted too)`)
+	flag.StringVar(&privacyName, "privacy", "off", `metadata to strip from served originals, refusing images and videos it cannot be stripped from; "off" (default), "location" (GPS, maker notes, XMP and IPTC) or "all" (also camera and owner details)`)
+	flag.StringVar(&ffmpegName, "ffmpeg", "ffmpeg", `ffmpeg executable used to grab video poster frames; "" uses only the built-in MP4 and MJPEG reader`)
+	flag.StringVar(&tileURL, "tiles", "https://tile.openstreetmap.org/{z}/{x}/{y}.png", "map tile URL template for the map page")
+	flag.StringVar(&tileAttribution, "tile-attribution", `&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a> contributors`, "attribution HTML shown for the map tiles")
+	flag.StringVar(&usersFile, "users", "", "JSON file of accounts allowed to upload and delete; if not given, anyone can")
+	flag.StringVar(&tokensFile, "tokens", "", "JSON file of API tokens; defaults to tokens.json beside the users file")
+	flag.StringVar(&sharesFile, "shares", "", "JSON file holding the share link signing key and download counts; defaults to shares.json beside the users file")
+	flag.StringVar(&trustedProxyList, "trusted-proxies", "", "comma-separated IP addresses and CIDR ranges of reverse proxies whose X-Forwarded-For is believed; peers on a unix socket always are")
+	flag.StringVar(&readRate, "rate-read", "600/1m", `requests per client per period, e.g. "600/1m"; "0/1m" turns the limit off`)
+	flag.StringVar(&uploadRate, "rate-upload", "30/1m", "uploads per client per period")
+	flag.StringVar(&thumbRate, "rate-thumbs", "120/1m", "thumbnail renders per client per period; cached thumbnails count as reads")
+	flag.BoolVar(&hashPassword, "hash-password", false, "read a password from standard input, print its bcrypt hash for the users file and exit")
 	flag.Parse()
 
+	if hashPassword {
+		input, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hash, err := hashPasswordCommand(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	var err error
+	if dedup, err = parseDedupMode(dedupName); err != nil {
+		log.Fatal(err)
+	}
+
+	if privacy, err = parsePrivacyMode(privacyName); err != nil {
+		log.Fatal(err)
+	}
+
+	partialPatterns = parsePartialPatterns(partialNames)
+
+	configurePosterExtractors(ffmpegName)
+
+	if trustedProxies, err = parseTrustedProxies(trustedProxyList); err != nil {
+		log.Fatal(err)
+	}
+	budgets := make([]rateBudget, 3)
+	for i, rate := range []string{readRate, uploadRate, thumbRate} {
+		if budgets[i], err = parseRateBudget(rate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	readLimiter, uploadLimiter, thumbLimiter = NewRateLimiter(budgets[0]), NewRateLimiter(budgets[1]), NewRateLimiter(budgets[2])
+	for _, l := range []*RateLimiter{readLimiter, uploadLimiter, thumbLimiter} {
+		l.SweepEvery(time.Minute)
+	}
+	log.Printf("rates:     read %s, upload %s, thumbnail renders %s\n", readLimiter.budget, uploadLimiter.budget, thumbLimiter.budget)
+
+	if usersFile != "" {
+		if accounts, err = LoadAccounts(usersFile); err != nil {
+			log.Fatal(err)
+		}
+		if tokensFile == "" {
+			tokensFile = path.Join(path.Dir(usersFile), "tokens.json")
+		}
+		if sharesFile == "" {
+			sharesFile = path.Join(path.Dir(usersFile), "shares.json")
+		}
+		log.Printf("users:     %s (%d accounts)\n", usersFile, len(accounts.users))
+	} else {
+		log.Printf("No -users file given; anyone can upload and delete\n")
+	}
+
 	// Clean up args:
 	siteHost = removeSuffix(siteHost, "/")
 	proxyRoot = removeSuffix(proxyRoot, "/")
@@ -350,6 +798,54 @@ func main() {
 		os.Mkdir(thumbsDir, 0775)
 	}
 
+	// Index the content of existing pictures for duplicate detection:
+	if err := hashIndex.Rebuild(picsDir); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load cached metadata and catch up on any pictures added while we were down:
+	metaCache = NewMetaCache(path.Join(thumbsDir, ".meta.json"))
+	if err := metaCache.Load(); err != nil {
+		log.Printf("Could not load metadata cache; %s\n", err)
+	}
+	metaCache.SaveEvery(30 * time.Second)
+
+	// Load API tokens:
+	if accounts != nil {
+		tokenStore = NewTokenStore(tokensFile)
+		if err := tokenStore.Load(); err != nil {
+			log.Fatal(err)
+		}
+		tokenStore.SaveEvery(time.Minute)
+
+		// Share links are only needed when not everything is public:
+		shareStore = NewShareStore(sharesFile)
+		if err := shareStore.Load(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load tags and virtual albums:
+	tagStore = NewTagStore(path.Join(picsDir, ".tags.json"))
+	if err := tagStore.Load(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Index the pics directory and follow changes to it:
+	picIndex = NewDirIndex(picsDir)
+	if err := picIndex.Rescan(); err != nil {
+		log.Fatal(err)
+	}
+	if err := picIndex.Watch(rescanInterval); err != nil {
+		log.Fatal(err)
+	}
+
+	go processMetaQueue()
+	go scanPicMetas()
+
+	// Purge expired trash hourly:
+	purgeTrashEvery(time.Hour)
+
 	// Parse HTML templates:
 	templates = template.Must(template.ParseGlob(path.Join(templatesDir, "*.html")))
 
@@ -369,6 +865,16 @@ func main() {
 		// Wait for a signal:
 		sig := <-c
 		log.Printf("Caught signal '%s': shutting down.", sig)
+		// Flush cached metadata:
+		if err := metaCache.Save(); err != nil {
+			log.Printf("Could not save metadata cache; %s\n", err)
+		}
+		// Record when API tokens were last used:
+		if tokenStore != nil {
+			if err := tokenStore.Save(); err != nil {
+				log.Printf("Could not save tokens; %s\n", err)
+			}
+		}
 		// Stop listening:
 		l.Close()
 		// Delete the unix socket, if applicable:
@@ -396,14 +902,104 @@ func main() {
 	deleteURL = pjoin(proxyRoot, "/delete")
 	mux.Handle(deleteURL, NewJsonHandler(deleteJsonHandler))
 
+	// Trash handlers:
+	mux.Handle(pjoin(proxyRoot, "/trash"), NewJsonHandler(trashJsonHandler))
+	restoreURL = pjoin(proxyRoot, "/trash/restore")
+	mux.Handle(restoreURL, NewJsonHandler(restoreJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/trash/purge"), NewJsonHandler(purgeJsonHandler))
+
+	// Batch handlers:
+	batchURL = pjoin(proxyRoot, "/batch/")
+	mux.Handle(pjoin(batchURL, "delete"), NewJsonHandler(batchDeleteJsonHandler))
+	mux.Handle(pjoin(batchURL, "rename"), NewJsonHandler(batchRenameJsonHandler))
+	mux.Handle(pjoin(batchURL, "move"), NewJsonHandler(batchMoveJsonHandler))
+
+	// Tags and virtual albums:
+	mux.Handle(pjoin(proxyRoot, "/tags"), NewJsonHandler(tagsJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/tags/add"), NewJsonHandler(tagAddJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/tags/remove"), NewJsonHandler(tagRemoveJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/caption"), NewJsonHandler(captionJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/valbums"), NewJsonHandler(virtualAlbumsJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/valbums/create"), NewJsonHandler(virtualAlbumCreateJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/valbums/delete"), NewJsonHandler(virtualAlbumDeleteJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/valbums/add"), NewJsonHandler(virtualAlbumAddJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/valbums/remove"), NewJsonHandler(virtualAlbumRemoveJsonHandler))
+
+	// Per-file metadata pages:
+	detailsURL = pjoin(proxyRoot, "/details/")
+	mux.Handle(detailsURL, NewErrorHandler(detailsHandler))
+
+	// Map of geotagged pictures:
+	mapURL = pjoin(proxyRoot, "/map")
+	mux.Handle(mapURL, NewErrorHandler(mapHandler))
+	geoURL = pjoin(proxyRoot, "/geo.json")
+	mux.Handle(geoURL, NewJsonHandler(geoJsonHandler))
+
+	// Search:
+	searchURL = pjoin(proxyRoot, "/search")
+	mux.Handle(searchURL, NewJsonHandler(searchJsonHandler))
+
+	// Near-duplicate detection:
+	mux.Handle(pjoin(proxyRoot, "/similar"), NewJsonHandler(similarJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/duplicates"), NewJsonHandler(duplicatesJsonHandler))
+
+	// Album pages:
+	albumsURL = pjoin(proxyRoot, "/albums/")
+	mux.Handle(albumsURL, NewErrorHandler(albumHandler))
+
 	// Serve /pics/ from the folder:
 	picsURL = pjoin(proxyRoot, "/pics/")
-	mux.Handle(picsURL, http.StripPrefix(picsURL, http.FileServer(http.Dir(picsDir))))
+	picsFileServer = http.FileServer(http.Dir(picsDir))
+	mux.Handle(picsURL, http.StripPrefix(picsURL, NewErrorHandler(picsFileHandler)))
 
 	// Serve /thumbs/ requests dynamically with a filesystem-backed cache:
 	thumbsURL = pjoin(proxyRoot, "/thumbs/")
 	mux.Handle(thumbsURL, NewErrorHandler(thumbHandler))
 
+	// Accounts:
+	loginURL = pjoin(proxyRoot, "/login")
+	mux.Handle(loginURL, NewErrorHandler(loginHandler))
+	logoutURL = pjoin(proxyRoot, "/logout")
+	mux.Handle(logoutURL, NewErrorHandler(logoutHandler))
+
+	// API tokens:
+	mux.Handle(pjoin(proxyRoot, "/tokens"), NewJsonHandler(tokensJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/tokens/create"), NewJsonHandler(tokenCreateJsonHandler))
+	mux.Handle(pjoin(proxyRoot, "/tokens/revoke"), NewJsonHandler(tokenRevokeJsonHandler))
+
+	// Share links:
+	mux.Handle(pjoin(proxyRoot, "/share"), NewJsonHandler(shareJsonHandler))
+
+	// Viewing stays public; changing anything requires signing in:
+	auth := NewAuthHandler(mux)
+	auth.RequireLogin(pjoin(proxyRoot, "/tokens"), pjoin(proxyRoot, "/trash"))
+	// Anything that changes state also needs the CSRF token from our pages:
+	auth.RequireCSRF(
+		uploadURL,
+		deleteURL,
+		restoreURL,
+		pjoin(proxyRoot, "/trash/purge"),
+		pjoin(batchURL, "delete"),
+		pjoin(batchURL, "rename"),
+		pjoin(batchURL, "move"),
+		pjoin(proxyRoot, "/tags/add"),
+		pjoin(proxyRoot, "/tags/remove"),
+		pjoin(proxyRoot, "/caption"),
+		pjoin(proxyRoot, "/valbums/create"),
+		pjoin(proxyRoot, "/valbums/delete"),
+		pjoin(proxyRoot, "/valbums/add"),
+		pjoin(proxyRoot, "/valbums/remove"),
+		pjoin(proxyRoot, "/tokens/create"),
+		pjoin(proxyRoot, "/tokens/revoke"),
+		pjoin(proxyRoot, "/share"),
+	)
+
+	// Scripts holding API tokens may view, upload and delete; tokens are refused everywhere else:
+	auth.AllowToken(scopeRead, listURL, searchURL, pjoin(proxyRoot, "/trash"), pjoin(proxyRoot, "/tags"), pjoin(proxyRoot, "/valbums"))
+	auth.AllowToken(scopeRead, picsURL, thumbsURL, detailsURL, albumsURL, geoURL, pjoin(proxyRoot, "/similar"), pjoin(proxyRoot, "/duplicates"))
+	auth.AllowToken(scopeUpload, uploadURL)
+	auth.AllowToken(scopeDelete, deleteURL, pjoin(batchURL, "delete"), restoreURL, pjoin(proxyRoot, "/trash/purge"))
+
 	// Start the HTTP server on the listening socket:
-	log.Fatal(http.Serve(l, http.Handler(mux)))
+	log.Fatal(http.Serve(l, NewRateLimitHandler(auth, mux)))
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// Points the server's stores at empty temporary directories:
+func setupTestStores(t *testing.T) {
+	t.Helper()
+	picsDir, thumbsDir = t.TempDir(), t.TempDir()
+	hashIndex = NewHashIndex()
+	picIndex = NewDirIndex(picsDir)
+	metaCache = NewMetaCache(path.Join(thumbsDir, ".meta.json"))
+	tagStore = NewTagStore(path.Join(picsDir, ".tags.json"))
+	searchIndex = NewSearchIndex()
+	duplicateGroups = &DuplicateGroups{}
+}
+
+// Signs accounts in with the password "secret":
+const testPasswordHash = "$2a$10$tFUypo1DM3/hog83XoCREOeaaCysCejI.cNMTNSqPhaOFRZ8w9kk."
+
+// Loads accounts from the given users file content, along with empty token and share stores, until the test ends:
+func setupTestAccounts(t *testing.T, usersJSON string) {
+	t.Helper()
+	dir := t.TempDir()
+	p := path.Join(dir, "users.json")
+	if err := ioutil.WriteFile(p, []byte(usersJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := LoadAccounts(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts = a
+	tokenStore = NewTokenStore(path.Join(dir, "tokens.json"))
+	if err := tokenStore.Load(); err != nil {
+		t.Fatal(err)
+	}
+	shareStore = NewShareStore(path.Join(dir, "shares.json"))
+	if err := shareStore.Load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		accounts, tokenStore, shareStore = nil, nil, nil
+	})
+}
+
+// Writes a file under `picsDir` and adds it to the index:
+func writeTestPic(t *testing.T, rel string, data []byte) {
+	t.Helper()
+	p := path.Join(picsDir, rel)
+	if err := os.MkdirAll(path.Dir(p), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListJsonHandlerErrors(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "a.jpg", []byte("x"))
+	tests := []struct {
+		query  string
+		status int
+		code   string
+	}{
+		{"", http.StatusOK, ""},
+		{"album=nope", http.StatusNotFound, "not_found"},
+		{"album=../x", http.StatusNotFound, "not_found"},
+		{"limit=-1", http.StatusBadRequest, "bad_request"},
+		{"cursor=!!", http.StatusBadRequest, "bad_request"},
+		{"sort=size&dir=up", http.StatusBadRequest, "bad_request"},
+	}
+	for _, tt := range tests {
+		status, body := serveJson(t, NewJsonHandler(listJsonHandler), httptest.NewRequest("GET", "/list?"+tt.query, nil))
+		if status != tt.status || body.Code != tt.code {
+			t.Errorf("%q: %d %q, want %d %q", tt.query, status, body.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestRenderTemplateFailure(t *testing.T) {
+	saved := templates
+	defer func() { templates = saved }()
+	templates = template.Must(template.New("page.html").Parse(`before {{.Missing}} after`))
+
+	rec := httptest.NewRecorder()
+	NewErrorHandler(func(rsp http.ResponseWriter, req *http.Request) error {
+		return renderTemplate(rsp, http.StatusOK, "page.html", struct{}{})
+	}).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "500 Internal Server Error\n" {
+		t.Errorf("got %d %q", rec.Code, rec.Body.String())
+	}
+}
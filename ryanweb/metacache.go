@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Images with more pixels than this are not decoded to hash them, only their dimensions recorded:
+const hashMaxPixels = 64 << 20
+
+// Bump whenever `PicMeta` gains fields so stale cache entries are recomputed:
+const picMetaVersion = 7
+
+// Derived per-picture metadata, expensive to compute and so cached on disk:
+type PicMeta struct {
+	Version int       `json:"version"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+
+	// SHA-256 of the content:
+	Hash string `json:"hash"`
+
+	// Pixel dimensions of images and videos as displayed; zero if unknown:
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// When the picture was taken according to its EXIF data; zero if unknown:
+	Taken time.Time `json:"taken"`
+
+	// Photographic details from EXIF:
+	Camera       string    `json:"camera,omitempty"`
+	Lens         string    `json:"lens,omitempty"`
+	ExposureTime string    `json:"exposureTime,omitempty"`
+	FNumber      float64   `json:"fNumber,omitempty"`
+	ISO          int       `json:"iso,omitempty"`
+	FocalLength  float64   `json:"focalLength,omitempty"`
+	GPS          *GeoPoint `json:"gps,omitempty"`
+
+	// IPTC caption and XMP rating:
+	Caption string `json:"caption,omitempty"`
+	Rating  int    `json:"rating,omitempty"`
+
+	// Running time of videos; zero if unknown:
+	Duration time.Duration `json:"duration,omitempty"`
+	// Clockwise rotation of videos in degrees, already applied to the dimensions:
+	Rotation int `json:"rotation,omitempty"`
+	// Sample formats of videos' video and audio tracks, e.g. "avc1" and "mp4a":
+	VideoCodec string `json:"videoCodec,omitempty"`
+	AudioCodec string `json:"audioCodec,omitempty"`
+
+	// Perceptual hashes; only valid if `Hashed` (i.e. the file is a decodable image):
+	Hashed bool   `json:"hashed,omitempty"`
+	DHash  uint64 `json:"dHash,omitempty"`
+	PHash  uint64 `json:"pHash,omitempty"`
+}
+
+// Reports whether the cached metadata still describes the file:
+func (m *PicMeta) Fresh(fi os.FileInfo) bool {
+	return m.Version == picMetaVersion && m.Size == fi.Size() && m.ModTime.Equal(fi.ModTime())
+}
+
+// JSON-file backed cache of `PicMeta` keyed by file name:
+type MetaCache struct {
+	lock  sync.RWMutex
+	path  string
+	dirty bool
+	metas map[string]*PicMeta
+	// Bumped on every change, so results derived from the cache can tell when they are stale:
+	generation uint64
+}
+
+func NewMetaCache(path string) *MetaCache {
+	return &MetaCache{path: path, metas: make(map[string]*PicMeta)}
+}
+
+// Loads the cache file; a missing file is not an error:
+func (c *MetaCache) Load() error {
+	b, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	metas := make(map[string]*PicMeta)
+	if err := json.Unmarshal(b, &metas); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.metas = metas
+	c.generation++
+	c.lock.Unlock()
+	return nil
+}
+
+// Writes the cache file if anything changed since the last save:
+func (c *MetaCache) Save() error {
+	c.lock.Lock()
+	if !c.dirty {
+		c.lock.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(c.metas)
+	c.dirty = false
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename over the old one so a crash never leaves a torn cache:
+	tf, err := ioutil.TempFile(filepath.Dir(c.path), ".meta-")
+	if err != nil {
+		return err
+	}
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return err
+	}
+	tf.Close()
+	return os.Rename(tf.Name(), c.path)
+}
+
+// Periodically saves the cache in the background:
+func (c *MetaCache) SaveEvery(d time.Duration) {
+	go func() {
+		for range time.Tick(d) {
+			if err := c.Save(); err != nil {
+				log.Printf("Could not save metadata cache '%s'; %s\n", c.path, err)
+			}
+		}
+	}()
+}
+
+// Returns a copy of the cached metadata for the named file:
+func (c *MetaCache) Get(name string) (meta PicMeta, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	m, ok := c.metas[name]
+	if ok {
+		meta = *m
+	}
+	return
+}
+
+func (c *MetaCache) Put(name string, meta PicMeta) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.metas[name] = &meta
+	c.dirty = true
+	c.generation++
+}
+
+func (c *MetaCache) Remove(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.metas[name]; ok {
+		delete(c.metas, name)
+		c.dirty = true
+		c.generation++
+	}
+}
+
+// Returns a snapshot of all cached metadata:
+func (c *MetaCache) All() map[string]PicMeta {
+	all, _ := c.Snapshot()
+	return all
+}
+
+// Returns a snapshot of all cached metadata along with the generation it was taken at:
+func (c *MetaCache) Snapshot() (map[string]PicMeta, uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	all := make(map[string]PicMeta, len(c.metas))
+	for name, m := range c.metas {
+		all[name] = *m
+	}
+	return all, c.generation
+}
+
+// Computes the metadata for the named picture and invalidates the search index if it changed:
+func refreshPicMeta(name string) (PicMeta, error) {
+	meta, changed, err := updatePicMeta(name)
+	if changed {
+		searchIndex.Invalidate()
+	}
+	return meta, err
+}
+
+// Computes the metadata for the named picture, reusing the cached copy if the file has not changed; reports whether
+// the cache changed, leaving it to the caller to invalidate the search index:
+func updatePicMeta(name string) (PicMeta, bool, error) {
+	picPath := path.Join(picsDir, name)
+	fi, err := os.Lstat(picPath)
+	if err != nil {
+		return PicMeta{}, false, err
+	}
+	if meta, ok := metaCache.Get(name); ok && meta.Fresh(fi) {
+		return meta, false, nil
+	}
+
+	meta := PicMeta{Version: picMetaVersion, Size: fi.Size(), ModTime: fi.ModTime()}
+	if meta.Hash, err = hashFile(picPath); err != nil {
+		return PicMeta{}, false, err
+	}
+	hashIndex.Add(name, meta.Hash)
+
+	mimeType := getMimeType(name)
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		f, err := os.Open(picPath)
+		if err != nil {
+			return PicMeta{}, false, err
+		}
+		defer f.Close()
+
+		// Check the size the file declares before decoding anything; a tiny file may declare a huge image:
+		config, _, err := image.DecodeConfig(f)
+		if err != nil {
+			// Still cache the file so we do not retry decoding it until it changes:
+			log.Printf("Could not decode image '%s'; %s\n", name, err)
+			break
+		}
+		meta.Width, meta.Height = config.Width, config.Height
+		if int64(config.Width)*int64(config.Height) > hashMaxPixels {
+			log.Printf("Not hashing image '%s' of %dx%d\n", name, config.Width, config.Height)
+			break
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return PicMeta{}, false, err
+		}
+		img, _, err := image.Decode(f)
+		if err != nil {
+			log.Printf("Could not decode image '%s'; %s\n", name, err)
+			break
+		}
+		hashImage(img, &meta)
+	case mimeType == "video/mp4" || mimeType == "video/quicktime":
+		if info, err := readMP4File(picPath); err == nil {
+			meta.Duration = info.Duration
+			meta.Width, meta.Height = info.Width, info.Height
+			meta.Rotation = info.Rotation
+			meta.VideoCodec, meta.AudioCodec = info.VideoCodec, info.AudioCodec
+		} else {
+			log.Printf("Could not read video metadata of '%s'; %s\n", name, err)
+		}
+	}
+
+	if hasPhotoMeta(name) {
+		if err := readPhotoMeta(picPath, &meta); err != nil {
+			log.Printf("Could not read photo metadata of '%s'; %s\n", name, err)
+		}
+	}
+
+	metaCache.Put(name, meta)
+	return meta, true, nil
+}
+
+// Brings the metadata cache up to date with `picsDir`, dropping entries for files that no longer exist:
+func scanPicMetas() {
+	present := make(map[string]bool)
+	for _, name := range picIndex.AllFiles() {
+		present[name] = true
+		// The search index is invalidated once the scan is done, rather than after every picture:
+		if _, _, err := updatePicMeta(name); err != nil {
+			log.Printf("Could not compute metadata for '%s'; %s\n", name, err)
+		}
+	}
+	for name := range metaCache.All() {
+		if !present[name] {
+			metaCache.Remove(name)
+		}
+	}
+	searchIndex.Invalidate()
+}
+
+// Names of pictures waiting for their metadata to be computed in the background:
+var metaQueue = make(chan string, 1024)
+
+// Queues the named picture for a background metadata refresh; if the queue is full the next scan catches it:
+func queuePicMeta(name string) {
+	select {
+	case metaQueue <- name:
+	default:
+	}
+}
+
+// Computes queued metadata one picture at a time so bursts of uploads do not swamp the CPU:
+func processMetaQueue() {
+	changed := false
+	for name := range metaQueue {
+		_, c, err := updatePicMeta(name)
+		if err != nil {
+			log.Printf("Could not compute metadata for '%s'; %s\n", name, err)
+		}
+		changed = changed || c
+
+		// Invalidate the search index once a burst has been worked through, rather than after every picture:
+		if changed && len(metaQueue) == 0 {
+			searchIndex.Invalidate()
+			changed = false
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// Builds a PNG that declares a `width` by `height` image but carries no image data:
+func testPNGHeader(width, height uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	// Bit depth 8, truecolor with alpha, default compression, filter and interlacing:
+	ihdr[8], ihdr[9] = 8, 6
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestUpdatePicMetaHashesImages(t *testing.T) {
+	setupTestStores(t)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPic(t, "small.png", buf.Bytes())
+
+	meta, changed, err := updatePicMeta("small.png")
+	if err != nil || !changed {
+		t.Fatalf("updatePicMeta = %v, %v", changed, err)
+	}
+	if meta.Width != 40 || meta.Height != 30 || !meta.Hashed {
+		t.Errorf("small image: got %dx%d, hashed %v", meta.Width, meta.Height, meta.Hashed)
+	}
+}
+
+func TestUpdatePicMetaSkipsHugeImages(t *testing.T) {
+	setupTestStores(t)
+	// Would take 40 GB to decode:
+	writeTestPic(t, "bomb.png", testPNGHeader(100000, 100000))
+
+	meta, _, err := updatePicMeta("bomb.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Width != 100000 || meta.Height != 100000 {
+		t.Errorf("got %dx%d, want the declared dimensions", meta.Width, meta.Height)
+	}
+	if meta.Hashed {
+		t.Error("huge image was hashed")
+	}
+	if meta.Hash == "" {
+		t.Error("content hash missing")
+	}
+}
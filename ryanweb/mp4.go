@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Minimal ISO base media file format (MP4/MOV) box reader.
+
+var errBoxNotFound = errors.New("mp4: box not found")
+
+// A box's header starts at `At` and its payload lies in [Start, End) of the file:
+type mp4Box struct {
+	Type           string
+	At, Start, End int64
+}
+
+// Calls `visit` with each of the sibling boxes in [start, end) until it returns false:
+func walkMP4Boxes(r io.ReaderAt, start, end int64, visit func(box mp4Box) bool) error {
+	var hdr [16]byte
+	for pos := start; pos+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], pos); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		boxType := string(hdr[4:8])
+		headerLen := int64(8)
+
+		switch size {
+		case 0:
+			// Box extends to the end of its container:
+			size = end - pos
+		case 1:
+			// 64-bit size follows the type:
+			if _, err := r.ReadAt(hdr[8:16], pos+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen || size > end-pos {
+			return errors.New("mp4: malformed box size")
+		}
+
+		if !visit(mp4Box{Type: boxType, At: pos, Start: pos + headerLen, End: pos + size}) {
+			return nil
+		}
+		pos += size
+	}
+	return nil
+}
+
+// Finds the first box of type `typ` among the sibling boxes in [start, end):
+func findMP4Box(r io.ReaderAt, start, end int64, typ string) (found mp4Box, err error) {
+	err = walkMP4Boxes(r, start, end, func(box mp4Box) bool {
+		if box.Type == typ {
+			found = box
+			return false
+		}
+		return true
+	})
+	if err == nil && found.Type != typ {
+		err = errBoxNotFound
+	}
+	return
+}
+
+// Follows a path of nested box types, e.g. "moov", "mvhd":
+func findMP4Path(r io.ReaderAt, size int64, types ...string) (box mp4Box, err error) {
+	box = mp4Box{Start: 0, End: size}
+	for _, typ := range types {
+		if box, err = findMP4Box(r, box.Start, box.End, typ); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Reads the movie duration from the `mvhd` box:
+func readMP4Duration(r io.ReaderAt, size int64) (time.Duration, error) {
+	mvhd, err := findMP4Path(r, size, "moov", "mvhd")
+	if err != nil {
+		return 0, err
+	}
+
+	var b [32]byte
+	if _, err := r.ReadAt(b[:1], mvhd.Start); err != nil {
+		return 0, err
+	}
+
+	var timescale, duration uint64
+	if b[0] == 1 {
+		// version(1) flags(3) creation(8) modification(8) timescale(4) duration(8)
+		if _, err := r.ReadAt(b[:32], mvhd.Start); err != nil {
+			return 0, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[20:24]))
+		duration = binary.BigEndian.Uint64(b[24:32])
+	} else {
+		// version(1) flags(3) creation(4) modification(4) timescale(4) duration(4)
+		if _, err := r.ReadAt(b[:20], mvhd.Start); err != nil {
+			return 0, err
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	}
+	if timescale == 0 {
+		return 0, errors.New("mp4: zero timescale")
+	}
+
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+// What we report about a movie:
+type mp4Info struct {
+	Duration time.Duration
+	// Display size, i.e. after rotation; zero if there is no video track:
+	Width, Height int
+	// Clockwise rotation the player applies, in degrees: 0, 90, 180 or 270:
+	Rotation int
+	// Sample formats of the first video and audio tracks, e.g. "avc1" and "mp4a":
+	VideoCodec, AudioCodec string
+}
+
+// Reads duration, and size, rotation and codecs of the first video and audio tracks:
+func readMP4Info(r io.ReaderAt, size int64) (*mp4Info, error) {
+	d, err := readMP4Duration(r, size)
+	if err != nil {
+		return nil, err
+	}
+	info := &mp4Info{Duration: d}
+
+	if trak, err := findMP4Track(r, size, "vide"); err == nil {
+		// A broken track header still leaves the duration and codec worth reporting:
+		readMP4TrackHeader(r, trak, info)
+		info.VideoCodec, _ = readMP4SampleFormat(r, trak)
+	}
+	if trak, err := findMP4Track(r, size, "soun"); err == nil {
+		info.AudioCodec, _ = readMP4SampleFormat(r, trak)
+	}
+	return info, nil
+}
+
+// Reads the presentation size and rotation matrix from a track's `tkhd` box:
+func readMP4TrackHeader(r io.ReaderAt, trak mp4Box, info *mp4Info) error {
+	tkhd, err := findMP4Within(r, trak, "tkhd")
+	if err != nil {
+		return err
+	}
+
+	// version(1) flags(3) creation(4) modification(4) track_ID(4) reserved(4) duration(4) reserved(8)
+	// layer(2) alternate_group(2) volume(2) reserved(2) matrix(36) width(4) height(4);
+	// version 1 widens the times and duration to 8 bytes:
+	var b [96]byte
+	if _, err := r.ReadAt(b[:1], tkhd.Start); err != nil {
+		return err
+	}
+	matrixAt := 40
+	if b[0] == 1 {
+		matrixAt = 52
+	}
+	if _, err := r.ReadAt(b[:matrixAt+44], tkhd.Start); err != nil {
+		return err
+	}
+
+	// The matrix is { a b u; c d v; x y w } with a, b, c, d in 16.16 fixed point:
+	m := b[matrixAt:]
+	ma := int32(binary.BigEndian.Uint32(m[0:4])) >> 16
+	mb := int32(binary.BigEndian.Uint32(m[4:8])) >> 16
+	switch {
+	case ma == 0 && mb == 1:
+		info.Rotation = 90
+	case ma == -1:
+		info.Rotation = 180
+	case ma == 0 && mb == -1:
+		info.Rotation = 270
+	}
+
+	// Width and height are 16.16 fixed point too:
+	w := int(binary.BigEndian.Uint32(b[matrixAt+36:]) >> 16)
+	h := int(binary.BigEndian.Uint32(b[matrixAt+40:]) >> 16)
+	if info.Rotation == 90 || info.Rotation == 270 {
+		w, h = h, w
+	}
+	info.Width, info.Height = w, h
+	return nil
+}
+
+func readMP4File(filePath string) (*mp4Info, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readMP4Info(f, fi.Size())
+}
+
+// Finds the `trak` box of the first track whose handler is `handler`, e.g. "vide":
+func findMP4Track(r io.ReaderAt, size int64, handler string) (mp4Box, error) {
+	moov, err := findMP4Path(r, size, "moov")
+	if err != nil {
+		return mp4Box{}, err
+	}
+	var b [12]byte
+	for pos := moov.Start; pos < moov.End; {
+		trak, err := findMP4Box(r, pos, moov.End, "trak")
+		if err != nil {
+			return mp4Box{}, err
+		}
+		pos = trak.End
+
+		// version(1) flags(3) pre_defined(4) handler_type(4)
+		hdlr, err := findMP4Within(r, trak, "mdia", "hdlr")
+		if err != nil {
+			continue
+		}
+		if _, err := r.ReadAt(b[:], hdlr.Start); err != nil {
+			return mp4Box{}, err
+		}
+		if string(b[8:12]) == handler {
+			return trak, nil
+		}
+	}
+	return mp4Box{}, errBoxNotFound
+}
+
+// Finds a box nested below `parent` by a path of box types:
+func findMP4Within(r io.ReaderAt, parent mp4Box, types ...string) (box mp4Box, err error) {
+	box = parent
+	for _, typ := range types {
+		if box, err = findMP4Box(r, box.Start, box.End, typ); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Reads the format (codec) of a track's first sample description, e.g. "avc1" or "jpeg":
+func readMP4SampleFormat(r io.ReaderAt, trak mp4Box) (string, error) {
+	stsd, err := findMP4Within(r, trak, "mdia", "minf", "stbl", "stsd")
+	if err != nil {
+		return "", err
+	}
+	// version(1) flags(3) entry_count(4), then the first entry: size(4) format(4)
+	var b [16]byte
+	if _, err := r.ReadAt(b[:], stsd.Start); err != nil {
+		return "", err
+	}
+	if binary.BigEndian.Uint32(b[4:8]) == 0 {
+		return "", errBoxNotFound
+	}
+	return string(b[12:16]), nil
+}
+
+// Locates a track's first sample in the file of `fileSize` bytes:
+func readMP4FirstSample(r io.ReaderAt, fileSize int64, trak mp4Box) (offset, size int64, err error) {
+	stbl, err := findMP4Within(r, trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var b [20]byte
+	// stco: version(1) flags(3) entry_count(4) offsets(4 each); co64 has 8-byte offsets:
+	if stco, err := findMP4Box(r, stbl.Start, stbl.End, "stco"); err == nil {
+		if _, err := r.ReadAt(b[:12], stco.Start); err != nil {
+			return 0, 0, err
+		}
+		if binary.BigEndian.Uint32(b[4:8]) == 0 {
+			return 0, 0, errors.New("mp4: track has no chunks")
+		}
+		offset = int64(binary.BigEndian.Uint32(b[8:12]))
+	} else if co64, err := findMP4Box(r, stbl.Start, stbl.End, "co64"); err == nil {
+		if _, err := r.ReadAt(b[:16], co64.Start); err != nil {
+			return 0, 0, err
+		}
+		if binary.BigEndian.Uint32(b[4:8]) == 0 {
+			return 0, 0, errors.New("mp4: track has no chunks")
+		}
+		offset = int64(binary.BigEndian.Uint64(b[8:16]))
+	} else {
+		return 0, 0, err
+	}
+
+	// stsz: version(1) flags(3) sample_size(4) sample_count(4) sizes(4 each) when sample_size is 0:
+	stsz, err := findMP4Box(r, stbl.Start, stbl.End, "stsz")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := r.ReadAt(b[:12], stsz.Start); err != nil {
+		return 0, 0, err
+	}
+	size = int64(binary.BigEndian.Uint32(b[4:8]))
+	if size == 0 {
+		// The sizes table only exists when samples differ in size:
+		if binary.BigEndian.Uint32(b[8:12]) == 0 {
+			return 0, 0, errors.New("mp4: track has no samples")
+		}
+		if _, err := r.ReadAt(b[12:16], stsz.Start+12); err != nil {
+			return 0, 0, err
+		}
+		size = int64(binary.BigEndian.Uint32(b[12:16]))
+	}
+	// A 64-bit offset may be negative as an int64:
+	if offset < 0 || offset > fileSize || size > fileSize-offset {
+		return 0, 0, errors.New("mp4: first sample lies outside the file")
+	}
+	return offset, size, nil
+}
+
+// Returns the cover art stored in iTunes-style `covr` metadata as found in the file:
+func readMP4Cover(r io.ReaderAt, size int64) (offset, length int64, err error) {
+	meta, err := findMP4Path(r, size, "moov", "udta", "meta")
+	if err != nil {
+		return 0, 0, err
+	}
+	// `meta` is a full box; skip its version and flags:
+	meta.Start += 4
+	data, err := findMP4Within(r, meta, "ilst", "covr", "data")
+	if err != nil {
+		return 0, 0, err
+	}
+	// type(4) locale(4) then the image itself:
+	if data.End-data.Start <= 8 {
+		return 0, 0, errBoxNotFound
+	}
+	return data.Start + 8, data.End - data.Start - 8, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// An MP4 box with a 32-bit size:
+func testBox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+func be32(vs ...uint32) []byte {
+	b := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+func testMvhd(timescale, duration uint32) []byte {
+	return testBox("mvhd", be32(0, 0, 0, timescale, duration), make([]byte, 80))
+}
+
+// A version 0 track header with the given matrix a, b, c, d and size, all whole numbers:
+func testTkhd(a, b, c, d int32, width, height uint32) []byte {
+	payload := be32(0, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	payload = append(payload, be32(uint32(a<<16), uint32(b<<16), 0, uint32(c<<16), uint32(d<<16), 0, 0, 0, 1<<30)...)
+	return testBox("tkhd", payload, be32(width<<16, height<<16))
+}
+
+func testTrak(handler, format string, tkhd []byte, stbl ...[]byte) []byte {
+	stsd := testBox("stsd", be32(0, 1), testBox(format, make([]byte, 8)))
+	return testBox("trak", tkhd,
+		testBox("mdia",
+			testBox("hdlr", be32(0, 0), []byte(handler), make([]byte, 12)),
+			testBox("minf", testBox("stbl", append([][]byte{stsd}, stbl...)...))))
+}
+
+func TestReadMP4Info(t *testing.T) {
+	audio := testTrak("soun", "mp4a", nil)
+	tests := []struct {
+		name string
+		moov []byte
+		want mp4Info
+	}{
+		{"landscape", testBox("moov", testMvhd(600, 3000), testTrak("vide", "avc1", testTkhd(1, 0, 0, 1, 1920, 1080)), audio),
+			mp4Info{Duration: 5 * time.Second, Width: 1920, Height: 1080, VideoCodec: "avc1", AudioCodec: "mp4a"}},
+		{"rotated 90", testBox("moov", testMvhd(1000, 1500), audio, testTrak("vide", "hvc1", testTkhd(0, 1, -1, 0, 1920, 1080))),
+			mp4Info{Duration: 1500 * time.Millisecond, Width: 1080, Height: 1920, Rotation: 90, VideoCodec: "hvc1", AudioCodec: "mp4a"}},
+		{"rotated 180", testBox("moov", testMvhd(1, 1), testTrak("vide", "avc1", testTkhd(-1, 0, 0, -1, 640, 480))),
+			mp4Info{Duration: time.Second, Width: 640, Height: 480, Rotation: 180, VideoCodec: "avc1"}},
+		{"rotated 270", testBox("moov", testMvhd(1, 1), testTrak("vide", "avc1", testTkhd(0, -1, 1, 0, 640, 480))),
+			mp4Info{Duration: time.Second, Width: 480, Height: 640, Rotation: 270, VideoCodec: "avc1"}},
+		{"audio only", testBox("moov", testMvhd(44100, 44100), audio),
+			mp4Info{Duration: time.Second, AudioCodec: "mp4a"}},
+		{"no track header", testBox("moov", testMvhd(1, 2), testTrak("vide", "mp4v", nil)),
+			mp4Info{Duration: 2 * time.Second, VideoCodec: "mp4v"}},
+	}
+	for _, tt := range tests {
+		file := append(testBox("ftyp", []byte("isom")), tt.moov...)
+		info, err := readMP4Info(bytes.NewReader(file), int64(len(file)))
+		if err != nil || *info != tt.want {
+			t.Errorf("%s: %+v %v, want %+v", tt.name, info, err, tt.want)
+		}
+	}
+}
+
+func TestReadMP4Duration(t *testing.T) {
+	v1 := testBox("moov", testBox("mvhd", be32(1<<24, 0, 0, 0, 0, 90000, 0, 90000*3), make([]byte, 80)))
+	d, err := readMP4Duration(bytes.NewReader(v1), int64(len(v1)))
+	if err != nil || d != 3*time.Second {
+		t.Errorf("version 1: %v %v", d, err)
+	}
+
+	// A 64-bit size field, and a last box running to the end of the file:
+	large := append(be32(1), "moov"...)
+	large = append(large, 0, 0, 0, 0, 0, 0, 0, 16+uint8(len(testMvhd(1, 4))))
+	large = append(large, testMvhd(1, 4)...)
+	toEnd := append(be32(0), "moov"...)
+	toEnd = append(toEnd, testMvhd(1, 7)...)
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want time.Duration
+	}{
+		{"64-bit size", large, 4 * time.Second},
+		{"to the end", toEnd, 7 * time.Second},
+	} {
+		if d, err := readMP4Duration(bytes.NewReader(tt.b), int64(len(tt.b))); err != nil || d != tt.want {
+			t.Errorf("%s: %v %v", tt.name, d, err)
+		}
+	}
+}
+
+func TestReadMP4Malformed(t *testing.T) {
+	valid := testBox("moov", testMvhd(600, 3000), testTrak("vide", "avc1", testTkhd(1, 0, 0, 1, 16, 16)))
+	hugeLarge := append(be32(1), "moov"...)
+	hugeLarge = append(hugeLarge, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	hugeLarge = append(hugeLarge, testMvhd(1, 1)...)
+	negativeLarge := append(be32(1), "moov"...)
+	negativeLarge = append(negativeLarge, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"no moov", testBox("ftyp", []byte("isom"))},
+		{"no mvhd", testBox("moov", testBox("trak"))},
+		{"zero timescale", testBox("moov", testMvhd(0, 1))},
+		{"size below header", append(be32(4), "moov"...)},
+		{"size past the end", append(be32(1000), "moov"...)},
+		{"huge 64-bit size", hugeLarge},
+		{"negative 64-bit size", negativeLarge},
+		{"truncated 64-bit size", append(be32(1), "moov\x00\x00"...)},
+		{"truncated mvhd", testBox("moov", testBox("mvhd", be32(0, 0)))},
+	} {
+		if info, err := readMP4Info(bytes.NewReader(tt.b), int64(len(tt.b))); err == nil {
+			t.Errorf("%s: read %+v", tt.name, info)
+		}
+	}
+
+	// No truncation of a valid file panics or loops:
+	for n := range valid {
+		readMP4Info(bytes.NewReader(valid[:n]), int64(n))
+	}
+}
+
+func TestReadMP4FirstSample(t *testing.T) {
+	tests := []struct {
+		name     string
+		stbl     [][]byte
+		fileSize int64
+		offset   int64
+		size     int64
+		ok       bool
+	}{
+		{"stco", [][]byte{testBox("stco", be32(0, 1, 1234)), testBox("stsz", be32(0, 0, 2, 99, 100))}, 1 << 20, 1234, 99, true},
+		{"co64", [][]byte{testBox("co64", be32(0, 1, 1, 5)), testBox("stsz", be32(0, 0, 1, 7))}, 1 << 40, 1<<32 + 5, 7, true},
+		{"fixed size", [][]byte{testBox("stco", be32(0, 1, 10)), testBox("stsz", be32(0, 42, 3))}, 1 << 20, 10, 42, true},
+		{"up to the end", [][]byte{testBox("stco", be32(0, 1, 1000)), testBox("stsz", be32(0, 42, 3))}, 1042, 1000, 42, true},
+		{"no samples", [][]byte{testBox("stco", be32(0, 0, 0)), testBox("stsz", be32(0, 0, 0, 0))}, 1 << 20, 0, 0, false},
+		{"no chunks", [][]byte{testBox("stco", be32(0, 0, 10)), testBox("stsz", be32(0, 42, 3))}, 1 << 20, 0, 0, false},
+		{"no 64-bit chunks", [][]byte{testBox("co64", be32(0, 0, 0, 10)), testBox("stsz", be32(0, 42, 3))}, 1 << 20, 0, 0, false},
+		{"no chunk offsets", [][]byte{testBox("stsz", be32(0, 42, 3))}, 1 << 20, 0, 0, false},
+		{"no sizes", [][]byte{testBox("stco", be32(0, 1, 10))}, 1 << 20, 0, 0, false},
+		{"truncated sizes", [][]byte{testBox("stco", be32(0, 1, 10)), testBox("stsz", be32(0))}, 1 << 20, 0, 0, false},
+		{"past the end", [][]byte{testBox("stco", be32(0, 1, 1000)), testBox("stsz", be32(0, 42, 3))}, 1041, 0, 0, false},
+		{"offset past the end", [][]byte{testBox("stco", be32(0, 1, 2000)), testBox("stsz", be32(0, 0, 1, 0))}, 1041, 0, 0, false},
+		{"negative offset", [][]byte{testBox("co64", be32(0, 1, 1<<31, 0)), testBox("stsz", be32(0, 42, 3))}, 1 << 20, 0, 0, false},
+	}
+	for _, tt := range tests {
+		file := testBox("moov", testTrak("vide", "jpeg", nil, tt.stbl...))
+		trak, err := findMP4Track(bytes.NewReader(file), int64(len(file)), "vide")
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, size, err := readMP4FirstSample(bytes.NewReader(file), tt.fileSize, trak)
+		if (err == nil) != tt.ok || offset != tt.offset || size != tt.size {
+			t.Errorf("%s: %d %d %v", tt.name, offset, size, err)
+		}
+	}
+}
+
+func TestReadMP4Cover(t *testing.T) {
+	cover := func(data []byte) []byte {
+		return testBox("moov", testMvhd(1, 1),
+			testBox("udta", testBox("meta", be32(0), testBox("hdlr", make([]byte, 24)),
+				testBox("ilst", testBox("covr", testBox("data", be32(13, 0), data))))))
+	}
+	file := cover([]byte("\xFF\xD8jpeg"))
+	offset, length, err := readMP4Cover(bytes.NewReader(file), int64(len(file)))
+	if err != nil || string(file[offset:offset+length]) != "\xFF\xD8jpeg" {
+		t.Errorf("got %d %d %v", offset, length, err)
+	}
+
+	file = cover(nil)
+	if _, _, err := readMP4Cover(bytes.NewReader(file), int64(len(file))); err == nil {
+		t.Error("empty cover found")
+	}
+	file = testBox("moov", testMvhd(1, 1))
+	if _, _, err := readMP4Cover(bytes.NewReader(file), int64(len(file))); err == nil {
+		t.Error("missing cover found")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scanning /proc is not cheap; reuse the result for a little while:
+const openFilesTTL = 2 * time.Second
+
+var openFiles struct {
+	lock    sync.Mutex
+	scanned time.Time
+	paths   map[string]bool
+}
+
+// Returns the set of paths under `picsDir` that some other process has open for writing:
+func openForWriting() map[string]bool {
+	openFiles.lock.Lock()
+	defer openFiles.lock.Unlock()
+	if time.Since(openFiles.scanned) < openFilesTTL {
+		return openFiles.paths
+	}
+
+	paths := make(map[string]bool)
+	self := strconv.Itoa(os.Getpid())
+	procs, _ := ioutil.ReadDir("/proc")
+	for _, proc := range procs {
+		pid := proc.Name()
+		if pid == self || pid[0] < '0' || pid[0] > '9' {
+			continue
+		}
+
+		// Processes owned by other users are unreadable unless we are root; skip them quietly:
+		fdDir := path.Join("/proc", pid, "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(path.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(target, picsDir+"/") {
+				continue
+			}
+			if fdWritable(path.Join("/proc", pid, "fdinfo", fd.Name())) {
+				paths[target] = true
+			}
+		}
+	}
+
+	openFiles.paths = paths
+	openFiles.scanned = time.Now()
+	return paths
+}
+
+// Reads the open flags from /proc/<pid>/fdinfo/<fd> and checks for O_WRONLY or O_RDWR:
+func fdWritable(fdinfo string) bool {
+	b, err := ioutil.ReadFile(fdinfo)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(line[len("flags:"):]), 8, 64)
+		if err != nil {
+			return false
+		}
+		return flags&(uint64(os.O_WRONLY)|uint64(os.O_RDWR)) != 0
+	}
+	return false
+}
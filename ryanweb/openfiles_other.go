@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Open-file detection relies on /proc; elsewhere only the name and stability checks apply.
+func openForWriting() map[string]bool {
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/JamesDunne/go-ryan/resize"
+)
+
+// Default maximum pHash Hamming distance for two pictures to be considered near-duplicates:
+const defaultSimilarDistance = 10
+
+// Downsamples the image to a `w` by `h` grid of luminance values:
+func grayGrid(img image.Image, w, h int) []float64 {
+	small := resize.Resize(img, img.Bounds(), w, h)
+
+	grid := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := small.At(x, y).RGBA()
+			grid[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+	return grid
+}
+
+// Difference hash; each bit records whether a pixel is brighter than its right-hand neighbor in a 9x8 grid:
+func dHash(img image.Image) uint64 {
+	grid := grayGrid(img, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grid[y*9+x] > grid[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// DCT hash; each bit records whether a low-frequency coefficient of a 32x32 grid is above the median:
+func pHash(img image.Image) uint64 {
+	const n = 32
+	grid := grayGrid(img, n, n)
+
+	// Precompute the DCT-II basis:
+	var basis [8][n]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < n; x++ {
+			basis[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+
+	// Only the top-left 8x8 coefficients are needed; transform rows then columns:
+	var rows [n][8]float64
+	for y := 0; y < n; y++ {
+		for u := 0; u < 8; u++ {
+			s := 0.0
+			for x := 0; x < n; x++ {
+				s += grid[y*n+x] * basis[u][x]
+			}
+			rows[y][u] = s
+		}
+	}
+	coeffs := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			s := 0.0
+			for y := 0; y < n; y++ {
+				s += rows[y][u] * basis[v][y]
+			}
+			coeffs = append(coeffs, s)
+		}
+	}
+
+	// Compare against the median, excluding the DC term which only carries overall brightness:
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for _, c := range coeffs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// Fills in the perceptual hashes of a decoded image:
+func hashImage(img image.Image, meta *PicMeta) {
+	meta.Hashed = true
+	meta.DHash = dHash(img)
+	meta.PHash = pHash(img)
+}
+
+// Parses the `max` query value as a Hamming distance:
+func getMaxDistance(req *http.Request) (int, error) {
+	s := req.URL.Query().Get("max")
+	if s == "" {
+		return defaultSimilarDistance, nil
+	}
+	max, err := strconv.Atoi(s)
+	if err != nil || max < 0 || max > 64 {
+		return 0, NewHttpError(http.StatusBadRequest, "max must be an integer between 0 and 64", fmt.Errorf("Invalid max value '%s'", s))
+	}
+	return max, nil
+}
+
+type SimilarPic struct {
+	Name      string `json:"name"`
+	Distance  int    `json:"distance"`
+	DDistance int    `json:"dHashDistance"`
+}
+
+// JSON handler for `/similar`:
+func similarJsonHandler(req *http.Request) (interface{}, error) {
+	name, ok := safeRelPath(req.URL.Query().Get("name"))
+	if !ok || name == "" {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting name query value", fmt.Errorf("No name query value"))
+	}
+	if err := requireViewPic(req, name); err != nil {
+		return nil, err
+	}
+	max, err := getMaxDistance(req)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := refreshPicMeta(name)
+	if err != nil {
+		return nil, NewHttpError(http.StatusNotFound, "Picture not found", err)
+	}
+	if !meta.Hashed {
+		return nil, NewHttpError(http.StatusBadRequest, "Picture is not a decodable image", fmt.Errorf("No perceptual hash for '%s'", name))
+	}
+
+	similar := make([]SimilarPic, 0)
+	for other, m := range metaCache.All() {
+		if other == name || !m.Hashed || !canViewAlbum(req, albumOf(other)) {
+			continue
+		}
+		if d := hammingDistance(meta.PHash, m.PHash); d <= max {
+			similar = append(similar, SimilarPic{Name: other, Distance: d, DDistance: hammingDistance(meta.DHash, m.DHash)})
+		}
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].Name < similar[j].Name
+	})
+
+	return struct {
+		Name    string       `json:"name"`
+		PHash   string       `json:"pHash"`
+		DHash   string       `json:"dHash"`
+		Similar []SimilarPic `json:"similar"`
+	}{
+		Name:    name,
+		PHash:   formatHash(meta.PHash),
+		DHash:   formatHash(meta.DHash),
+		Similar: similar,
+	}, nil
+}
+
+// Groups of near-duplicates computed by `/duplicates`, kept until the metadata cache changes. Entries are keyed by
+// distance and the albums the viewer may see, since pictures they cannot see must not link the ones they can:
+type DuplicateGroups struct {
+	lock       sync.Mutex
+	generation uint64
+	groups     map[string][][]string
+}
+
+var duplicateGroups = &DuplicateGroups{}
+
+// Returns the groups cached under `key` if they were computed at `generation`:
+func (d *DuplicateGroups) Get(generation uint64, key string) ([][]string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.generation != generation {
+		return nil, false
+	}
+	groups, ok := d.groups[key]
+	return groups, ok
+}
+
+// Caches groups computed at `generation`, dropping any computed at another:
+func (d *DuplicateGroups) Put(generation uint64, key string, groups [][]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.generation != generation || d.groups == nil {
+		d.generation = generation
+		d.groups = make(map[string][][]string)
+	}
+	d.groups[key] = groups
+}
+
+// JSON handler for `/duplicates`; groups pictures transitively connected by near-duplicate pairs:
+func duplicatesJsonHandler(req *http.Request) (interface{}, error) {
+	max, err := getMaxDistance(req)
+	if err != nil {
+		return nil, err
+	}
+
+	all, generation := metaCache.Snapshot()
+	names := make([]string, 0, len(all))
+	visible := make(map[string]bool)
+	for name, m := range all {
+		if !m.Hashed {
+			continue
+		}
+		album := albumOf(name)
+		v, ok := visible[album]
+		if !ok {
+			v = canViewAlbum(req, album)
+			visible[album] = v
+		}
+		if v {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	albums := make([]string, 0, len(visible))
+	for album, v := range visible {
+		if v {
+			albums = append(albums, album)
+		}
+	}
+	sort.Strings(albums)
+	key := strconv.Itoa(max) + "\x00" + strings.Join(albums, "\x00")
+
+	groups, ok := duplicateGroups.Get(generation, key)
+	if !ok {
+		groups = clusterDuplicates(names, all, max)
+		duplicateGroups.Put(generation, key, groups)
+	}
+
+	return struct {
+		MaxDistance int        `json:"maxDistance"`
+		Groups      [][]string `json:"groups"`
+	}{
+		MaxDistance: max,
+		Groups:      groups,
+	}, nil
+}
+
+// Groups the sorted `names` into sets of two or more linked by pHash distances of at most `max`:
+func clusterDuplicates(names []string, all map[string]PicMeta, max int) [][]string {
+	// Union-find over picture indexes:
+	parent := make([]int, len(names))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			if hammingDistance(all[names[i]].PHash, all[names[j]].PHash) <= max {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]string)
+	for i, name := range names {
+		r := find(i)
+		byRoot[r] = append(byRoot[r], name)
+	}
+	groups := make([][]string, 0)
+	for i := range names {
+		if g := byRoot[i]; len(g) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Requests `/duplicates` as `user`, or anonymously if empty:
+func testDuplicates(t *testing.T, user, query string) [][]string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/duplicates"+query, nil)
+	if user != "" {
+		req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sessions.Create(user)))
+	}
+	v, err := duplicatesJsonHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v.(struct {
+		MaxDistance int        `json:"maxDistance"`
+		Groups      [][]string `json:"groups"`
+	}).Groups
+}
+
+func putTestHash(name string, pHash uint64) {
+	metaCache.Put(name, PicMeta{Version: picMetaVersion, Hashed: true, PHash: pHash})
+}
+
+func TestDuplicatesGroups(t *testing.T) {
+	setupTestStores(t)
+	// a-b and b-c are within distance 1, so all three group together; d and e are far from them:
+	putTestHash("a.jpg", 0x0)
+	putTestHash("b.jpg", 0x1)
+	putTestHash("c.jpg", 0x3)
+	putTestHash("d.jpg", 0xff00)
+	putTestHash("e.jpg", 0xff01)
+	putTestHash("f.jpg", 0xf0f0f0)
+	metaCache.Put("g.txt", PicMeta{Version: picMetaVersion})
+
+	want := [][]string{{"a.jpg", "b.jpg", "c.jpg"}, {"d.jpg", "e.jpg"}}
+	if got := testDuplicates(t, "", "?max=1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("max 1: got %v, want %v", got, want)
+	}
+	if got := testDuplicates(t, "", "?max=0"); len(got) != 0 {
+		t.Errorf("max 0: got %v", got)
+	}
+
+	// Cached groups must not outlive a change to the hashes:
+	putTestHash("f.jpg", 0x2)
+	want = [][]string{{"a.jpg", "b.jpg", "c.jpg", "f.jpg"}, {"d.jpg", "e.jpg"}}
+	if got := testDuplicates(t, "", "?max=1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after change: got %v, want %v", got, want)
+	}
+	metaCache.Remove("b.jpg")
+	want = [][]string{{"a.jpg", "c.jpg", "f.jpg"}, {"d.jpg", "e.jpg"}}
+	if got := testDuplicates(t, "", "?max=1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after removal: got %v, want %v", got, want)
+	}
+}
+
+func TestDuplicatesHidesRestrictedAlbums(t *testing.T) {
+	setupTestStores(t)
+	setupTestAccounts(t, `{"users":[
+		{"name":"ryan","passwordHash":"`+testPasswordHash+`","role":"admin"},
+		{"name":"bob","passwordHash":"`+testPasswordHash+`","role":"contributor"}],
+		"albums":{"family":{"viewers":["ryan"]}}}`)
+	// Only the restricted picture links the two public ones:
+	putTestHash("a.jpg", 0x0)
+	putTestHash("family/b.jpg", 0x1)
+	putTestHash("c.jpg", 0x3)
+
+	want := [][]string{{"a.jpg", "c.jpg", "family/b.jpg"}}
+	if got := testDuplicates(t, "ryan", "?max=1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("admin: got %v, want %v", got, want)
+	}
+	// The groups cached for the admin must not be served to bob:
+	if got := testDuplicates(t, "bob", "?max=1"); len(got) != 0 {
+		t.Errorf("bob: got %v", got)
+	}
+}
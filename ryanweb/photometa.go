@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Photographic metadata: EXIF, IPTC captions and XMP ratings from JPEG and TIFF files.
+
+// A WGS 84 location in decimal degrees; altitude in metres above sea level:
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	Alt float64 `json:"alt,omitempty"`
+}
+
+// TIFF tags embedding IPTC and XMP in TIFF files:
+const (
+	tagIPTC = 0x83BB
+	tagXMP  = 0x02BC
+)
+
+// Photoshop image resource holding IPTC-NAA records:
+const photoshopIPTCResource = 0x0404
+
+// Reports whether the file is of a format we read photographic metadata from:
+func hasPhotoMeta(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".jpe", ".tif", ".tiff":
+		return true
+	default:
+		return false
+	}
+}
+
+func isTIFFName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".tif" || ext == ".tiff"
+}
+
+// Reads EXIF, IPTC and XMP metadata from a JPEG or TIFF file into `meta`:
+func readPhotoMeta(filePath string, meta *PicMeta) error {
+	var exif, xmp, iptc []byte
+	if isTIFFName(filePath) {
+		// TIFF directories may sit anywhere in the file:
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		exif = b
+	} else {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		jm, err := readJPEGMeta(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		exif, xmp = jm.Exif, jm.XMP
+		iptc = photoshopResource(jm.Photoshop, photoshopIPTCResource)
+	}
+
+	if exif != nil {
+		if dirs, err := parseTIFF(exif); err == nil {
+			applyExif(dirs, meta)
+			if isTIFFName(filePath) {
+				xmp, iptc = dirs.IFD0[tagXMP].Data, dirs.IFD0[tagIPTC].Data
+			}
+		}
+	}
+	if iptc != nil {
+		meta.Caption = iptcCaption(iptc)
+	}
+	if xmp != nil {
+		meta.Rating = xmpRating(xmp)
+	}
+	return nil
+}
+
+func applyExif(dirs *exifDirs, meta *PicMeta) {
+	meta.Taken, _ = dirs.Taken()
+	meta.Camera = dirs.Camera()
+	meta.Lens = dirs.Lens()
+	meta.ExposureTime = dirs.ExposureTime()
+	meta.FNumber = dirs.FNumber()
+	meta.ISO = dirs.ISO()
+	meta.FocalLength = dirs.FocalLength()
+	meta.GPS, _ = dirs.Location()
+}
+
+// Finds a resource by ID among Photoshop image resource blocks; nil if absent:
+func photoshopResource(b []byte, id uint16) []byte {
+	for len(b) >= 12 && string(b[:4]) == "8BIM" {
+		rid := binary.BigEndian.Uint16(b[4:6])
+
+		// Pascal string name, padded to an even length including its length byte:
+		nameLen := int(b[6]) + 1
+		if nameLen%2 != 0 {
+			nameLen++
+		}
+		pos := 6 + nameLen
+		if pos+4 > len(b) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(b[pos:]))
+		pos += 4
+		if size < 0 || pos+size > len(b) {
+			return nil
+		}
+		if rid == id {
+			return b[pos : pos+size]
+		}
+
+		// Data is padded to an even length:
+		if size%2 != 0 {
+			size++
+		}
+		if pos+size > len(b) {
+			return nil
+		}
+		b = b[pos+size:]
+	}
+	return nil
+}
+
+var errBadIPTC = errors.New("iptc: malformed record")
+
+// Returns the value of IPTC dataset `record:dataset`:
+func iptcDataset(b []byte, record, dataset byte) ([]byte, error) {
+	for len(b) >= 5 {
+		if b[0] != 0x1C {
+			return nil, errBadIPTC
+		}
+		size := int(binary.BigEndian.Uint16(b[3:5]))
+		pos := 5
+		if size&0x8000 != 0 {
+			// Extended dataset; the low bits give the length of the real length field:
+			n := size & 0x7FFF
+			if n > 4 || pos+n > len(b) {
+				return nil, errBadIPTC
+			}
+			size = 0
+			for _, c := range b[pos : pos+n] {
+				size = size<<8 | int(c)
+			}
+			pos += n
+		}
+		if pos+size > len(b) {
+			return nil, errBadIPTC
+		}
+		if b[1] == record && b[2] == dataset {
+			return b[pos : pos+size], nil
+		}
+		b = b[pos+size:]
+	}
+	return nil, nil
+}
+
+// IPTC Caption/Abstract (2:120), which is what most tools write a photo's description to:
+func iptcCaption(b []byte) string {
+	v, err := iptcDataset(b, 2, 120)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(v))
+}
+
+// Matches both the attribute and element forms of xmp:Rating:
+var xmpRatingPattern = regexp.MustCompile(`xmp:Rating\s*(?:=\s*["']|>)\s*(-?\d+)`)
+
+// XMP star rating from 1 to 5 (-1 means rejected); 0 if unrated:
+func xmpRating(b []byte) int {
+	m := xmpRatingPattern.FindSubmatch(b)
+	if m == nil {
+		return 0
+	}
+	r, err := strconv.Atoi(string(m[1]))
+	if err != nil || r < -1 || r > 5 {
+		return 0
+	}
+	return r
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+// A Photoshop image resource block:
+func testResource(id uint16, name string, data []byte) []byte {
+	b := []byte("8BIM\x00\x00")
+	binary.BigEndian.PutUint16(b[4:], id)
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	if len(name)%2 == 0 {
+		b = append(b, 0)
+	}
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// An IPTC dataset, using an extended length if asked to:
+func testDataset(record, dataset byte, value string, extended bool) []byte {
+	b := []byte{0x1C, record, dataset, 0, 0}
+	if extended {
+		binary.BigEndian.PutUint16(b[3:], 0x8004)
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[5:], uint32(len(value)))
+	} else {
+		binary.BigEndian.PutUint16(b[3:], uint16(len(value)))
+	}
+	return append(b, value...)
+}
+
+func TestPhotoshopResource(t *testing.T) {
+	blocks := bytes.Join([][]byte{
+		testResource(0x03ED, "", []byte{1, 2, 3}),
+		testResource(0x0400, "odd", []byte("x")),
+		testResource(photoshopIPTCResource, "", []byte("iptc")),
+	}, nil)
+	tests := []struct {
+		name string
+		b    []byte
+		id   uint16
+		want []byte
+	}{
+		{"found", blocks, photoshopIPTCResource, []byte("iptc")},
+		{"after a named block", blocks, 0x0400, []byte("x")},
+		{"missing", blocks, 0x0422, nil},
+		{"empty", nil, photoshopIPTCResource, nil},
+		{"not a resource", []byte("8BIX\x04\x04\x00\x00\x00\x00\x00\x00"), photoshopIPTCResource, nil},
+		{"truncated data", blocks[:len(blocks)-1], photoshopIPTCResource, nil},
+		{"truncated name", blocks[:8], photoshopIPTCResource, nil},
+		{"huge size", append(blocks[:10:10], 0xFF, 0xFF, 0xFF, 0xFF, 0), 0x03ED, nil},
+	}
+	for _, tt := range tests {
+		if got := photoshopResource(tt.b, tt.id); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIPTCCaption(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"caption", bytes.Join([][]byte{testDataset(1, 90, "\x1b%G", false), testDataset(2, 5, "Title", false), testDataset(2, 120, " At the beach \n", false)}, nil), "At the beach"},
+		{"extended length", append(testDataset(2, 25, "tag", true), testDataset(2, 120, "Long", true)...), "Long"},
+		{"missing", testDataset(2, 5, "Title", false), ""},
+		{"empty", nil, ""},
+		{"bad marker", append(testDataset(2, 5, "Title", false), 0x1D, 2, 120, 0, 1, 'x'), ""},
+		{"truncated", testDataset(2, 120, "Caption", false)[:8], ""},
+		{"extended length too long", []byte{0x1C, 2, 120, 0x80, 0x05, 0, 0, 0, 0, 1, 'x'}, ""},
+		{"extended length truncated", []byte{0x1C, 2, 120, 0x80, 0x04, 0, 0}, ""},
+		{"huge extended length", []byte{0x1C, 2, 120, 0x80, 0x04, 0xFF, 0xFF, 0xFF, 0xFF, 'x'}, ""},
+	}
+	for _, tt := range tests {
+		if got := iptcCaption(tt.b); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestXMPRating(t *testing.T) {
+	tests := []struct {
+		xmp  string
+		want int
+	}{
+		{`<rdf:Description xmp:Rating="4"/>`, 4},
+		{`<rdf:Description xmp:Rating = '5'/>`, 5},
+		{`<xmp:Rating>3</xmp:Rating>`, 3},
+		{`<rdf:Description xmp:Rating="-1"/>`, -1},
+		{`<rdf:Description xmp:Rating="7"/>`, 0},
+		{`<rdf:Description xmp:Rating="-2"/>`, 0},
+		{`<rdf:Description xmp:Rating="99999999999999999999"/>`, 0},
+		{`<rdf:Description xmp:Rating="x"/>`, 0},
+		{`<rdf:Description MicrosoftPhoto:Rating="80"/>`, 0},
+		{``, 0},
+	}
+	for _, tt := range tests {
+		if got := xmpRating([]byte(tt.xmp)); got != tt.want {
+			t.Errorf("xmpRating(%q) = %d, want %d", tt.xmp, got, tt.want)
+		}
+	}
+}
+
+func TestReadPhotoMeta(t *testing.T) {
+	dir := t.TempDir()
+	caption := testDataset(2, 120, "Sunset", false)
+	jpeg := bytes.Join([][]byte{
+		{0xFF, 0xD8},
+		jpegSegment(0xE1, jpegExifPrefix, testPhotoTIFF(binary.LittleEndian)),
+		jpegSegment(0xE1, jpegXMPPrefix, []byte(`<x xmp:Rating="2"/>`)),
+		jpegSegment(0xED, jpegPhotoshopPrefix, testResource(photoshopIPTCResource, "", caption)),
+		jpegSegment(0xDA),
+	}, nil)
+	tiff := testTIFF(binary.BigEndian, []testTag{
+		asciiTag(tagModel, "Scanner"),
+		{tagXMP, tiffByte, uint32(len(`<x xmp:Rating="5"/>`)), []byte(`<x xmp:Rating="5"/>`)},
+		{tagIPTC, tiffUndefined, uint32(len(caption)), caption},
+	}, nil, nil)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		camera  string
+		caption string
+		rating  int
+		ok      bool
+	}{
+		{"a.jpg", jpeg, "Google Pixel 7", "Sunset", 2, true},
+		{"b.TIFF", tiff, "Scanner", "Sunset", 5, true},
+		{"c.jpg", []byte("not a jpeg"), "", "", 0, false},
+		// Files without usable EXIF still have their other metadata read:
+		{"d.jpg", bytes.Replace(jpeg, []byte("II*\x00"), []byte("XX*\x00"), 1), "", "Sunset", 2, true},
+		{"e.tif", []byte("not a tiff"), "", "", 0, true},
+	}
+	for _, tt := range tests {
+		p := path.Join(dir, tt.name)
+		if err := ioutil.WriteFile(p, tt.data, 0664); err != nil {
+			t.Fatal(err)
+		}
+		var meta PicMeta
+		err := readPhotoMeta(p, &meta)
+		if (err == nil) != tt.ok || meta.Camera != tt.camera || meta.Caption != tt.caption || meta.Rating != tt.rating {
+			t.Errorf("%s: %q %q %d %v", tt.name, meta.Camera, meta.Caption, meta.Rating, err)
+		}
+	}
+}
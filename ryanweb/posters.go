@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Poster frames for videos, from which `/thumbs/` renders video thumbnails.
+
+// Produces a representative still frame for a video:
+type PosterExtractor interface {
+	// Short name for logging:
+	Name() string
+	Extract(videoPath string) (image.Image, error)
+}
+
+// Tried in order until one produces a frame:
+var posterExtractors []PosterExtractor
+
+// How long ffmpeg may take to produce a frame:
+const ffmpegTimeout = 20 * time.Second
+
+var errNoPoster = errors.New("poster: no frame found")
+
+// Uses ffmpeg at `ffmpegName` if it can be found, falling back to what we can decode ourselves:
+func configurePosterExtractors(ffmpegName string) {
+	posterExtractors = nil
+	if ffmpegName != "" {
+		if x, err := newFFmpegExtractor(ffmpegName); err == nil {
+			posterExtractors = append(posterExtractors, x)
+		} else {
+			log.Printf("ffmpeg not available, only MJPEG videos and cover art get thumbnails; %s\n", err)
+		}
+	}
+	posterExtractors = append(posterExtractors, nativePosterExtractor{})
+}
+
+// Videos no extractor could handle, by path, with the modification time they had; not retried until they change:
+var posterFailures = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+func extractPoster(videoPath string, modTime time.Time) (image.Image, error) {
+	posterFailures.Lock()
+	failed, ok := posterFailures.m[videoPath]
+	posterFailures.Unlock()
+	if ok && failed.Equal(modTime) {
+		return nil, errNoPoster
+	}
+
+	errs := make([]string, 0, len(posterExtractors))
+	for _, x := range posterExtractors {
+		img, err := x.Extract(videoPath)
+		if err == nil {
+			return img, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", x.Name(), err))
+	}
+
+	posterFailures.Lock()
+	posterFailures.m[videoPath] = modTime
+	posterFailures.Unlock()
+	return nil, fmt.Errorf("no poster frame for '%s'; %s", videoPath, strings.Join(errs, "; "))
+}
+
+// Runs ffmpeg to grab a frame, which handles any codec ffmpeg was built with:
+type ffmpegExtractor struct {
+	Path string
+}
+
+func newFFmpegExtractor(name string) (*ffmpegExtractor, error) {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return &ffmpegExtractor{Path: p}, nil
+}
+
+func (x *ffmpegExtractor) Name() string {
+	return "ffmpeg"
+}
+
+func (x *ffmpegExtractor) Extract(videoPath string) (image.Image, error) {
+	// Skip a second in to get past fades from black; clips shorter than that get their first frame:
+	img, err := x.frameAt(videoPath, "1")
+	if err != nil {
+		img, err = x.frameAt(videoPath, "")
+	}
+	return img, err
+}
+
+func (x *ffmpegExtractor) frameAt(videoPath, seek string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+
+	args := []string{"-nostdin", "-v", "error"}
+	if seek != "" {
+		args = append(args, "-ss", seek)
+	}
+	args = append(args, "-i", videoPath, "-frames:v", "1", "-f", "image2pipe", "-vcodec", "mjpeg", "-")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, x.Path, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s; %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errNoPoster
+	}
+	return jpeg.Decode(&stdout)
+}
+
+// Sample formats of Motion JPEG tracks, whose frames are plain JPEGs:
+var mjpegFormats = map[string]bool{
+	"jpeg": true,
+	"mjpa": true,
+	"mjpg": true,
+	"MJPG": true,
+	"AVDJ": true,
+}
+
+// Pure Go fallback: embedded cover art or the first frame of a Motion JPEG track in MP4/MOV files, and
+// the first frame of raw MJPEG streams. Other codecs need ffmpeg.
+type nativePosterExtractor struct{}
+
+func (nativePosterExtractor) Name() string {
+	return "native"
+}
+
+func (nativePosterExtractor) Extract(videoPath string) (image.Image, error) {
+	f, err := os.Open(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(path.Ext(videoPath)) {
+	case ".mjpg", ".mjpeg":
+		// A raw stream is a run of JPEGs; the decoder stops after the first:
+		return jpeg.Decode(f)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	if offset, length, err := readMP4Cover(f, size); err == nil {
+		if img, _, err := image.Decode(io.NewSectionReader(f, offset, length)); err == nil {
+			return img, nil
+		}
+	}
+
+	trak, err := findMP4Track(f, size, "vide")
+	if err != nil {
+		return nil, err
+	}
+	format, err := readMP4SampleFormat(f, trak)
+	if err != nil {
+		return nil, err
+	}
+	if !mjpegFormats[format] {
+		return nil, fmt.Errorf("cannot decode '%s' video frames", format)
+	}
+	offset, length, err := readMP4FirstSample(f, size, trak)
+	if err != nil {
+		return nil, err
+	}
+	return jpeg.Decode(io.NewSectionReader(f, offset, length))
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Privacy filtering of originals served from `/pics/`. Metadata is redacted on the fly as files are served;
+// image data is passed through untouched and the files on disk keep everything. Images and videos of types we
+// cannot redact are not served at all while filtering is on.
+
+type privacyMode int
+
+const (
+	// Serve files as stored:
+	privacyOff privacyMode = iota
+	// Remove GPS coordinates and other location data:
+	privacyLocation
+	// Also remove device details such as camera make, model and serial numbers:
+	privacyAll
+)
+
+var privacy privacyMode
+
+func parsePrivacyMode(s string) (privacyMode, error) {
+	switch strings.ToLower(s) {
+	case "off", "":
+		return privacyOff, nil
+	case "location":
+		return privacyLocation, nil
+	case "all":
+		return privacyAll, nil
+	default:
+		return privacyOff, fmt.Errorf(`unknown privacy mode '%s'; expected "off", "location" or "all"`, s)
+	}
+}
+
+// Hides the same details from metadata shown in pages and JSON as are redacted from served originals:
+func privatePicMeta(meta PicMeta) PicMeta {
+	if privacy >= privacyLocation {
+		meta.GPS = nil
+	}
+	if privacy >= privacyAll {
+		meta.Camera, meta.Lens = "", ""
+	}
+	return meta
+}
+
+// Vendor-specific EXIF tags cleared in every privacy mode; maker notes often repeat locations as well as serial numbers:
+var locationExifTags = map[uint16]bool{
+	0x927C: true, // MakerNote
+}
+
+// Identifying tags cleared in `privacyAll` mode, by directory:
+var (
+	deviceIFD0Tags = map[uint16]bool{
+		tagMake:  true,
+		tagModel: true,
+		0x0131:   true, // Software
+		0x013B:   true, // Artist
+		0x013C:   true, // HostComputer
+		0x8298:   true, // Copyright
+		0xC62F:   true, // CameraSerialNumber
+	}
+	deviceExifTags = map[uint16]bool{
+		tagLensMake:  true,
+		tagLensModel: true,
+		0xA420:       true, // ImageUniqueID
+		0xA430:       true, // CameraOwnerName
+		0xA431:       true, // BodySerialNumber
+		0xA435:       true, // LensSerialNumber
+	}
+)
+
+// Visits the entries of the IFD at `offset`, passing each entry's tag and the byte range holding its value:
+func visitIFD(b []byte, order binary.ByteOrder, offset uint32, visit func(tag uint16, value []byte)) error {
+	if int64(offset)+2 > int64(len(b)) {
+		return errors.New("exif: IFD offset out of range")
+	}
+	n := int(order.Uint16(b[offset:]))
+	pos := int(offset) + 2
+	if pos+12*n > len(b) {
+		return errors.New("exif: IFD truncated")
+	}
+
+	for i := 0; i < n; i, pos = i+1, pos+12 {
+		tag := order.Uint16(b[pos:])
+		size, ok := tiffTypeSizes[order.Uint16(b[pos+2:])]
+		if !ok {
+			continue
+		}
+		total := int64(size) * int64(order.Uint32(b[pos+4:]))
+		if total <= 4 {
+			visit(tag, b[pos+8:pos+8+int(total)])
+			continue
+		}
+		off := int64(order.Uint32(b[pos+8:]))
+		if off+total > int64(len(b)) {
+			continue
+		}
+		visit(tag, b[off:off+total])
+	}
+	return nil
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Redacts TIFF-structured metadata in place, keeping its length and layout so no offsets change:
+func redactTIFF(b []byte, mode privacyMode) error {
+	if len(b) < 8 {
+		return errNoExif
+	}
+	var order binary.ByteOrder
+	switch string(b[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return errors.New("exif: bad TIFF byte order")
+	}
+
+	var exifOff, gpsOff uint32
+	err := visitIFD(b, order, order.Uint32(b[4:8]), func(tag uint16, value []byte) {
+		switch {
+		case tag == tagExifIFD && len(value) == 4:
+			exifOff = order.Uint32(value)
+		case tag == tagGPSIFD && len(value) == 4:
+			gpsOff = order.Uint32(value)
+		case tag == tagXMP || tag == tagIPTC:
+			// Embedded XMP and IPTC may repeat the location and device details:
+			zeroBytes(value)
+		case mode == privacyAll && deviceIFD0Tags[tag]:
+			zeroBytes(value)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directories we cannot read may still be read by others, so they fail the whole redaction:
+	if exifOff != 0 {
+		err := visitIFD(b, order, exifOff, func(tag uint16, value []byte) {
+			if locationExifTags[tag] || mode == privacyAll && deviceExifTags[tag] {
+				zeroBytes(value)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if gpsOff != 0 {
+		// Wipe every GPS value, then empty the directory itself so readers see no GPS data at all:
+		if err := visitIFD(b, order, gpsOff, func(tag uint16, value []byte) { zeroBytes(value) }); err != nil {
+			return err
+		}
+		end := int(gpsOff) + 2 + 12*int(order.Uint16(b[gpsOff:])) + 4
+		if end > len(b) {
+			end = len(b)
+		}
+		zeroBytes(b[gpsOff:end])
+	}
+	return nil
+}
+
+// Reads the segments of a JPEG up to the start of scan, redacting EXIF and dropping XMP and IPTC segments.
+// Returns the rewritten header and the offset in `r` where the unchanged remainder begins:
+func redactJPEGHeader(r io.Reader, mode privacyMode) ([]byte, int64, error) {
+	var out bytes.Buffer
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return nil, 0, err
+	}
+	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return nil, 0, errors.New("exif: not a JPEG")
+	}
+	out.Write(hdr[:2])
+	read := int64(2)
+
+	for {
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			return nil, 0, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, 0, errors.New("exif: bad JPEG marker")
+		}
+		marker := hdr[1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Image data follows; pass it through from here:
+			return out.Bytes(), read, nil
+		}
+		length := int(binary.BigEndian.Uint16(hdr[2:4])) - 2
+		if length < 0 {
+			return nil, 0, errors.New("exif: bad JPEG segment length")
+		}
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, 0, err
+		}
+		read += 4 + int64(length)
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(seg, jpegExifPrefix):
+			if err := redactTIFF(seg[len(jpegExifPrefix):], mode); err != nil {
+				// Cannot tell what is in it; leave it out:
+				continue
+			}
+		case marker == 0xE1 || marker == 0xED:
+			// XMP, IPTC and anything else in these segments is dropped wholesale:
+			continue
+		}
+		out.Write(hdr[:4])
+		out.Write(seg)
+	}
+}
+
+// A piece of a spliced file: `data` if it is not nil, otherwise `n` zero bytes if `zero` is set, otherwise `n` bytes of
+// the original from `at`:
+type splice struct {
+	data  []byte
+	zero  bool
+	at, n int64
+}
+
+func (p splice) size() int64 {
+	if p.data != nil {
+		return int64(len(p.data))
+	}
+	return p.n
+}
+
+// Appends `n` bytes of the original from `at`, extending the last piece when they follow on from it:
+func appendSplice(pieces []splice, at, n int64) []splice {
+	if n == 0 {
+		return pieces
+	}
+	if last := len(pieces) - 1; last >= 0 && pieces[last].data == nil && !pieces[last].zero && pieces[last].at+pieces[last].n == at {
+		pieces[last].n += n
+		return pieces
+	}
+	return append(pieces, splice{at: at, n: n})
+}
+
+// Reads as its pieces one after another, taking those not held in memory from `rest`:
+type splicedReader struct {
+	pieces []splice
+	rest   io.ReaderAt
+	size   int64
+	pos    int64
+}
+
+func newSplicedReader(rest io.ReaderAt, pieces []splice) *splicedReader {
+	s := &splicedReader{pieces: pieces, rest: rest}
+	for _, p := range pieces {
+		s.size += p.size()
+	}
+	return s
+}
+
+func (s *splicedReader) Read(p []byte) (int, error) {
+	start := int64(0)
+	for _, piece := range s.pieces {
+		size := piece.size()
+		if s.pos >= start+size {
+			start += size
+			continue
+		}
+		off := s.pos - start
+		if max := size - off; int64(len(p)) > max {
+			p = p[:max]
+		}
+		switch {
+		case piece.data != nil:
+			n := copy(p, piece.data[off:])
+			s.pos += int64(n)
+			return n, nil
+		case piece.zero:
+			zeroBytes(p)
+			s.pos += int64(len(p))
+			return len(p), nil
+		}
+		n, err := s.rest.ReadAt(p, piece.at+off)
+		s.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (s *splicedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("splicedReader: bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("splicedReader: negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG chunks that hold EXIF, XMP or free text; none of them change how the image looks:
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true}
+
+// Lists the pieces of a PNG to serve: everything up to its end but the metadata chunks:
+func redactPNG(r io.ReaderAt, size int64) ([]splice, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil || !bytes.Equal(hdr[:], pngSignature) {
+		return nil, errors.New("png: not a PNG")
+	}
+	pieces := appendSplice(nil, 0, 8)
+	for pos := int64(8); pos+12 <= size; {
+		// length(4) type(4) data(length) crc(4)
+		if _, err := r.ReadAt(hdr[:], pos); err != nil {
+			return nil, err
+		}
+		n := 12 + int64(binary.BigEndian.Uint32(hdr[0:4]))
+		if n > size-pos {
+			return nil, errors.New("png: truncated chunk")
+		}
+		typ := string(hdr[4:8])
+		if !pngMetadataChunks[typ] {
+			pieces = appendSplice(pieces, pos, n)
+		}
+		if typ == "IEND" {
+			// Anything trailing the image is left out too:
+			return pieces, nil
+		}
+		pos += n
+	}
+	return nil, errors.New("png: no IEND chunk")
+}
+
+// Application extensions a GIF needs to animate as intended; any other may carry XMP:
+var gifApplications = map[string]bool{"NETSCAPE2.0": true, "ANIMEXTS1.0": true}
+
+// Lists the pieces of a GIF to serve: everything up to its trailer but comments and application extensions other
+// than the looping ones:
+func redactGIF(r io.ReaderAt, size int64) ([]splice, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	pos := int64(0)
+	read := func(b []byte) error {
+		n, err := io.ReadFull(br, b)
+		pos += int64(n)
+		return err
+	}
+	discard := func(n int) error {
+		d, err := br.Discard(n)
+		pos += int64(d)
+		return err
+	}
+	var b [11]byte
+
+	// Header, logical screen descriptor and any global color table:
+	if err := read(b[:]); err != nil || string(b[:3]) != "GIF" {
+		return nil, errors.New("gif: not a GIF")
+	}
+	flags := b[10]
+	if err := read(b[:2]); err != nil {
+		return nil, err
+	}
+	if flags&0x80 != 0 {
+		if err := discard(3 << (flags&0x07 + 1)); err != nil {
+			return nil, err
+		}
+	}
+	pieces := appendSplice(nil, 0, pos)
+
+	for {
+		start := pos
+		if err := read(b[:1]); err != nil {
+			return nil, err
+		}
+		keep := true
+		switch b[0] {
+		case 0x21:
+			if err := read(b[:1]); err != nil {
+				return nil, err
+			}
+			switch b[0] {
+			case 0xFE:
+				keep = false
+			case 0xFF:
+				// The application identifier is the first sub-block:
+				if err := read(b[:1]); err != nil {
+					return nil, err
+				}
+				n := int(b[0])
+				if n != 11 {
+					keep = false
+					if err := discard(n); err != nil {
+						return nil, err
+					}
+				} else {
+					if err := read(b[:11]); err != nil {
+						return nil, err
+					}
+					keep = gifApplications[string(b[:11])]
+				}
+			}
+		case 0x2C:
+			// Image descriptor, then any local color table and the LZW minimum code size ahead of the data sub-blocks:
+			var desc [9]byte
+			if err := read(desc[:]); err != nil {
+				return nil, err
+			}
+			skip := 1
+			if desc[8]&0x80 != 0 {
+				skip += 3 << (desc[8]&0x07 + 1)
+			}
+			if err := discard(skip); err != nil {
+				return nil, err
+			}
+		case 0x3B:
+			// Anything trailing the image is left out:
+			return appendSplice(pieces, start, 1), nil
+		default:
+			return nil, fmt.Errorf("gif: unknown block type 0x%02x", b[0])
+		}
+
+		// The data sub-blocks up to the zero-length terminator:
+		for {
+			if err := read(b[:1]); err != nil {
+				return nil, err
+			}
+			if b[0] == 0 {
+				break
+			}
+			if err := discard(int(b[0])); err != nil {
+				return nil, err
+			}
+		}
+		if keep {
+			pieces = appendSplice(pieces, start, pos-start)
+		}
+	}
+}
+
+// Boxes holding user data such as locations, device details, cover art and XMP:
+var mp4MetadataBoxes = map[string]bool{"udta": true, "meta": true, "uuid": true}
+
+// Lists the pieces of an MP4 or QuickTime movie to serve: the file as stored, with its metadata boxes at the top
+// level, in the movie and in each track blanked and renamed to `free` so players skip them. Nothing moves, so the
+// sample offsets stay valid:
+func redactMP4(r io.ReaderAt, size int64) ([]splice, error) {
+	var hidden []mp4Box
+	var walk func(start, end int64, depth int) error
+	walk = func(start, end int64, depth int) error {
+		var children []mp4Box
+		err := walkMP4Boxes(r, start, end, func(box mp4Box) bool {
+			switch {
+			case mp4MetadataBoxes[box.Type]:
+				hidden = append(hidden, box)
+			case depth == 0 && box.Type == "moov", depth == 1 && box.Type == "trak":
+				children = append(children, box)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, box := range children {
+			if err := walk(box.Start, box.End, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(0, size, 0); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hidden, func(i, j int) bool { return hidden[i].At < hidden[j].At })
+	var pieces []splice
+	pos := int64(0)
+	for _, box := range hidden {
+		// Keep the size, and the 64-bit size if any, which follow and precede the type:
+		pieces = appendSplice(pieces, pos, box.At+4-pos)
+		pieces = append(pieces, splice{data: []byte("free")})
+		pieces = appendSplice(pieces, box.At+8, box.Start-box.At-8)
+		pieces = append(pieces, splice{zero: true, n: box.End - box.Start})
+		pos = box.End
+	}
+	return appendSplice(pieces, pos, size-pos), nil
+}
+
+// Serves an image original with its metadata redacted according to `privacy`; types we cannot redact are refused:
+func servePrivate(rsp http.ResponseWriter, req *http.Request, picPath string) error {
+	f, err := os.Open(picPath)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", err)
+	}
+
+	var pieces []splice
+	switch mimeType := getMimeType(picPath); {
+	case isTIFFName(picPath):
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return NewHttpError(http.StatusInternalServerError, "Could not read file", err)
+		}
+		if err := redactTIFF(b, privacy); err != nil {
+			return NewHttpError(http.StatusInternalServerError, "Could not filter file metadata", fmt.Errorf("Could not redact '%s'; %s", picPath, err))
+		}
+		http.ServeContent(rsp, req, fi.Name(), fi.ModTime(), bytes.NewReader(b))
+		return nil
+	case hasPhotoMeta(picPath):
+		var head []byte
+		var offset int64
+		head, offset, err = redactJPEGHeader(io.NewSectionReader(f, 0, fi.Size()), privacy)
+		pieces = appendSplice([]splice{{data: head}}, offset, fi.Size()-offset)
+	case mimeType == "image/png":
+		pieces, err = redactPNG(f, fi.Size())
+	case mimeType == "image/gif":
+		pieces, err = redactGIF(f, fi.Size())
+	default:
+		return NewHttpError(http.StatusForbidden, "Originals of this type are not served while metadata is filtered", fmt.Errorf("No way to redact '%s'", picPath))
+	}
+	if err != nil {
+		// Never fall back to the unfiltered file:
+		return NewHttpError(http.StatusInternalServerError, "Could not filter file metadata", fmt.Errorf("Could not redact '%s'; %s", picPath, err))
+	}
+	http.ServeContent(rsp, req, fi.Name(), fi.ModTime(), newSplicedReader(f, pieces))
+	return nil
+}
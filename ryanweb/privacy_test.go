@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPrivatePicMeta(t *testing.T) {
+	defer func(p privacyMode) { privacy = p }(privacy)
+
+	meta := PicMeta{Camera: "Pixel 7", Lens: "wide", ISO: 100, Caption: "Pier", GPS: &GeoPoint{Lat: 47.6, Lon: -122.3, Alt: 12}}
+	tests := []struct {
+		mode     privacyMode
+		gps      bool
+		camera   bool
+		lens     bool
+		exposure bool
+		caption  bool
+	}{
+		{privacyOff, true, true, true, true, true},
+		{privacyLocation, false, true, true, true, true},
+		{privacyAll, false, false, false, true, true},
+	}
+	for _, tt := range tests {
+		privacy = tt.mode
+		got := privatePicMeta(meta)
+		if (got.GPS != nil) != tt.gps || (got.Camera != "") != tt.camera || (got.Lens != "") != tt.lens ||
+			(got.ISO != 0) != tt.exposure || (got.Caption != "") != tt.caption {
+			t.Errorf("privatePicMeta in mode %d = %+v", tt.mode, got)
+		}
+	}
+	if meta.GPS == nil || meta.Camera == "" {
+		t.Errorf("privatePicMeta modified its argument")
+	}
+}
+
+// A TIFF with location, device details and embedded XMP:
+func testPrivateTIFF(order binary.ByteOrder) []byte {
+	return testTIFF(order,
+		[]testTag{
+			asciiTag(tagMake, "Google"), asciiTag(tagModel, "Pixel 7"), asciiTag(0xC62F, "SN12345"),
+			{tagXMP, tiffByte, 30, []byte(`<x exif:GPSLatitude="33,51.9S"/>`)[:30]},
+		},
+		[]testTag{asciiTag(tagDateTimeOriginal, "2024:05:17 14:03:22"), shortTag(order, tagISO, 100), asciiTag(0xA431, "BODY-98765"),
+			{0x927C, tiffUndefined, 12, []byte("MAKERNOTE-42")}},
+		[]testTag{asciiTag(tagGPSLatitudeRef, "S"), ratTag(order, tagGPSLatitude, 33, 1, 51, 1, 54, 1),
+			asciiTag(tagGPSLongitudeRef, "E"), ratTag(order, tagGPSLongitude, 151, 1, 12, 1, 36, 1)})
+}
+
+func TestRedactTIFF(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, mode := range []privacyMode{privacyLocation, privacyAll} {
+			b := testPrivateTIFF(order)
+			n := len(b)
+			if err := redactTIFF(b, mode); err != nil || len(b) != n {
+				t.Fatalf("%v mode %d: %v", order, mode, err)
+			}
+			if bytes.Contains(b, []byte("GPSLatitude")) {
+				t.Errorf("%v mode %d: XMP left in", order, mode)
+			}
+			if bytes.Contains(b, []byte("MAKERNOTE")) {
+				t.Errorf("%v mode %d: maker note left in", order, mode)
+			}
+			for _, device := range []string{"SN12345", "BODY-98765"} {
+				if bytes.Contains(b, []byte(device)) != (mode == privacyLocation) {
+					t.Errorf("%v mode %d: %q redacted wrongly", order, mode, device)
+				}
+			}
+
+			dirs, err := parseTIFF(b)
+			if err != nil {
+				t.Fatalf("%v mode %d: redacted TIFF does not parse; %s", order, mode, err)
+			}
+			if p, ok := dirs.Location(); ok || len(dirs.GPS) != 0 {
+				t.Errorf("%v mode %d: location %+v left in", order, mode, p)
+			}
+			if camera := dirs.Camera(); (camera != "") != (mode == privacyLocation) {
+				t.Errorf("%v mode %d: camera %q", order, mode, camera)
+			}
+			if _, ok := dirs.Taken(); !ok || dirs.ISO() != 100 {
+				t.Errorf("%v mode %d: exposure details lost", order, mode)
+			}
+		}
+	}
+}
+
+func TestRedactTIFFMalformed(t *testing.T) {
+	le := binary.LittleEndian
+	pointAt := func(tag uint16, offset uint32) []byte {
+		b := testTIFF(le, []testTag{asciiTag(tagModel, "Pixel 7"), {tag, tiffLong, 1, []byte{0, 0, 0, 0}}}, nil, nil)
+		le.PutUint32(b[8+2+12+8:], offset)
+		return b
+	}
+	// Points into the model's value, whose last bytes read as a count of 55 entries:
+	truncatedGPS := pointAt(tagGPSIFD, 0)
+	le.PutUint32(truncatedGPS[8+2+12+8:], uint32(len(truncatedGPS)-2))
+	tests := []struct {
+		name string
+		b    []byte
+		mode privacyMode
+		ok   bool
+	}{
+		{"empty", nil, privacyLocation, false},
+		{"byte order", []byte("XX*\x00\x08\x00\x00\x00"), privacyLocation, false},
+		{"IFD0 offset", []byte("II*\x00\xFF\x00\x00\x00"), privacyLocation, false},
+		{"GPS offset", pointAt(tagGPSIFD, 1<<20), privacyLocation, false},
+		{"truncated GPS", truncatedGPS, privacyLocation, false},
+		{"EXIF offset", pointAt(tagExifIFD, 1<<20), privacyAll, false},
+		// The maker note is cleared in location mode too, so the directory is needed there as well:
+		{"EXIF offset in location mode", pointAt(tagExifIFD, 1<<20), privacyLocation, false},
+	}
+	for _, tt := range tests {
+		if err := redactTIFF(tt.b, tt.mode); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// No truncation of a TIFF panics:
+	valid := testPrivateTIFF(le)
+	for n := range valid {
+		redactTIFF(append([]byte(nil), valid[:n]...), privacyAll)
+	}
+}
+
+func TestRedactJPEG(t *testing.T) {
+	scan := append(jpegSegment(0xDA, []byte{1, 2, 3}), "scan data\xFF\xD9"...)
+	jpeg := bytes.Join([][]byte{
+		{0xFF, 0xD8},
+		jpegSegment(0xE0, []byte("JFIF\x00\x01\x02")),
+		jpegSegment(0xE1, jpegExifPrefix, testPrivateTIFF(binary.BigEndian)),
+		jpegSegment(0xE1, jpegXMPPrefix, []byte(`<x xmp:Rating="4" exif:GPSLatitude="33,51.9S"/>`)),
+		jpegSegment(0xED, jpegPhotoshopPrefix, []byte("8BIM")),
+		jpegSegment(0xE1, jpegExifPrefix, []byte("MM\x00*\x00\x00\x00\xFF")),
+		scan,
+	}, nil)
+
+	head, offset, err := redactJPEGHeader(bytes.NewReader(jpeg), privacyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(jpeg[offset:], scan) {
+		t.Errorf("image data starts at %d", offset)
+	}
+
+	// Served as the new header followed by the untouched image data:
+	served, err := ioutil.ReadAll(newSplicedReader(bytes.NewReader(jpeg), appendSplice([]splice{{data: head}}, offset, int64(len(jpeg))-offset)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(served, scan) || !bytes.Contains(served, []byte("JFIF")) {
+		t.Errorf("served %q", served)
+	}
+	meta, err := readJPEGMeta(bytes.NewReader(served))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.XMP != nil || meta.Photoshop != nil || bytes.Contains(served, []byte("GPSLatitude")) {
+		t.Errorf("XMP or IPTC left in %q", served)
+	}
+	dirs, err := parseTIFF(meta.Exif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dirs.Location(); ok || dirs.Camera() != "" || dirs.ISO() != 100 {
+		t.Errorf("redacted EXIF %+v", dirs)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("GIF89a"), jpeg[:20], {0xFF, 0xD8, 0xFF, 0xE1, 0, 1}} {
+		if _, _, err := redactJPEGHeader(bytes.NewReader(bad), privacyAll); err == nil {
+			t.Errorf("redacted %q", bad)
+		}
+	}
+}
+
+func TestSplicedReaderSeek(t *testing.T) {
+	r := newSplicedReader(bytes.NewReader([]byte("xxxrest-and-more")), []splice{{data: []byte("head:")}, {at: 3, n: 4}, {zero: true, n: 2}, {at: 12, n: 4}})
+	for _, tt := range []struct {
+		offset int64
+		whence int
+		want   string
+	}{
+		{0, io.SeekStart, "head:rest\x00\x00more"},
+		{3, io.SeekStart, "d:rest\x00\x00more"},
+		{-7, io.SeekEnd, "t\x00\x00more"},
+		{10, io.SeekStart, "\x00more"},
+		{20, io.SeekStart, ""},
+	} {
+		if _, err := r.Seek(tt.offset, tt.whence); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || string(got) != tt.want {
+			t.Errorf("after Seek(%d, %d) read %q %v, want %q", tt.offset, tt.whence, got, err, tt.want)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seeked before the start")
+	}
+}
+
+func TestAppendSplice(t *testing.T) {
+	pieces := appendSplice(nil, 0, 4)
+	pieces = appendSplice(pieces, 4, 2)
+	pieces = appendSplice(pieces, 10, 0)
+	pieces = append(pieces, splice{zero: true, n: 3})
+	pieces = appendSplice(pieces, 9, 1)
+	pieces = appendSplice(pieces, 10, 5)
+	want := []splice{{at: 0, n: 6}, {zero: true, n: 3}, {at: 9, n: 6}}
+	if !reflect.DeepEqual(pieces, want) {
+		t.Errorf("got %+v, want %+v", pieces, want)
+	}
+}
+
+// Reads a redacted file back as it would be served:
+func readSpliced(t *testing.T, b []byte, redact func(io.ReaderAt, int64) ([]splice, error)) []byte {
+	t.Helper()
+	pieces, err := redact(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := ioutil.ReadAll(newSplicedReader(bytes.NewReader(b), pieces))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return served
+}
+
+// A PNG chunk with its CRC:
+func testPNGChunk(typ string, data []byte) []byte {
+	b := be32(uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return append(b, be32(crc32.ChecksumIEEE(b[4:]))...)
+}
+
+func TestRedactPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	// Metadata chunks follow the 25-byte IHDR chunk, and junk trails the image:
+	const ihdrEnd = 8 + 25
+	b := bytes.Join([][]byte{
+		plain[:ihdrEnd],
+		testPNGChunk("eXIf", testPrivateTIFF(binary.BigEndian)),
+		testPNGChunk("iTXt", []byte(`XML:com.adobe.xmp`+"\x00\x00\x00\x00\x00"+`<x exif:GPSLatitude="33,51.9S"/>`)),
+		testPNGChunk("tEXt", []byte("Comment\x00Taken at home")),
+		plain[ihdrEnd:],
+		[]byte("GPSLatitude trailing"),
+	}, nil)
+
+	served := readSpliced(t, b, redactPNG)
+	if !bytes.Equal(served, plain) {
+		t.Errorf("served %q, want %q", served, plain)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("GIF89a"), b[:ihdrEnd+10], plain[:len(plain)-12]} {
+		if _, err := redactPNG(bytes.NewReader(bad), int64(len(bad))); err == nil {
+			t.Errorf("redacted %q", bad)
+		}
+	}
+}
+
+func TestRedactGIF(t *testing.T) {
+	plain := testGIF(t, 2, 4, 4, 4, 4, false)
+	loop := bytes.Index(plain, []byte("\x21\xFF\x0BNETSCAPE2.0"))
+	if loop < 0 {
+		t.Fatal("no looping extension")
+	}
+	b := bytes.Join([][]byte{
+		plain[:loop],
+		{0x21, 0xFE, 13}, []byte("Taken at home"), {0},
+		{0x21, 0xFF, 11}, []byte("XMP DataXMP"), {31}, []byte(`<x exif:GPSLatitude="33,51.9S"/>`)[:31], {0},
+		{0x21, 0xFF, 3}, []byte("odd"), {0},
+		plain[loop:],
+		[]byte("GPSLatitude trailing"),
+	}, nil)
+
+	served := readSpliced(t, b, redactGIF)
+	if !bytes.Equal(served, plain) {
+		t.Errorf("served %q, want %q", served, plain)
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(served)); err != nil || len(g.Image) != 2 {
+		t.Errorf("redacted GIF does not decode; %v", err)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("\x89PNG"), plain[:len(plain)-1], append(plain[:loop:loop], 0x99)} {
+		if _, err := redactGIF(bytes.NewReader(bad), int64(len(bad))); err == nil {
+			t.Errorf("redacted %q", bad)
+		}
+	}
+}
+
+func TestRedactMP4(t *testing.T) {
+	xyz := testBox("udta", testBox("\xA9xyz", []byte("+33.8568+151.2153/")))
+	b := bytes.Join([][]byte{
+		testBox("ftyp", []byte("isom")),
+		testBox("uuid", []byte(`<x exif:GPSLatitude="33,51.9S"/>`)),
+		testBox("moov", testMvhd(600, 3000), xyz,
+			testBox("trak", testTrak("vide", "avc1", testTkhd(0, 1, -1, 0, 1920, 1080))[8:], xyz),
+			testBox("meta", be32(0), testBox("keys", []byte("com.apple.quicktime.location.ISO6709")))),
+		testBox("mdat", []byte("+33.8568 kept as sample data")),
+	}, nil)
+	want, err := readMP4Info(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := readSpliced(t, b, redactMP4)
+	if len(served) != len(b) {
+		t.Fatalf("served %d bytes of %d", len(served), len(b))
+	}
+	for _, secret := range []string{"xyz", "+151.2153", "GPSLatitude", "location"} {
+		if bytes.Contains(served, []byte(secret)) {
+			t.Errorf("%q left in %q", secret, served)
+		}
+	}
+	if !bytes.HasSuffix(served, testBox("mdat", []byte("+33.8568 kept as sample data"))) {
+		t.Error("media data changed")
+	}
+	got, err := readMP4Info(bytes.NewReader(served), int64(len(served)))
+	if err != nil || *got != *want {
+		t.Errorf("redacted movie reads as %+v %v, want %+v", got, err, want)
+	}
+	if _, err := findMP4Path(bytes.NewReader(served), int64(len(served)), "moov", "udta"); err != errBoxNotFound {
+		t.Errorf("moov/udta still found; %v", err)
+	}
+
+	bad := append(testBox("moov", testMvhd(1, 1)), 0, 0, 0, 99, 'u', 'd', 't', 'a')
+	if _, err := redactMP4(bytes.NewReader(bad), int64(len(bad))); err == nil {
+		t.Error("redacted a movie with a malformed box")
+	}
+}
+
+func TestServePrivateOriginals(t *testing.T) {
+	setupTestStores(t)
+	defer func(p privacyMode) { privacy = p }(privacy)
+	defer func(u string, fs http.Handler) { picsURL, picsFileServer = u, fs }(picsURL, picsFileServer)
+	picsURL, picsFileServer = "/pics/", http.FileServer(http.Dir(picsDir))
+	handler := http.StripPrefix(picsURL, NewErrorHandler(picsFileHandler))
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	pngWithText := append(append(append([]byte(nil), buf.Bytes()[:33]...), testPNGChunk("tEXt", []byte("Where\x00home"))...), buf.Bytes()[33:]...)
+	movie := bytes.Join([][]byte{testBox("ftyp", []byte("isom")), testBox("moov", testMvhd(1, 1), testBox("udta", []byte("home")))}, nil)
+	files := map[string][]byte{"a.png": pngWithText, "b.mp4": movie, "c.webp": []byte("RIFF home"), "d.mjpg": []byte("home"), "e.txt": []byte("home")}
+	for name, data := range files {
+		writeTestPic(t, name, data)
+	}
+
+	tests := []struct {
+		name   string
+		mode   privacyMode
+		status int
+		home   bool
+	}{
+		{"a.png", privacyOff, http.StatusOK, true},
+		{"a.png", privacyLocation, http.StatusOK, false},
+		{"b.mp4", privacyOff, http.StatusOK, true},
+		{"b.mp4", privacyLocation, http.StatusOK, false},
+		{"c.webp", privacyOff, http.StatusOK, true},
+		{"c.webp", privacyLocation, http.StatusForbidden, false},
+		{"d.mjpg", privacyAll, http.StatusForbidden, false},
+		// Neither an image nor a video, so served as stored:
+		{"e.txt", privacyAll, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		privacy = tt.mode
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/pics/"+tt.name, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s in mode %d: %d %s", tt.name, tt.mode, rec.Code, rec.Body.String())
+			continue
+		}
+		if home := bytes.Contains(rec.Body.Bytes(), []byte("home")); home != tt.home {
+			t.Errorf("%s in mode %d: served %q", tt.name, tt.mode, rec.Body.Bytes())
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-client rate limits. Each client gets a token bucket per kind of request, so that hammering one kind
+// (e.g. thumbnail renders) does not use up the budget of the others.
+
+// How much of a kind of request a client may make; a client may use a whole period's worth at once:
+type rateBudget struct {
+	Count  int
+	Period time.Duration
+}
+
+// Parses "<count>/<period>", e.g. "600/1m"; a count of 0 turns the limit off:
+func parseRateBudget(s string) (rateBudget, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return rateBudget{}, fmt.Errorf("rate '%s' is not of the form <count>/<period>, e.g. 600/1m", s)
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || n < 0 {
+		return rateBudget{}, fmt.Errorf("rate '%s' does not start with a count", s)
+	}
+	d, err := time.ParseDuration(s[i+1:])
+	if err != nil || d <= 0 {
+		return rateBudget{}, fmt.Errorf("rate '%s' does not end with a period, e.g. 1m", s)
+	}
+	return rateBudget{Count: n, Period: d}, nil
+}
+
+func (b rateBudget) String() string {
+	return fmt.Sprintf("%d/%s", b.Count, b.Period)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets for one kind of request, by client:
+type RateLimiter struct {
+	lock    sync.Mutex
+	budget  rateBudget
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(budget rateBudget) *RateLimiter {
+	return &RateLimiter{budget: budget, buckets: make(map[string]*tokenBucket)}
+}
+
+// Tokens regained per second:
+func (l *RateLimiter) rate() float64 {
+	return float64(l.budget.Count) / l.budget.Period.Seconds()
+}
+
+// Takes a token from the client's bucket; if there is none, returns how long until there will be:
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if l.budget.Count == 0 {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	burst := float64(l.budget.Count)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate())
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate() * float64(time.Second))
+}
+
+// Forgets clients whose buckets have filled back up, which is the same as never having seen them:
+func (l *RateLimiter) sweep() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate() >= float64(l.budget.Count) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *RateLimiter) SweepEvery(d time.Duration) {
+	go func() {
+		for range time.Tick(d) {
+			l.sweep()
+		}
+	}()
+}
+
+var readLimiter, uploadLimiter, thumbLimiter *RateLimiter
+
+// Peers allowed to tell us who the client is with `X-Forwarded-For`:
+var trustedProxies []*net.IPNet
+
+// Parses a comma-separated list of IP addresses and CIDR ranges:
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy '%s' is not an IP address or CIDR range", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Peers on a unix socket are the reverse proxy in front of us:
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr == "" || addr == "@"
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The client's IP address, taken from `X-Forwarded-For` only as far back as the proxies we trust:
+func clientIP(req *http.Request) string {
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+
+	// Each proxy appends the address it heard from; the rightmost one we do not trust is the client:
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// Buckets are per API token for scripts, so that they are not limited along with everyone behind the same address.
+// Only live tokens get their own bucket; otherwise a client could make up a new token, and so a new bucket, each time:
+func rateLimitKey(req *http.Request) string {
+	if secret := bearerToken(req); tokenStore != nil && tokenStore.Valid(secret) {
+		return "token:" + hashAPIToken(secret)[:12]
+	}
+	return "ip:" + clientIP(req)
+}
+
+// Responds with 429 the way the route's own handler reports errors, without logging each one:
+func tooManyRequests(rsp http.ResponseWriter, handler http.Handler, wait time.Duration) {
+	rsp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeErrorFor(rsp, handler, NewHttpError(http.StatusTooManyRequests, "Too many requests; please slow down", nil).WithCode("rate_limited"))
+}
+
+// Wraps the server to hold each client to the upload or read budget; thumbnail renders are limited where they happen:
+type RateLimitHandler struct {
+	next http.Handler
+	mux  *http.ServeMux
+}
+
+func NewRateLimitHandler(next http.Handler, mux *http.ServeMux) RateLimitHandler {
+	return RateLimitHandler{next: next, mux: mux}
+}
+
+func (h RateLimitHandler) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+	handler, pattern := h.mux.Handler(req)
+	limiter := readLimiter
+	if pattern == uploadURL {
+		limiter = uploadLimiter
+	}
+	if ok, wait := limiter.Allow(rateLimitKey(req)); !ok {
+		tooManyRequests(rsp, handler, wait)
+		return
+	}
+	h.next.ServeHTTP(rsp, req)
+}
+
+// Holds the client to the thumbnail render budget, responding and returning false if it is used up:
+func allowThumbRender(rsp http.ResponseWriter, req *http.Request) bool {
+	if ok, wait := thumbLimiter.Allow(rateLimitKey(req)); !ok {
+		tooManyRequests(rsp, nil, wait)
+		return false
+	}
+	return true
+}
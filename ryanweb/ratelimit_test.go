@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateBudget(t *testing.T) {
+	tests := []struct {
+		s    string
+		want rateBudget
+		ok   bool
+	}{
+		{"600/1m", rateBudget{600, time.Minute}, true},
+		{"0/1s", rateBudget{0, time.Second}, true},
+		{"30/90s", rateBudget{30, 90 * time.Second}, true},
+		{"600", rateBudget{}, false},
+		{"x/1m", rateBudget{}, false},
+		{"-1/1m", rateBudget{}, false},
+		{"10/", rateBudget{}, false},
+		{"10/0s", rateBudget{}, false},
+		{"10/-1m", rateBudget{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRateBudget(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRateBudget(%q) = %v, %v; want %v, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(rateBudget{Count: 3, Period: time.Second})
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d of a burst of 3 refused", i+1)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait <= 0 || wait > time.Second/3 {
+		t.Fatalf("fourth request = %v, wait %s; want refused for up to 1/3 s", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatalf("another client was refused")
+	}
+
+	time.Sleep(wait)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("request after waiting was refused")
+	}
+
+	// Full buckets are forgotten:
+	l.buckets["c"] = &tokenBucket{tokens: 3, last: time.Now()}
+	l.sweep()
+	if _, ok := l.buckets["c"]; ok {
+		t.Errorf("sweep kept a full bucket")
+	}
+	if _, ok := l.buckets["a"]; !ok {
+		t.Errorf("sweep dropped a bucket in use")
+	}
+
+	unlimited := NewRateLimiter(rateBudget{Count: 0, Period: time.Second})
+	for i := 0; i < 100; i++ {
+		if ok, _ := unlimited.Allow("a"); !ok {
+			t.Fatalf("a budget of 0 refused a request")
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"10.0.0.1", []string{"10.0.0.1/32"}, true},
+		{" 10.0.0.0/8 , ::1 ", []string{"10.0.0.0/8", "::1/128"}, true},
+		{"10.0.0.1,,192.168.0.0/16", []string{"10.0.0.1/32", "192.168.0.0/16"}, true},
+		{"proxy.local", nil, false},
+		{"10.0.0.0/33", nil, false},
+	}
+	for _, tt := range tests {
+		nets, err := parseTrustedProxies(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseTrustedProxies(%q) error = %v, want ok %v", tt.s, err, tt.ok)
+			continue
+		}
+		got := make([]string, 0)
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseTrustedProxies(%q) = %v, want %v", tt.s, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseTrustedProxies(%q) = %v, want %v", tt.s, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func mustParseTrustedProxies(t *testing.T, s string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseTrustedProxies(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(p []*net.IPNet) { trustedProxies = p }(trustedProxies)
+	trustedProxies = mustParseTrustedProxies(t, "10.0.0.0/8")
+
+	tests := []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		// Untrusted peers cannot say who the client is:
+		{"203.0.113.9:5000", nil, "203.0.113.9"},
+		{"203.0.113.9:5000", []string{"198.51.100.1"}, "203.0.113.9"},
+		// Trusted proxies can:
+		{"10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		// The rightmost untrusted hop is the client; anything left of it may be made up:
+		{"10.0.0.2:5000", []string{"1.1.1.1, 198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"10.0.0.2:5000", []string{"1.1.1.1", "198.51.100.1"}, "198.51.100.1"},
+		// A chain of only trusted proxies ends at the leftmost:
+		{"10.0.0.2:5000", []string{"10.0.0.4, 10.0.0.3"}, "10.0.0.4"},
+		{"10.0.0.2:5000", nil, "10.0.0.2"},
+		// Unix sockets are from the reverse proxy:
+		{"@", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"", nil, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		for _, h := range tt.xff {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		if got := clientIP(req); got != tt.want {
+			t.Errorf("clientIP(%q, %q) = %q, want %q", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	setupTestAccounts(t, `{"users": [{"name": "ryan", "passwordHash": "`+testPasswordHash+`"}]}`)
+	secret, _, err := tokenStore.Create("ryan", "script", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(authorization string) string {
+		req := httptest.NewRequest("GET", "/list", nil)
+		req.RemoteAddr = "203.0.113.9:5000"
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return rateLimitKey(req)
+	}
+	if got := key(""); got != "ip:203.0.113.9" {
+		t.Errorf("key without a token = %q", got)
+	}
+	if got := key("Bearer " + secret); got != "token:"+hashAPIToken(secret)[:12] {
+		t.Errorf("key with a live token = %q", got)
+	}
+	// Made-up tokens must not get buckets of their own:
+	if got := key("Bearer " + apiTokenPrefix + "madeup"); got != "ip:203.0.113.9" {
+		t.Errorf("key with a made-up token = %q", got)
+	}
+}
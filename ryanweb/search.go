@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Inverted index over file names, captions, tags, camera models and dates, rebuilt lazily after anything it covers changes.
+
+// Searchable fields; a query term without a field matches any of them:
+var searchFields = []string{"name", "caption", "tag", "camera", "date"}
+
+type SearchIndex struct {
+	// Bumped by `Invalidate`; the index is rebuilt when it differs from `built`. Accessed atomically so the stores
+	// feeding the index can invalidate it while holding their own locks:
+	generation uint64
+
+	// Held while rebuilding, so concurrent searches of a stale index rebuild it once:
+	building sync.Mutex
+
+	lock  sync.Mutex
+	built uint64
+	ready bool
+	// When files left out as mid-upload may have settled, so the index is rebuilt after it; zero if none were:
+	recheck time.Time
+	// "field:token" -> picture paths:
+	postings map[string][]string
+	// Sorted keys of `postings`, for prefix matching:
+	terms []string
+}
+
+var searchIndex = NewSearchIndex()
+
+// The least time before looking again for files left out of the index as mid-upload; files named as partial
+// downloads may sit there indefinitely:
+const searchRecheckInterval = 10 * time.Second
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{postings: make(map[string][]string)}
+}
+
+// Marks the index as out of date:
+func (x *SearchIndex) Invalidate() {
+	atomic.AddUint64(&x.generation, 1)
+}
+
+// Splits text into lower-case runs of letters and digits:
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Dates are indexed at year, month and day granularity so `date:2024-05` is a prefix of `date:2024-05-17`:
+func dateTokens(t time.Time) []string {
+	return []string{t.Format("2006"), t.Format("2006-01"), t.Format("2006-01-02")}
+}
+
+// Rebuilds the index if anything has changed since it was built. What it covers is read before taking the lock,
+// since the stores it is read from invalidate the index while holding their own locks:
+func (x *SearchIndex) refresh() {
+	x.building.Lock()
+	defer x.building.Unlock()
+
+	generation := atomic.LoadUint64(&x.generation)
+	x.lock.Lock()
+	current := x.ready && x.built == generation && (x.recheck.IsZero() || time.Now().Before(x.recheck))
+	x.lock.Unlock()
+	if current {
+		return
+	}
+
+	metas := metaCache.All()
+	tags := tagStore.All()
+	captions := tagStore.Captions()
+	// Uploads still in progress are left out until they settle:
+	files, pending := picIndex.SettledFiles()
+	var recheck time.Time
+	if pending {
+		wait := settleTime
+		if wait < searchRecheckInterval {
+			wait = searchRecheckInterval
+		}
+		recheck = time.Now().Add(wait)
+	}
+
+	postings := make(map[string][]string)
+	for _, name := range files {
+		seen := make(map[string]bool)
+		add := func(field string, tokens []string) {
+			for _, tok := range tokens {
+				term := field + ":" + tok
+				if !seen[term] {
+					seen[term] = true
+					postings[term] = append(postings[term], name)
+				}
+			}
+		}
+
+		add("name", searchTokens(name))
+		add("caption", searchTokens(captions[name]))
+		add("tag", tags[name])
+		if meta, ok := metas[name]; ok {
+			meta = privatePicMeta(meta)
+			add("camera", searchTokens(meta.Camera))
+			add("caption", searchTokens(meta.Caption))
+			if !meta.Taken.IsZero() {
+				add("date", dateTokens(meta.Taken))
+			} else {
+				add("date", dateTokens(meta.ModTime))
+			}
+		}
+	}
+
+	terms := make([]string, 0, len(postings))
+	for term := range postings {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	x.lock.Lock()
+	x.postings, x.terms = postings, terms
+	x.built, x.ready, x.recheck = generation, true, recheck
+	x.lock.Unlock()
+}
+
+// Returns the pictures with a term starting with `prefix` in `field`; must be called with the lock held:
+func (x *SearchIndex) matchPrefix(field, prefix string, into map[string]bool) {
+	key := field + ":" + prefix
+	for i := sort.SearchStrings(x.terms, key); i < len(x.terms) && strings.HasPrefix(x.terms[i], key); i++ {
+		for _, name := range x.postings[x.terms[i]] {
+			into[name] = true
+		}
+	}
+}
+
+// One parsed query term; an empty field matches any field:
+type searchTerm struct {
+	Field  string
+	Tokens []string
+}
+
+// Parses queries like `beach camera:pixel date:2024-05`; terms with an unknown field are searched for literally:
+func parseSearchQuery(q string) []searchTerm {
+	terms := make([]searchTerm, 0)
+	for _, word := range strings.Fields(q) {
+		field := ""
+		if i := strings.Index(word, ":"); i > 0 {
+			f := strings.ToLower(word[:i])
+			for _, known := range searchFields {
+				if f == known {
+					field, word = f, word[i+1:]
+					break
+				}
+			}
+		}
+
+		var tokens []string
+		switch field {
+		case "date":
+			// Keep the dashes so the whole date is one prefix:
+			tokens = []string{strings.ToLower(word)}
+		case "tag":
+			tokens = []string{strings.ToLower(word)}
+		default:
+			tokens = searchTokens(word)
+		}
+		if len(tokens) == 0 || tokens[0] == "" {
+			continue
+		}
+		terms = append(terms, searchTerm{Field: field, Tokens: tokens})
+	}
+	return terms
+}
+
+// Returns the paths of the pictures matching every term of the query, in no particular order:
+func (x *SearchIndex) Search(q string) []string {
+	terms := parseSearchQuery(q)
+	if len(terms) == 0 {
+		return []string{}
+	}
+
+	x.refresh()
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	var result map[string]bool
+	for _, t := range terms {
+		for _, tok := range t.Tokens {
+			matches := make(map[string]bool)
+			if t.Field != "" {
+				x.matchPrefix(t.Field, tok, matches)
+			} else {
+				for _, f := range searchFields {
+					x.matchPrefix(f, tok, matches)
+				}
+			}
+
+			// Every token must match:
+			if result == nil {
+				result = matches
+				continue
+			}
+			for name := range result {
+				if !matches[name] {
+					delete(result, name)
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	return names
+}
+
+// One search hit:
+type SearchResult struct {
+	Name     string   `json:"name"`
+	PicURL   string   `json:"picUrl"`
+	ThumbURL string   `json:"thumbUrl,omitempty"`
+	Mime     string   `json:"mime"`
+	Caption  string   `json:"caption,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Camera   string   `json:"camera,omitempty"`
+	Taken    string   `json:"taken,omitempty"`
+	ModTime  string   `json:"mtime"`
+
+	when time.Time
+}
+
+// JSON handler for `/search`:
+func searchJsonHandler(req *http.Request) (interface{}, error) {
+	v := req.URL.Query()
+	q := strings.TrimSpace(v.Get("q"))
+	if q == "" {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting q query value", fmt.Errorf("No q query value"))
+	}
+	limit := 100
+	if s := v.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return nil, NewHttpError(http.StatusBadRequest, "Invalid limit query value", fmt.Errorf("limit '%s' is not a positive integer", s))
+		}
+	}
+
+	metas := metaCache.All()
+	hits := make([]SearchResult, 0)
+	for _, name := range visiblePics(req, searchIndex.Search(q)) {
+		r := SearchResult{
+			Name:    name,
+			PicURL:  pjoin(siteHost, pjoin(picsURL, name)),
+			Mime:    getMimeType(name),
+			Caption: tagStore.Caption(name),
+			Tags:    tagStore.Tags(name),
+		}
+		if hasThumbnail(name) {
+			r.ThumbURL = pjoin(siteHost, pjoin(thumbsURL, name))
+		}
+		if meta, ok := metas[name]; ok {
+			meta = privatePicMeta(meta)
+			r.Camera = meta.Camera
+			if r.Caption == "" {
+				r.Caption = meta.Caption
+			}
+			r.ModTime = meta.ModTime.UTC().Format(time.RFC3339)
+			r.when = meta.ModTime
+			if !meta.Taken.IsZero() {
+				r.Taken = meta.Taken.Format(time.RFC3339)
+				r.when = meta.Taken
+			}
+		}
+		hits = append(hits, r)
+	}
+
+	// Newest first, by when taken if known:
+	sort.Slice(hits, func(i, j int) bool {
+		if wi, wj := hits[i].when, hits[j].when; !wi.Equal(wj) {
+			return wi.After(wj)
+		}
+		return path.Base(hits[i].Name) < path.Base(hits[j].Name)
+	})
+
+	total := len(hits)
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return struct {
+		Query string         `json:"query"`
+		Total int            `json:"total"`
+		Files []SearchResult `json:"files"`
+	}{
+		Query: q,
+		Total: total,
+		Files: hits,
+	}, nil
+}
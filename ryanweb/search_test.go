@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []searchTerm
+	}{
+		{"", []searchTerm{}},
+		{"Beach", []searchTerm{{Tokens: []string{"beach"}}}},
+		{"camera:Pixel-7", []searchTerm{{Field: "camera", Tokens: []string{"pixel", "7"}}}},
+		{"date:2024-05", []searchTerm{{Field: "date", Tokens: []string{"2024-05"}}}},
+		{"tag:Summer_Trip", []searchTerm{{Field: "tag", Tokens: []string{"summer_trip"}}}},
+		// Unknown fields are searched for literally:
+		{"lens:50mm", []searchTerm{{Tokens: []string{"lens", "50mm"}}}},
+		{"caption:", []searchTerm{}},
+	}
+	for _, tt := range tests {
+		if got := parseSearchQuery(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSearchQuery(%q) = %#v, want %#v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSeesTagEdits(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "beach.jpg", []byte("not really a jpeg"))
+
+	if got := searchIndex.Search("sunset"); len(got) != 0 {
+		t.Fatalf("Search before captioning = %v, want nothing", got)
+	}
+	if err := tagStore.SetCaption("beach.jpg", "Sunset at the pier"); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIndex.Search("caption:sun pier"); !reflect.DeepEqual(got, []string{"beach.jpg"}) {
+		t.Fatalf("Search after captioning = %v, want [beach.jpg]", got)
+	}
+}
+
+// Tag edits invalidate the index while holding the tag store's lock, and rebuilding the index reads the tag store:
+func TestSearchConcurrentWithTagEdits(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "beach.jpg", []byte("not really a jpeg"))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if err := tagStore.SetCaption("beach.jpg", fmt.Sprintf("sunset %d", i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			searchIndex.Search("sunset")
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock between searching and editing captions")
+	}
+}
+
+func TestSearchLeavesOutUploads(t *testing.T) {
+	setupTestStores(t)
+	defer func(d time.Duration) { settleTime = d }(settleTime)
+	settleTime = time.Minute
+
+	hourAgo := time.Now().Add(-time.Hour)
+	for name, mtime := range map[string]time.Time{"beach.jpg": hourAgo, "beach2.jpg": time.Now(), "beach3.jpg.part": hourAgo} {
+		p := path.Join(picsDir, name)
+		if err := ioutil.WriteFile(p, []byte(name), 0664); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := picIndex.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIndex.Search("beach"); !reflect.DeepEqual(got, []string{"beach.jpg"}) {
+		t.Fatalf("Search = %v, want [beach.jpg]", got)
+	}
+
+	// Settling raises no event, so the index looks again once uploads may have settled:
+	settleTime = 0
+	if got := searchIndex.Search("beach"); !reflect.DeepEqual(got, []string{"beach.jpg"}) {
+		t.Fatalf("Search before the recheck = %v, want [beach.jpg]", got)
+	}
+	searchIndex.lock.Lock()
+	searchIndex.recheck = time.Now().Add(-time.Second)
+	searchIndex.lock.Unlock()
+	if got := searchIndex.Search("beach"); !reflect.DeepEqual(got, []string{"beach.jpg", "beach2.jpg"}) {
+		t.Fatalf("Search after the recheck = %v, want [beach.jpg beach2.jpg]", got)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share links let people without an account see a single picture, or the pictures of one album, until the link
+// expires. The link carries its own terms, signed with a server key; only download counts are kept on our side.
+
+// How long share links last unless asked otherwise, and at most:
+const (
+	shareDefaultLifetime = 7 * 24 * time.Hour
+	shareMaxLifetime     = 90 * 24 * time.Hour
+)
+
+// Once a client's download of a file is counted, it may fetch the file again for this long without counting another,
+// e.g. to seek in a video or resume with range requests:
+const shareSessionLength = time.Hour
+
+// The terms of a share link:
+type ShareClaims struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Shares the pictures directly in the album at `Path`, not those in its sub-albums:
+	Album   bool  `json:"album,omitempty"`
+	Expires int64 `json:"exp"`
+	// 0 for no limit:
+	MaxDownloads int `json:"max,omitempty"`
+}
+
+func (c *ShareClaims) Covers(rel string) bool {
+	if c.Album {
+		return rel == c.Path || albumOf(rel) == c.Path
+	}
+	return rel == c.Path
+}
+
+var (
+	errShareInvalid = errors.New("share link is not valid")
+	errShareExpired = errors.New("share link has expired")
+	errShareUsedUp  = errors.New("share link has no downloads left")
+)
+
+type shareCount struct {
+	Downloads int   `json:"downloads"`
+	Expires   int64 `json:"exp"`
+}
+
+type shareState struct {
+	// HMAC key for signing links; replacing it invalidates all links:
+	Key []byte `json:"key"`
+	// Downloads of limited shares by share ID:
+	Counts map[string]shareCount `json:"counts"`
+}
+
+type ShareStore struct {
+	lock  sync.Mutex
+	path  string
+	state shareState
+	// When each client's download of each file of a limited share was last counted; not kept across restarts:
+	sessions map[shareSession]time.Time
+}
+
+type shareSession struct {
+	ID, Client, Path string
+}
+
+var shareStore *ShareStore
+
+func NewShareStore(path string) *ShareStore {
+	return &ShareStore{path: path, sessions: make(map[shareSession]time.Time)}
+}
+
+// Loads the key and counts, creating a new key on first use:
+func (s *ShareStore) Load() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return err
+		}
+	}
+	if s.state.Counts == nil {
+		s.state.Counts = make(map[string]shareCount)
+	}
+	if len(s.state.Key) == 0 {
+		s.state.Key = make([]byte, 32)
+		if _, err := rand.Read(s.state.Key); err != nil {
+			return err
+		}
+		return s.save()
+	}
+	return nil
+}
+
+// Must be called with the lock held:
+func (s *ShareStore) save() error {
+	// Counts of expired links are no longer needed:
+	now := time.Now().Unix()
+	for id, c := range s.state.Counts {
+		if c.Expires < now {
+			delete(s.state.Counts, id)
+		}
+	}
+
+	b, err := json.MarshalIndent(s.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(s.path), ".shares-")
+	if err != nil {
+		return err
+	}
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return err
+	}
+	tf.Close()
+	// Holds the signing key; keep it private:
+	os.Chmod(tf.Name(), 0600)
+	if err := os.Rename(tf.Name(), s.path); err != nil {
+		os.Remove(tf.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *ShareStore) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.state.Key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+// Encodes and signs the terms as `<payload>.<signature>`:
+func (s *ShareStore) Sign(c ShareClaims) string {
+	b, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+// Reports whether the client's download of a file has been counted lately; must be called with the lock held:
+func (s *ShareStore) inSession(session shareSession) bool {
+	t, ok := s.sessions[session]
+	return ok && time.Since(t) < shareSessionLength
+}
+
+// Checks the signature, expiry and remaining downloads of a share link used by `client` to fetch `rel`:
+func (s *ShareStore) Verify(token, client, rel string) (ShareClaims, error) {
+	var c ShareClaims
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return c, errShareInvalid
+	}
+	payload := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, s.mac(payload)) {
+		return c, errShareInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(b, &c) != nil {
+		return c, errShareInvalid
+	}
+
+	if time.Now().Unix() > c.Expires {
+		return c, errShareExpired
+	}
+	if c.MaxDownloads > 0 {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.state.Counts[c.ID].Downloads >= c.MaxDownloads && !s.inSession(shareSession{c.ID, client, rel}) {
+			return c, errShareUsedUp
+		}
+	}
+	return c, nil
+}
+
+// Counts a download of `rel` by `client` against a limited share, unless one was counted lately:
+func (s *ShareStore) Use(c ShareClaims, client, rel string) error {
+	if c.MaxDownloads <= 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session := shareSession{c.ID, client, rel}
+	if s.inSession(session) {
+		return nil
+	}
+	n := s.state.Counts[c.ID]
+	if n.Downloads >= c.MaxDownloads {
+		return errShareUsedUp
+	}
+	n.Downloads++
+	n.Expires = c.Expires
+	s.state.Counts[c.ID] = n
+
+	now := time.Now()
+	for old, t := range s.sessions {
+		if now.Sub(t) >= shareSessionLength {
+			delete(s.sessions, old)
+		}
+	}
+	s.sessions[session] = now
+	if err := s.save(); err != nil {
+		log.Printf("Could not save share counts; %s\n", err)
+	}
+	return nil
+}
+
+// The share link the request was made with, if it covers `rel`; nil if there is none or it does not cover `rel`.
+// Links that are genuine but expired or used up are refused outright:
+func requestShare(req *http.Request, rel string) (*ShareClaims, error) {
+	token := req.URL.Query().Get("share")
+	if token == "" || shareStore == nil {
+		return nil, nil
+	}
+	c, err := shareStore.Verify(token, clientIP(req), rel)
+	switch err {
+	case errShareExpired:
+		return nil, NewHttpError(http.StatusGone, "This share link has expired", fmt.Errorf("Share %s for '%s': %w", c.ID, c.Path, err)).WithCode("share_expired")
+	case errShareUsedUp:
+		return nil, NewHttpError(http.StatusGone, "This share link has no downloads left", fmt.Errorf("Share %s for '%s': %w", c.ID, c.Path, err)).WithCode("share_used_up")
+	}
+	if err != nil || !c.Covers(rel) {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// Counts a download of a shared picture, refusing it if the share is used up. Every GET counts, whatever range it
+// asks for, but each client is counted once per file for a while so it may seek and resume:
+func useShare(req *http.Request, share *ShareClaims, rel string) error {
+	if req.Method != "GET" {
+		return nil
+	}
+	if err := shareStore.Use(*share, clientIP(req), rel); err != nil {
+		return NewHttpError(http.StatusGone, "This share link has no downloads left", fmt.Errorf("Share %s for '%s': %w", share.ID, share.Path, err)).WithCode("share_used_up")
+	}
+	return nil
+}
+
+// Lists the pictures of a shared album with links that carry the share:
+func serveSharedAlbum(rsp http.ResponseWriter, req *http.Request, share *ShareClaims) {
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		http.Redirect(rsp, req, path.Base(req.URL.Path)+"/?"+req.URL.RawQuery, http.StatusMovedPermanently)
+		return
+	}
+
+	var names []string
+	for _, fi := range picIndex.Settled(share.Path) {
+		if !fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+
+	q := url.Values{"share": {req.URL.Query().Get("share")}}.Encode()
+	rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(rsp, "<pre>\n")
+	for _, name := range names {
+		href := (&url.URL{Path: name}).String() + "?" + q
+		fmt.Fprintf(rsp, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	fmt.Fprintf(rsp, "</pre>\n")
+}
+
+type ShareRequest struct {
+	Path string `json:"path"`
+	// A duration such as "48h"; defaults to a week:
+	Expires string `json:"expires"`
+	// 0 for no limit:
+	Downloads int `json:"downloads"`
+}
+
+func parseShareRequest(req *http.Request) (sr ShareRequest, err error) {
+	if req.Method != "POST" {
+		return sr, NewHttpError(http.StatusMethodNotAllowed, "Sharing requires POST method", fmt.Errorf("Sharing requires POST method"))
+	}
+
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&sr); err != nil {
+			return sr, NewHttpError(http.StatusBadRequest, "Error parsing JSON request body", err)
+		}
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return sr, NewHttpError(http.StatusBadRequest, "Error parsing form data", err)
+	}
+	sr.Path = req.Form.Get("path")
+	sr.Expires = req.Form.Get("expires")
+	if s := req.Form.Get("downloads"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return sr, NewHttpError(http.StatusBadRequest, "Invalid downloads value", fmt.Errorf("downloads '%s' is not an integer", s))
+		}
+		sr.Downloads = n
+	}
+	return
+}
+
+// JSON handler for `/share`; mints a share link for a picture or album:
+func shareJsonHandler(req *http.Request) (interface{}, error) {
+	if err := requireAccounts(); err != nil {
+		return nil, err
+	}
+	if err := requireContributor(req); err != nil {
+		return nil, err
+	}
+	sr, err := parseShareRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, ok := safeRelPath(sr.Path)
+	if !ok || rel == "" {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting a picture or album path", fmt.Errorf("Invalid share path '%s'", sr.Path))
+	}
+	isAlbum := picIndex.HasAlbum(rel)
+	if isAlbum {
+		if err := requireViewAlbum(req, rel); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := requireViewPic(req, rel); err != nil {
+			return nil, err
+		}
+		picPath, err := resolvePicPath(rel)
+		if err != nil {
+			return nil, NewHttpError(http.StatusNotFound, "Picture not found", err)
+		}
+		if fi, err := os.Stat(picPath); err != nil || !fi.Mode().IsRegular() {
+			return nil, NewHttpError(http.StatusNotFound, "Picture not found", fmt.Errorf("No file '%s'", rel))
+		}
+	}
+
+	lifetime := shareDefaultLifetime
+	if sr.Expires != "" {
+		d, err := time.ParseDuration(sr.Expires)
+		if err != nil || d <= 0 || d > shareMaxLifetime {
+			return nil, NewHttpError(http.StatusBadRequest, fmt.Sprintf("Expecting expires as a duration up to %d days, e.g. \"48h\"", shareMaxLifetime/(24*time.Hour)), fmt.Errorf("Invalid share expiry '%s'", sr.Expires))
+		}
+		lifetime = d
+	}
+	if sr.Downloads < 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting downloads to be 0 (unlimited) or more", fmt.Errorf("Invalid share downloads %d", sr.Downloads))
+	}
+
+	expires := time.Now().Add(lifetime).UTC()
+	c := ShareClaims{
+		ID:           randomToken()[:16],
+		Path:         rel,
+		Album:        isAlbum,
+		Expires:      expires.Unix(),
+		MaxDownloads: sr.Downloads,
+	}
+	q := "?" + url.Values{"share": {shareStore.Sign(c)}}.Encode()
+	log.Printf("User '%s' shared '%s' as %s until %s\n", currentUser(req), rel, c.ID, expires.Format(time.RFC3339))
+
+	shareURL, thumbURL := pjoin(siteHost, pjoin(picsURL, rel)), ""
+	if isAlbum {
+		shareURL += "/"
+	} else if hasThumbnail(rel) {
+		thumbURL = pjoin(siteHost, pjoin(thumbsURL, rel)) + q
+	}
+
+	return struct {
+		Success      bool      `json:"success"`
+		ID           string    `json:"id"`
+		URL          string    `json:"url"`
+		ThumbURL     string    `json:"thumbUrl,omitempty"`
+		Expires      time.Time `json:"expires"`
+		MaxDownloads int       `json:"maxDownloads,omitempty"`
+	}{
+		Success:      true,
+		ID:           c.ID,
+		URL:          shareURL + q,
+		ThumbURL:     thumbURL,
+		Expires:      expires,
+		MaxDownloads: c.MaxDownloads,
+	}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShareStore(t *testing.T) *ShareStore {
+	t.Helper()
+	s := NewShareStore(path.Join(t.TempDir(), "shares.json"))
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestShareSignVerify(t *testing.T) {
+	s := newTestShareStore(t)
+	future := time.Now().Add(time.Hour).Unix()
+	claims := ShareClaims{ID: "abc", Path: "family/a.jpg", Expires: future}
+	token := s.Sign(claims)
+
+	got, err := s.Verify(token, "ip:1.2.3.4", "family/a.jpg")
+	if err != nil || got != claims {
+		t.Fatalf("Verify(Sign(c)) = %+v, %v; want %+v", got, err, claims)
+	}
+
+	payload := token[:strings.IndexByte(token, '.')]
+	other := s.Sign(ShareClaims{ID: "abc", Path: "family/b.jpg", Expires: future})
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"empty", "", errShareInvalid},
+		{"no signature", payload, errShareInvalid},
+		{"bad signature", payload + ".AAAA", errShareInvalid},
+		{"signature of other terms", payload + other[strings.IndexByte(other, '.'):], errShareInvalid},
+		{"not base64", "!!!." + token[len(payload)+1:], errShareInvalid},
+		{"expired", s.Sign(ShareClaims{ID: "old", Path: "a.jpg", Expires: time.Now().Add(-time.Second).Unix()}), errShareExpired},
+		{"signed with another key", newTestShareStore(t).Sign(claims), errShareInvalid},
+	}
+	for _, tt := range tests {
+		if _, err := s.Verify(tt.token, "ip:1.2.3.4", "a.jpg"); err != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestShareKeyPersists(t *testing.T) {
+	p := path.Join(t.TempDir(), "shares.json")
+	s := NewShareStore(p)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	token := s.Sign(ShareClaims{ID: "abc", Path: "a.jpg", Expires: time.Now().Add(time.Hour).Unix()})
+
+	reloaded := NewShareStore(p)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Verify(token, "ip:1.2.3.4", "a.jpg"); err != nil {
+		t.Errorf("Verify after reload = %v", err)
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	s := newTestShareStore(t)
+	c := ShareClaims{ID: "abc", Path: "a.jpg", Expires: time.Now().Add(time.Hour).Unix(), MaxDownloads: 2}
+	token := s.Sign(c)
+
+	// A client fetching the same file again, e.g. by range, is counted once:
+	for i := 0; i < 3; i++ {
+		if err := s.Use(c, "ip:1.1.1.1", "a.jpg"); err != nil {
+			t.Fatalf("Use #%d by the first client = %v", i+1, err)
+		}
+	}
+	if err := s.Use(c, "ip:2.2.2.2", "a.jpg"); err != nil {
+		t.Fatalf("Use by the second client = %v", err)
+	}
+	if err := s.Use(c, "ip:3.3.3.3", "a.jpg"); err != errShareUsedUp {
+		t.Fatalf("Use by the third client = %v, want %v", err, errShareUsedUp)
+	}
+
+	if _, err := s.Verify(token, "ip:3.3.3.3", "a.jpg"); err != errShareUsedUp {
+		t.Errorf("Verify by a new client = %v, want %v", err, errShareUsedUp)
+	}
+	if _, err := s.Verify(token, "ip:1.1.1.1", "a.jpg"); err != nil {
+		t.Errorf("Verify by a counted client = %v, want it to carry on", err)
+	}
+
+	// Sessions end:
+	s.sessions[shareSession{"abc", "ip:1.1.1.1", "a.jpg"}] = time.Now().Add(-shareSessionLength)
+	if err := s.Use(c, "ip:1.1.1.1", "a.jpg"); err != errShareUsedUp {
+		t.Errorf("Use after the session ended = %v, want %v", err, errShareUsedUp)
+	}
+}
+
+func TestShareCovers(t *testing.T) {
+	pic := ShareClaims{Path: "family/a.jpg"}
+	album := ShareClaims{Path: "family", Album: true}
+	tests := []struct {
+		c    ShareClaims
+		rel  string
+		want bool
+	}{
+		{pic, "family/a.jpg", true},
+		{pic, "family/b.jpg", false},
+		{pic, "family", false},
+		{album, "family", true},
+		{album, "family/b.jpg", true},
+		{album, "family/kids/c.jpg", false},
+		{album, "familyx/b.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := tt.c.Covers(tt.rel); got != tt.want {
+			t.Errorf("%+v.Covers(%q) = %v, want %v", tt.c, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestShareJsonHandler(t *testing.T) {
+	setupTestStores(t)
+	setupTestAccounts(t, `{"users":[
+		{"name":"ryan","passwordHash":"`+testPasswordHash+`","role":"admin"},
+		{"name":"bob","passwordHash":"`+testPasswordHash+`","role":"contributor"},
+		{"name":"gm","passwordHash":"`+testPasswordHash+`","role":"viewer"}],
+		"albums":{"family":{"viewers":["gm"],"contributors":["ryan"]}}}`)
+	writeTestPic(t, "a.jpg", []byte("a"))
+	writeTestPic(t, "family/b.jpg", []byte("b"))
+
+	tests := []struct {
+		name   string
+		user   string
+		form   url.Values
+		status int
+	}{
+		{"picture", "bob", url.Values{"path": {"a.jpg"}, "expires": {"1h"}, "downloads": {"2"}}, http.StatusOK},
+		{"album", "ryan", url.Values{"path": {"family"}}, http.StatusOK},
+		{"anonymous", "", url.Values{"path": {"a.jpg"}}, http.StatusForbidden},
+		{"viewer", "gm", url.Values{"path": {"family/b.jpg"}}, http.StatusForbidden},
+		{"restricted album", "bob", url.Values{"path": {"family/b.jpg"}}, http.StatusNotFound},
+		{"missing picture", "bob", url.Values{"path": {"c.jpg"}}, http.StatusNotFound},
+		{"hidden path", "bob", url.Values{"path": {".tags.json"}}, http.StatusBadRequest},
+		{"no path", "bob", url.Values{}, http.StatusBadRequest},
+		{"too long", "bob", url.Values{"path": {"a.jpg"}, "expires": {"10000h"}}, http.StatusBadRequest},
+		{"negative expiry", "bob", url.Values{"path": {"a.jpg"}, "expires": {"-1h"}}, http.StatusBadRequest},
+		{"bad expiry", "bob", url.Values{"path": {"a.jpg"}, "expires": {"a week"}}, http.StatusBadRequest},
+		{"negative downloads", "bob", url.Values{"path": {"a.jpg"}, "downloads": {"-1"}}, http.StatusBadRequest},
+		{"bad downloads", "bob", url.Values{"path": {"a.jpg"}, "downloads": {"two"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/share", strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.user != "" {
+			req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sessions.Create(tt.user)))
+		}
+		rec := httptest.NewRecorder()
+		NewJsonHandler(shareJsonHandler).ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: %d %s", tt.name, rec.Code, rec.Body.String())
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		// The link works for what was shared and nothing else:
+		var rsp struct{ URL string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(rsp.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel := tt.form.Get("path")
+		for _, other := range []string{rel, "a.jpg", "family/b.jpg"} {
+			share, err := requestShare(httptest.NewRequest("GET", "/?"+u.RawQuery, nil), other)
+			if err != nil || (share != nil) != (other == rel || strings.HasPrefix(other, rel+"/")) {
+				t.Errorf("%s: share of '%s' used for '%s': %+v %v", tt.name, rel, other, share, err)
+			}
+		}
+	}
+}
+
+func TestRequestShareRefusals(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	expired := shareStore.Sign(ShareClaims{ID: "old", Path: "a.jpg", Expires: time.Now().Add(-time.Minute).Unix()})
+	usedUp := ShareClaims{ID: "once", Path: "a.jpg", Expires: time.Now().Add(time.Hour).Unix(), MaxDownloads: 1}
+	if err := shareStore.Use(usedUp, "ip:9.9.9.9", "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{"expired", expired, "share_expired"},
+		{"used up", shareStore.Sign(usedUp), "share_used_up"},
+		{"forged", "eyJ9." + strings.Repeat("A", 43), ""},
+	}
+	for _, tt := range tests {
+		share, err := requestShare(httptest.NewRequest("GET", "/?"+url.Values{"share": {tt.token}}.Encode(), nil), "a.jpg")
+		code := ""
+		if herr, ok := err.(HttpError); ok {
+			code = herr.Code
+		}
+		if share != nil || code != tt.code || (tt.code != "" && !errors.Is(err, ErrGone)) {
+			t.Errorf("%s: %+v %v", tt.name, share, err)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
-import "os"
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
 
 // For directory entry sorting:
 
@@ -15,8 +21,30 @@ const (
 	sortByName sortBy = iota
 	sortByDate
 	sortBySize
+	sortByType
+	sortByTaken
+	sortByDimensions
 )
 
+// Names used for the sort modes in query strings:
+var sortByNames = map[string]sortBy{
+	"name":       sortByName,
+	"date":       sortByDate,
+	"size":       sortBySize,
+	"type":       sortByType,
+	"taken":      sortByTaken,
+	"dimensions": sortByDimensions,
+}
+
+func (by sortBy) String() string {
+	for name, b := range sortByNames {
+		if b == by {
+			return name
+		}
+	}
+	return ""
+}
+
 type sortDirection int
 
 const (
@@ -24,6 +52,82 @@ const (
 	sortDescending
 )
 
+func (dir sortDirection) String() string {
+	if dir == sortDescending {
+		return "desc"
+	}
+	return "asc"
+}
+
+// Parses `?sort=&dir=` query values, defaulting to newest first:
+func parseSort(sortName, dirName string) (by sortBy, dir sortDirection) {
+	by, ok := sortByNames[sortName]
+	if !ok {
+		by = sortByDate
+	}
+
+	switch dirName {
+	case "asc":
+		dir = sortAscending
+	case "desc":
+		dir = sortDescending
+	default:
+		// Dates and sizes are most useful biggest first; names and types alphabetically:
+		if by == sortByName || by == sortByType {
+			dir = sortAscending
+		} else {
+			dir = sortDescending
+		}
+	}
+	return
+}
+
+// Returns the sort order for the given mode over the entries of `album`:
+func sortOrder(album string, by sortBy, dir sortDirection) func([]os.FileInfo) sort.Interface {
+	var metas map[string]PicMeta
+	if by == sortByTaken || by == sortByDimensions {
+		// The sorters look entries up by name within the album:
+		metas = make(map[string]PicMeta)
+		for rel, m := range metaCache.All() {
+			if albumOf(rel) == album {
+				metas[path.Base(rel)] = m
+			}
+		}
+	}
+
+	return func(fis []os.FileInfo) sort.Interface {
+		switch by {
+		case sortByName:
+			return ByName{fis, dir}
+		case sortBySize:
+			return BySize{fis, dir}
+		case sortByType:
+			return ByType{fis, dir}
+		case sortByTaken:
+			return ByTaken{fis, dir, metas}
+		case sortByDimensions:
+			return ByDimensions{fis, dir, metas}
+		default:
+			return ByDate{fis, dir}
+		}
+	}
+}
+
+// Adapts a sort order to compare two individual entries:
+func entryLess(order func([]os.FileInfo) sort.Interface) func(a, b os.FileInfo) bool {
+	return func(a, b os.FileInfo) bool {
+		return order([]os.FileInfo{a, b}).Less(0, 1)
+	}
+}
+
+// Directories always sort first; `decided` is false if both or neither are directories:
+func dirsFirst(a, b os.FileInfo) (less bool, decided bool) {
+	if a.IsDir() != b.IsDir() {
+		return a.IsDir(), true
+	}
+	return false, false
+}
+
 // Sort by last modified time:
 type ByDate struct {
 	Entries
@@ -52,3 +156,176 @@ func (s ByDate) Less(i, j int) bool {
 		}
 	}
 }
+
+// Sort by name, comparing runs of digits numerically so `IMG_9` precedes `IMG_10`:
+type ByName struct {
+	Entries
+	dir sortDirection
+}
+
+func (s ByName) Less(i, j int) bool {
+	if less, ok := dirsFirst(s.Entries[i], s.Entries[j]); ok {
+		return less
+	}
+	a, b := s.Entries[i].Name(), s.Entries[j].Name()
+	if s.dir == sortDescending {
+		a, b = b, a
+	}
+	return compareNames(a, b) < 0
+}
+
+// Sort by file size, then name:
+type BySize struct {
+	Entries
+	dir sortDirection
+}
+
+func (s BySize) Less(i, j int) bool {
+	if less, ok := dirsFirst(s.Entries[i], s.Entries[j]); ok {
+		return less
+	}
+	a, b := s.Entries[i], s.Entries[j]
+	if s.dir == sortDescending {
+		a, b = b, a
+	}
+	if a.Size() != b.Size() {
+		return a.Size() < b.Size()
+	}
+	return compareNames(a.Name(), b.Name()) < 0
+}
+
+// Sort by mime type, then name:
+type ByType struct {
+	Entries
+	dir sortDirection
+}
+
+func (s ByType) Less(i, j int) bool {
+	if less, ok := dirsFirst(s.Entries[i], s.Entries[j]); ok {
+		return less
+	}
+	a, b := s.Entries[i].Name(), s.Entries[j].Name()
+	if s.dir == sortDescending {
+		a, b = b, a
+	}
+	if ta, tb := getMimeType(a), getMimeType(b); ta != tb {
+		return ta < tb
+	}
+	return compareNames(a, b) < 0
+}
+
+// Sort by EXIF capture time, falling back to last modified time for pictures without one:
+type ByTaken struct {
+	Entries
+	dir   sortDirection
+	metas map[string]PicMeta
+}
+
+func (s ByTaken) taken(fi os.FileInfo) time.Time {
+	if t := s.metas[fi.Name()].Taken; !t.IsZero() {
+		return t
+	}
+	return fi.ModTime()
+}
+
+func (s ByTaken) Less(i, j int) bool {
+	if less, ok := dirsFirst(s.Entries[i], s.Entries[j]); ok {
+		return less
+	}
+	a, b := s.Entries[i], s.Entries[j]
+	if s.dir == sortDescending {
+		a, b = b, a
+	}
+	if ta, tb := s.taken(a), s.taken(b); !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return compareNames(a.Name(), b.Name()) < 0
+}
+
+// Sort by pixel count; files of unknown dimensions count as zero:
+type ByDimensions struct {
+	Entries
+	dir   sortDirection
+	metas map[string]PicMeta
+}
+
+func (s ByDimensions) pixels(fi os.FileInfo) int64 {
+	m := s.metas[fi.Name()]
+	return int64(m.Width) * int64(m.Height)
+}
+
+func (s ByDimensions) Less(i, j int) bool {
+	if less, ok := dirsFirst(s.Entries[i], s.Entries[j]); ok {
+		return less
+	}
+	a, b := s.Entries[i], s.Entries[j]
+	if s.dir == sortDescending {
+		a, b = b, a
+	}
+	if pa, pb := s.pixels(a), s.pixels(b); pa != pb {
+		return pa < pb
+	}
+	return compareNames(a.Name(), b.Name()) < 0
+}
+
+// Orders names naturally, falling back to byte order so that names differing only in case are still ordered:
+func compareNames(a, b string) int {
+	if c := naturalCompare(a, b); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// Compares strings case-insensitively, treating runs of digits as numbers:
+func naturalCompare(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			// Find the digit runs and skip leading zeros:
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			na := strings.TrimLeft(a[si:i], "0")
+			nb := strings.TrimLeft(b[sj:j], "0")
+
+			// A longer number is bigger; equal lengths compare digit by digit:
+			if len(na) != len(nb) {
+				if len(na) < len(nb) {
+					return -1
+				}
+				return 1
+			}
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return 1
+		}
+		i++
+		j++
+	}
+
+	switch {
+	case len(a)-i < len(b)-j:
+		return -1
+	case len(a)-i > len(b)-j:
+		return 1
+	}
+	return 0
+}
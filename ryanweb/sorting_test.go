@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"a", "", 1},
+		{"IMG_9.jpg", "IMG_10.jpg", -1},
+		{"img_10.jpg", "IMG_9.jpg", 1},
+		{"a2b", "a10a", -1},
+		{"007", "7", 0},
+		{"0", "00", 0},
+		{"x1", "x01", 0},
+		{"abc", "ABC", 0},
+		{"a", "b", -1},
+		{"1", "a", -1},
+		{"photo", "photo1", -1},
+		{"photo 2", "photo 2a", -1},
+		// Longer than any integer type:
+		{"99999999999999999999999", "100000000000000000000000", -1},
+		{"12345678901234567890124", "12345678901234567890123", 1},
+	}
+	for _, tt := range tests {
+		if got := naturalCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := naturalCompare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+// Names that compare equal naturally are still ordered, so sorts and cursors are deterministic:
+func TestCompareNames(t *testing.T) {
+	names := []string{"b", "IMG_10.jpg", "img_9.jpg", "IMG_9.jpg", "img_09.jpg", "Img_9.jpg", "a", "A"}
+	for _, a := range names {
+		for _, b := range names {
+			c := compareNames(a, b)
+			if (c == 0) != (a == b) {
+				t.Errorf("compareNames(%q, %q) = %d", a, b, c)
+			}
+			if compareNames(b, a) != -c {
+				t.Errorf("compareNames(%q, %q) is not antisymmetric", a, b)
+			}
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool { return compareNames(names[i], names[j]) < 0 })
+	want := []string{"A", "a", "b", "IMG_9.jpg", "Img_9.jpg", "img_09.jpg", "img_9.jpg", "IMG_10.jpg"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("sorted %q, want %q", names, want)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		sort, dir string
+		by        sortBy
+		want      sortDirection
+	}{
+		{"", "", sortByDate, sortDescending},
+		{"bogus", "", sortByDate, sortDescending},
+		{"name", "", sortByName, sortAscending},
+		{"type", "", sortByType, sortAscending},
+		{"size", "", sortBySize, sortDescending},
+		{"taken", "asc", sortByTaken, sortAscending},
+		{"name", "desc", sortByName, sortDescending},
+		{"dimensions", "sideways", sortByDimensions, sortDescending},
+	}
+	for _, tt := range tests {
+		if by, dir := parseSort(tt.sort, tt.dir); by != tt.by || dir != tt.want {
+			t.Errorf("parseSort(%q, %q) = %v %v, want %v %v", tt.sort, tt.dir, by, dir, tt.by, tt.want)
+		}
+	}
+}
+
+func TestSortersBreakTies(t *testing.T) {
+	entry := func(name string, size int64, dir bool) os.FileInfo {
+		return (&cursorKey{Name: name, Size: size, Dir: dir}).FileInfo()
+	}
+	fis := []os.FileInfo{entry("b.jpg", 1, false), entry("B.jpg", 1, false), entry("a.png", 2, false), entry("z", 0, true), entry("a.jpg", 1, false)}
+	metas := map[string]PicMeta{"a.png": {Width: 10, Height: 10}}
+	tests := []struct {
+		name string
+		sort func(Entries) sort.Interface
+		want []string
+	}{
+		{"name", func(e Entries) sort.Interface { return ByName{e, sortAscending} }, []string{"z", "a.jpg", "a.png", "B.jpg", "b.jpg"}},
+		{"name desc", func(e Entries) sort.Interface { return ByName{e, sortDescending} }, []string{"z", "b.jpg", "B.jpg", "a.png", "a.jpg"}},
+		{"size", func(e Entries) sort.Interface { return BySize{e, sortAscending} }, []string{"z", "a.jpg", "B.jpg", "b.jpg", "a.png"}},
+		{"size desc", func(e Entries) sort.Interface { return BySize{e, sortDescending} }, []string{"z", "a.png", "b.jpg", "B.jpg", "a.jpg"}},
+		{"type", func(e Entries) sort.Interface { return ByType{e, sortAscending} }, []string{"z", "a.jpg", "B.jpg", "b.jpg", "a.png"}},
+		{"taken", func(e Entries) sort.Interface { return ByTaken{e, sortAscending, metas} }, []string{"z", "a.jpg", "a.png", "B.jpg", "b.jpg"}},
+		{"dimensions desc", func(e Entries) sort.Interface { return ByDimensions{e, sortDescending, metas} }, []string{"z", "a.png", "b.jpg", "B.jpg", "a.jpg"}},
+	}
+	for _, tt := range tests {
+		sorted := append([]os.FileInfo(nil), fis...)
+		sort.Sort(tt.sort(sorted))
+		if got := extractNames(sorted); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
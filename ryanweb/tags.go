@@ -0,0 +1,745 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tags and virtual albums, which group pictures regardless of the directory they live in.
+// Pictures are keyed by their path relative to `picsDir`.
+
+// A named, hand-picked set of pictures:
+type VirtualAlbum struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Files   []string  `json:"files"`
+}
+
+// A copy sharing nothing with the store, safe to use once the lock is released:
+func (a *VirtualAlbum) clone() VirtualAlbum {
+	c := *a
+	c.Files = append([]string{}, a.Files...)
+	return c
+}
+
+// The tags, caption and virtual album memberships of a picture (and anything below it, for directories), kept with trashed files so they can be restored:
+type TagSnapshot struct {
+	Tags     map[string][]string `json:"tags,omitempty"`
+	Captions map[string]string   `json:"captions,omitempty"`
+	Albums   map[string][]string `json:"albums,omitempty"`
+}
+
+// JSON-file backed store of tags, captions and virtual albums; every change is written through immediately:
+type TagStore struct {
+	lock     sync.RWMutex
+	path     string
+	tags     map[string][]string
+	captions map[string]string
+	albums   map[string]*VirtualAlbum
+}
+
+// On-disk format of the store:
+type tagStoreFile struct {
+	Tags     map[string][]string      `json:"tags"`
+	Captions map[string]string        `json:"captions"`
+	Albums   map[string]*VirtualAlbum `json:"albums"`
+}
+
+func NewTagStore(path string) *TagStore {
+	return &TagStore{
+		path:     path,
+		tags:     make(map[string][]string),
+		captions: make(map[string]string),
+		albums:   make(map[string]*VirtualAlbum),
+	}
+}
+
+// Loads the store file; a missing file is not an error:
+func (s *TagStore) Load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f tagStoreFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	if f.Tags == nil {
+		f.Tags = make(map[string][]string)
+	}
+	if f.Captions == nil {
+		f.Captions = make(map[string]string)
+	}
+	if f.Albums == nil {
+		f.Albums = make(map[string]*VirtualAlbum)
+	}
+
+	s.lock.Lock()
+	s.tags, s.captions, s.albums = f.Tags, f.Captions, f.Albums
+	s.lock.Unlock()
+	return nil
+}
+
+// Writes the store atomically; must be called with the lock held:
+func (s *TagStore) save() error {
+	searchIndex.Invalidate()
+
+	b, err := json.Marshal(tagStoreFile{Tags: s.tags, Captions: s.captions, Albums: s.albums})
+	if err != nil {
+		return err
+	}
+
+	tf, err := ioutil.TempFile(filepath.Dir(s.path), ".tags-")
+	if err != nil {
+		return err
+	}
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return err
+	}
+	tf.Close()
+	if err := os.Rename(tf.Name(), s.path); err != nil {
+		os.Remove(tf.Name())
+		return err
+	}
+	return nil
+}
+
+// Tags are case-insensitive single words so they can be typed into queries:
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", fmt.Errorf("empty tag")
+	}
+	if len(tag) > 64 {
+		return "", fmt.Errorf("tag '%s' is longer than 64 characters", tag)
+	}
+	if strings.ContainsAny(tag, " \t\r\n,:\"") {
+		return "", fmt.Errorf("tag '%s' may not contain spaces, commas, colons or quotes", tag)
+	}
+	return tag, nil
+}
+
+// Reports whether `name` is `root` or lies beneath it:
+func underPath(name, root string) bool {
+	return name == root || strings.HasPrefix(name, root+"/")
+}
+
+func addString(list []string, s string) []string {
+	for _, x := range list {
+		if x == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func removeString(list []string, s string) []string {
+	out := list[:0]
+	for _, x := range list {
+		if x != s {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// Returns the sorted tags of a picture:
+func (s *TagStore) Tags(name string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	tags := append([]string(nil), s.tags[name]...)
+	sort.Strings(tags)
+	return tags
+}
+
+func (s *TagStore) HasTag(name, tag string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, t := range s.tags[name] {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TagStore) Caption(name string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.captions[name]
+}
+
+// Returns a copy of all captions keyed by picture:
+func (s *TagStore) Captions() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	all := make(map[string]string, len(s.captions))
+	for name, c := range s.captions {
+		all[name] = c
+	}
+	return all
+}
+
+// Sets a picture's caption; an empty caption removes it:
+func (s *TagStore) SetCaption(name, caption string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if caption == "" {
+		delete(s.captions, name)
+	} else {
+		s.captions[name] = caption
+	}
+	return s.save()
+}
+
+// Returns every tag in use on the pictures passing `visible`, with the number of them carrying it:
+func (s *TagStore) Counts(visible func(name string) bool) map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	counts := make(map[string]int)
+	for name, tags := range s.tags {
+		if !visible(name) {
+			continue
+		}
+		for _, t := range tags {
+			counts[t]++
+		}
+	}
+	return counts
+}
+
+// Returns a copy of all tags keyed by picture:
+func (s *TagStore) All() map[string][]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	all := make(map[string][]string, len(s.tags))
+	for name, tags := range s.tags {
+		all[name] = append([]string(nil), tags...)
+	}
+	return all
+}
+
+func (s *TagStore) AddTags(names, tags []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, name := range names {
+		for _, t := range tags {
+			s.tags[name] = addString(s.tags[name], t)
+		}
+	}
+	return s.save()
+}
+
+func (s *TagStore) RemoveTags(names, tags []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, name := range names {
+		for _, t := range tags {
+			s.tags[name] = removeString(s.tags[name], t)
+		}
+		if len(s.tags[name]) == 0 {
+			delete(s.tags, name)
+		}
+	}
+	return s.save()
+}
+
+// Returns copies of all virtual albums sorted by name:
+func (s *TagStore) Albums() []VirtualAlbum {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	albums := make([]VirtualAlbum, 0, len(s.albums))
+	for _, a := range s.albums {
+		albums = append(albums, a.clone())
+	}
+	sort.Slice(albums, func(i, j int) bool { return albums[i].Name < albums[j].Name })
+	return albums
+}
+
+func (s *TagStore) Album(name string) (VirtualAlbum, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	a, ok := s.albums[name]
+	if !ok {
+		return VirtualAlbum{}, false
+	}
+	return a.clone(), true
+}
+
+// Returns the names of the virtual albums containing a picture:
+func (s *TagStore) AlbumsOf(name string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := make([]string, 0)
+	for _, a := range s.albums {
+		for _, f := range a.Files {
+			if f == name {
+				names = append(names, a.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *TagStore) CreateAlbum(name string) (VirtualAlbum, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.albums[name]; ok {
+		return VirtualAlbum{}, os.ErrExist
+	}
+	a := &VirtualAlbum{Name: name, Created: time.Now().UTC(), Files: []string{}}
+	s.albums[name] = a
+	return a.clone(), s.save()
+}
+
+// Deletes a virtual album; the pictures in it are untouched:
+func (s *TagStore) DeleteAlbum(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.albums[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.albums, name)
+	return s.save()
+}
+
+func (s *TagStore) AddToAlbum(album string, names []string) (VirtualAlbum, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.albums[album]
+	if !ok {
+		return VirtualAlbum{}, os.ErrNotExist
+	}
+	for _, name := range names {
+		a.Files = addString(a.Files, name)
+	}
+	return a.clone(), s.save()
+}
+
+func (s *TagStore) RemoveFromAlbum(album string, names []string) (VirtualAlbum, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.albums[album]
+	if !ok {
+		return VirtualAlbum{}, os.ErrNotExist
+	}
+	for _, name := range names {
+		a.Files = removeString(a.Files, name)
+	}
+	return a.clone(), s.save()
+}
+
+// Follows a picture (or a directory and everything in it) to its new path:
+func (s *TagStore) Rename(from, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, tags := range s.tags {
+		if underPath(name, from) {
+			delete(s.tags, name)
+			s.tags[to+strings.TrimPrefix(name, from)] = tags
+		}
+	}
+	for name, c := range s.captions {
+		if underPath(name, from) {
+			delete(s.captions, name)
+			s.captions[to+strings.TrimPrefix(name, from)] = c
+		}
+	}
+	for _, a := range s.albums {
+		for i, f := range a.Files {
+			if underPath(f, from) {
+				a.Files[i] = to + strings.TrimPrefix(f, from)
+			}
+		}
+	}
+	return s.save()
+}
+
+// Drops a picture (or a directory and everything in it), returning what was dropped; nil if there was nothing:
+func (s *TagStore) Forget(root string) (*TagSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snap := &TagSnapshot{Tags: make(map[string][]string), Captions: make(map[string]string), Albums: make(map[string][]string)}
+	for name, tags := range s.tags {
+		if underPath(name, root) {
+			snap.Tags[name] = tags
+			delete(s.tags, name)
+		}
+	}
+	for name, c := range s.captions {
+		if underPath(name, root) {
+			snap.Captions[name] = c
+			delete(s.captions, name)
+		}
+	}
+	for _, a := range s.albums {
+		kept := make([]string, 0, len(a.Files))
+		for _, f := range a.Files {
+			if underPath(f, root) {
+				snap.Albums[a.Name] = append(snap.Albums[a.Name], f)
+			} else {
+				kept = append(kept, f)
+			}
+		}
+		a.Files = kept
+	}
+	if len(snap.Tags) == 0 && len(snap.Captions) == 0 && len(snap.Albums) == 0 {
+		return nil, nil
+	}
+	return snap, s.save()
+}
+
+// Puts back what `Forget` dropped; virtual albums deleted in the meantime stay deleted:
+func (s *TagStore) Restore(snap *TagSnapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, tags := range snap.Tags {
+		for _, t := range tags {
+			s.tags[name] = addString(s.tags[name], t)
+		}
+	}
+	for name, c := range snap.Captions {
+		if _, ok := s.captions[name]; !ok {
+			s.captions[name] = c
+		}
+	}
+	for album, files := range snap.Albums {
+		a, ok := s.albums[album]
+		if !ok {
+			continue
+		}
+		for _, f := range files {
+			a.Files = addString(a.Files, f)
+		}
+	}
+	return s.save()
+}
+
+// Body of a tag or virtual album request; either JSON or form-encoded with repeated keys:
+type TagRequest struct {
+	Filenames []string `json:"filenames"`
+	Tags      []string `json:"tags"`
+	Caption   string   `json:"caption"`
+	Album     string   `json:"album"`
+}
+
+func parseTagRequest(req *http.Request) (tr TagRequest, err error) {
+	if req.Method != "POST" {
+		return tr, NewHttpError(http.StatusMethodNotAllowed, "Tag operations require POST method", fmt.Errorf("Tag operations require POST method"))
+	}
+
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&tr); err != nil {
+			return tr, NewHttpError(http.StatusBadRequest, "Error parsing JSON request body", err)
+		}
+	} else {
+		if err := req.ParseForm(); err != nil {
+			return tr, NewHttpError(http.StatusBadRequest, "Error parsing form data", err)
+		}
+		tr.Filenames = req.Form["filename"]
+		tr.Tags = req.Form["tag"]
+		tr.Caption = req.Form.Get("caption")
+		tr.Album = req.Form.Get("album")
+	}
+
+	for i, t := range tr.Tags {
+		tag, err := normalizeTag(t)
+		if err != nil {
+			return tr, NewHttpError(http.StatusBadRequest, "Invalid tag", err)
+		}
+		tr.Tags[i] = tag
+	}
+	tr.Caption = strings.TrimSpace(tr.Caption)
+	tr.Album = strings.TrimSpace(tr.Album)
+	return
+}
+
+// Validates the named pictures; with `mustExist`, each must be a file currently in `picsDir`:
+func checkTagFilenames(names []string, mustExist bool) error {
+	if len(names) == 0 {
+		return NewHttpError(http.StatusBadRequest, "Expecting filename values", fmt.Errorf("No filenames given"))
+	}
+	for _, name := range names {
+		if msg := checkPicName(name); msg != "" {
+			return NewHttpError(http.StatusBadRequest, msg, fmt.Errorf("Invalid file name '%s'", name))
+		}
+		if !mustExist {
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(picsDir, name)); err != nil || fi.IsDir() {
+			return NewHttpError(http.StatusNotFound, "File not found", fmt.Errorf("No file '%s'", name))
+		}
+	}
+	return nil
+}
+
+func tagStoreError(err error) error {
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, "Unable to save tags", err)
+	}
+	return nil
+}
+
+type TaggedFile struct {
+	Name    string   `json:"name"`
+	Tags    []string `json:"tags"`
+	Caption string   `json:"caption,omitempty"`
+	Albums  []string `json:"albums"`
+}
+
+func taggedFiles(names []string) []TaggedFile {
+	files := make([]TaggedFile, len(names))
+	for i, name := range names {
+		files[i] = TaggedFile{Name: name, Tags: tagStore.Tags(name), Caption: tagStore.Caption(name), Albums: tagStore.AlbumsOf(name)}
+	}
+	return files
+}
+
+// JSON handler for `/tags`; lists all tags with counts, or a single picture's tags given `filename`:
+func tagsJsonHandler(req *http.Request) (interface{}, error) {
+	if name := req.URL.Query().Get("filename"); name != "" {
+		if err := checkTagFilenames([]string{name}, false); err != nil {
+			return nil, err
+		}
+		if err := requireViewPic(req, name); err != nil {
+			return nil, err
+		}
+		return taggedFiles([]string{name})[0], nil
+	}
+
+	return struct {
+		Tags map[string]int `json:"tags"`
+	}{
+		Tags: tagStore.Counts(func(name string) bool { return canViewAlbum(req, albumOf(name)) }),
+	}, nil
+}
+
+func tagResult(names []string) interface{} {
+	return struct {
+		Success bool         `json:"success"`
+		Files   []TaggedFile `json:"files"`
+	}{
+		Success: true,
+		Files:   taggedFiles(names),
+	}
+}
+
+// JSON handler for `/tags/add`:
+func tagAddJsonHandler(req *http.Request) (interface{}, error) {
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireEditPics(req, tr.Filenames); err != nil {
+		return nil, err
+	}
+	if err := checkTagFilenames(tr.Filenames, true); err != nil {
+		return nil, err
+	}
+	if len(tr.Tags) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting tag values", fmt.Errorf("No tags given"))
+	}
+
+	if err := tagStoreError(tagStore.AddTags(tr.Filenames, tr.Tags)); err != nil {
+		return nil, err
+	}
+	return tagResult(tr.Filenames), nil
+}
+
+// JSON handler for `/tags/remove`:
+func tagRemoveJsonHandler(req *http.Request) (interface{}, error) {
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireEditPics(req, tr.Filenames); err != nil {
+		return nil, err
+	}
+	if err := checkTagFilenames(tr.Filenames, false); err != nil {
+		return nil, err
+	}
+	if len(tr.Tags) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting tag values", fmt.Errorf("No tags given"))
+	}
+
+	if err := tagStoreError(tagStore.RemoveTags(tr.Filenames, tr.Tags)); err != nil {
+		return nil, err
+	}
+	return tagResult(tr.Filenames), nil
+}
+
+// JSON handler for `/caption`; sets the caption of the given pictures, or clears it if empty:
+func captionJsonHandler(req *http.Request) (interface{}, error) {
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireEditPics(req, tr.Filenames); err != nil {
+		return nil, err
+	}
+	if err := checkTagFilenames(tr.Filenames, tr.Caption != ""); err != nil {
+		return nil, err
+	}
+
+	for _, name := range tr.Filenames {
+		if err := tagStoreError(tagStore.SetCaption(name, tr.Caption)); err != nil {
+			return nil, err
+		}
+	}
+	return tagResult(tr.Filenames), nil
+}
+
+// JSON handler for `/valbums`; lists all virtual albums, or a single one given `album`:
+func virtualAlbumsJsonHandler(req *http.Request) (interface{}, error) {
+	if name := req.URL.Query().Get("album"); name != "" {
+		a, ok := tagStore.Album(name)
+		if !ok {
+			return nil, NewHttpError(http.StatusNotFound, "Album not found", fmt.Errorf("No virtual album '%s'", name))
+		}
+		a.Files = visiblePics(req, a.Files)
+		return a, nil
+	}
+
+	// Virtual albums are open to all, but not the pictures in them from albums the requestor may not see:
+	albums := tagStore.Albums()
+	for i := range albums {
+		albums[i].Files = visiblePics(req, albums[i].Files)
+	}
+	return struct {
+		Albums []VirtualAlbum `json:"albums"`
+	}{
+		Albums: albums,
+	}, nil
+}
+
+func virtualAlbumResult(a VirtualAlbum, err error) (interface{}, error) {
+	if os.IsNotExist(err) {
+		return nil, NewHttpError(http.StatusNotFound, "Album not found", fmt.Errorf("No virtual album '%s'", a.Name))
+	}
+	if err := tagStoreError(err); err != nil {
+		return nil, err
+	}
+	return struct {
+		Success bool         `json:"success"`
+		Album   VirtualAlbum `json:"album"`
+	}{
+		Success: true,
+		Album:   a,
+	}, nil
+}
+
+func requireAlbumName(tr TagRequest) (string, error) {
+	if tr.Album == "" {
+		return "", NewHttpError(http.StatusBadRequest, "Expecting album value", fmt.Errorf("No album name given"))
+	}
+	return tr.Album, nil
+}
+
+// JSON handler for `/valbums/create`:
+func virtualAlbumCreateJsonHandler(req *http.Request) (interface{}, error) {
+	if err := requireContributor(req); err != nil {
+		return nil, err
+	}
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	name, err := requireAlbumName(tr)
+	if err != nil {
+		return nil, err
+	}
+	a, err := tagStore.CreateAlbum(name)
+	if os.IsExist(err) {
+		return nil, NewHttpError(http.StatusConflict, "An album with that name already exists", fmt.Errorf("Virtual album '%s' exists", name))
+	}
+	return virtualAlbumResult(a, err)
+}
+
+// JSON handler for `/valbums/delete`:
+func virtualAlbumDeleteJsonHandler(req *http.Request) (interface{}, error) {
+	if err := requireContributor(req); err != nil {
+		return nil, err
+	}
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	name, err := requireAlbumName(tr)
+	if err != nil {
+		return nil, err
+	}
+	if err := tagStore.DeleteAlbum(name); err != nil {
+		return virtualAlbumResult(VirtualAlbum{Name: name}, err)
+	}
+	return struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	}, nil
+}
+
+// JSON handler for `/valbums/add`:
+func virtualAlbumAddJsonHandler(req *http.Request) (interface{}, error) {
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	name, err := requireAlbumName(tr)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireContributor(req); err != nil {
+		return nil, err
+	}
+	for _, f := range tr.Filenames {
+		if err := requireViewPic(req, f); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkTagFilenames(tr.Filenames, true); err != nil {
+		return nil, err
+	}
+
+	a, err := tagStore.AddToAlbum(name, tr.Filenames)
+	a.Name = name
+	return virtualAlbumResult(a, err)
+}
+
+// JSON handler for `/valbums/remove`:
+func virtualAlbumRemoveJsonHandler(req *http.Request) (interface{}, error) {
+	tr, err := parseTagRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	name, err := requireAlbumName(tr)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireContributor(req); err != nil {
+		return nil, err
+	}
+	if err := checkTagFilenames(tr.Filenames, false); err != nil {
+		return nil, err
+	}
+
+	a, err := tagStore.RemoveFromAlbum(name, tr.Filenames)
+	a.Name = name
+	return virtualAlbumResult(a, err)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+		ok   bool
+	}{
+		{"Beach", "beach", true},
+		{"  sunset\t", "sunset", true},
+		{"2024", "2024", true},
+		{"", "", false},
+		{"   ", "", false},
+		{"two words", "", false},
+		{"a,b", "", false},
+		{"camera:pixel", "", false},
+		{`"quoted"`, "", false},
+		{strings.Repeat("x", 64), strings.Repeat("x", 64), true},
+		{strings.Repeat("x", 65), "", false},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTag(tt.tag)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("normalizeTag(%q) = %q, %v", tt.tag, got, err)
+		}
+	}
+}
+
+func TestTagStorePersists(t *testing.T) {
+	p := path.Join(t.TempDir(), ".tags.json")
+	s := NewTagStore(p)
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTags([]string{"a.jpg", "b/c.jpg"}, []string{"beach", "sunset"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveTags([]string{"a.jpg"}, []string{"sunset"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCaption("a.jpg", "At the pier"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAlbum("best"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddToAlbum("best", []string{"b/c.jpg", "a.jpg", "b/c.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewTagStore(p)
+	if err := r.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Tags("a.jpg"); !reflect.DeepEqual(got, []string{"beach"}) {
+		t.Errorf("a.jpg tags %q", got)
+	}
+	if got := r.Tags("b/c.jpg"); !reflect.DeepEqual(got, []string{"beach", "sunset"}) {
+		t.Errorf("b/c.jpg tags %q", got)
+	}
+	if got := r.Caption("a.jpg"); got != "At the pier" {
+		t.Errorf("caption %q", got)
+	}
+	if a, ok := r.Album("best"); !ok || !reflect.DeepEqual(a.Files, []string{"b/c.jpg", "a.jpg"}) {
+		t.Errorf("album %+v %v", a, ok)
+	}
+	if got := r.Counts(func(string) bool { return true }); !reflect.DeepEqual(got, map[string]int{"beach": 2, "sunset": 1}) {
+		t.Errorf("counts %v", got)
+	}
+	if got := r.Counts(func(name string) bool { return !strings.HasPrefix(name, "b/") }); !reflect.DeepEqual(got, map[string]int{"beach": 1}) {
+		t.Errorf("visible counts %v", got)
+	}
+}
+
+func TestTagStoreFollowsFiles(t *testing.T) {
+	s := NewTagStore(path.Join(t.TempDir(), ".tags.json"))
+	s.AddTags([]string{"trip/a.jpg", "trip/b.jpg", "tripod.jpg"}, []string{"x"})
+	s.SetCaption("trip/a.jpg", "A")
+	s.CreateAlbum("best")
+	s.AddToAlbum("best", []string{"trip/a.jpg", "tripod.jpg"})
+
+	if err := s.Rename("trip", "2024/trip"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasTag("trip/a.jpg", "x") || !s.HasTag("2024/trip/a.jpg", "x") || !s.HasTag("tripod.jpg", "x") || s.Caption("2024/trip/a.jpg") != "A" {
+		t.Errorf("after rename: %v", s.All())
+	}
+	if a, _ := s.Album("best"); !reflect.DeepEqual(a.Files, []string{"2024/trip/a.jpg", "tripod.jpg"}) {
+		t.Errorf("album after rename %q", a.Files)
+	}
+
+	snap, err := s.Forget("2024/trip")
+	if err != nil || snap == nil {
+		t.Fatalf("forget: %+v %v", snap, err)
+	}
+	if len(s.Tags("2024/trip/b.jpg")) != 0 || s.Caption("2024/trip/a.jpg") != "" {
+		t.Errorf("after forget: %v", s.All())
+	}
+	if a, _ := s.Album("best"); !reflect.DeepEqual(a.Files, []string{"tripod.jpg"}) {
+		t.Errorf("album after forget %q", a.Files)
+	}
+	if snap, err := s.Forget("nothing"); snap != nil || err != nil {
+		t.Errorf("forgot nothing: %+v %v", snap, err)
+	}
+
+	if err := s.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasTag("2024/trip/b.jpg", "x") || s.Caption("2024/trip/a.jpg") != "A" {
+		t.Errorf("after restore: %v", s.All())
+	}
+	if a, _ := s.Album("best"); len(a.Files) != 2 {
+		t.Errorf("album after restore %q", a.Files)
+	}
+}
+
+// Albums handed out are copies, so they can be used after the lock is released while the store changes:
+func TestTagStoreAlbumCopies(t *testing.T) {
+	s := NewTagStore(path.Join(t.TempDir(), ".tags.json"))
+	s.CreateAlbum("best")
+	a, _ := s.AddToAlbum("best", []string{"a.jpg", "b.jpg", "c.jpg"})
+	s.RemoveFromAlbum("best", []string{"a.jpg"})
+	if !reflect.DeepEqual(a.Files, []string{"a.jpg", "b.jpg", "c.jpg"}) {
+		t.Errorf("returned album changed to %q", a.Files)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := []string{string(rune('d' + i))}
+			for j := 0; j < 50; j++ {
+				a, err := s.AddToAlbum("best", name)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				json.Marshal(a)
+				if a, err = s.RemoveFromAlbum("best", name); err != nil {
+					t.Error(err)
+					return
+				}
+				json.Marshal(a)
+				json.Marshal(s.Albums())
+			}
+		}(i)
+	}
+	wg.Wait()
+	if a, _ := s.Album("best"); !reflect.DeepEqual(a.Files, []string{"b.jpg", "c.jpg"}) {
+		t.Errorf("album ended up with %q", a.Files)
+	}
+}
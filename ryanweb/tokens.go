@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bearer tokens for scripts, sent as `Authorization: Bearer <token>`. Only a hash of each token is stored;
+// the token itself is shown once, when it is created.
+
+// What a token may be used for:
+const (
+	scopeRead   = "read"
+	scopeUpload = "upload"
+	scopeDelete = "delete"
+)
+
+var tokenScopes = []string{scopeRead, scopeUpload, scopeDelete}
+
+// Tokens are recognizable in logs and config files by this prefix:
+const apiTokenPrefix = "rwt_"
+
+type APIToken struct {
+	// Public identifier for listing and revoking; the start of the hash:
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// The account the token acts for:
+	User     string     `json:"user"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	// SHA-256 of the token; tokens are random enough that a slow hash buys nothing:
+	Hash string `json:"hash,omitempty"`
+}
+
+// A copy fit for showing to users:
+func (t APIToken) public() APIToken {
+	t.Hash = ""
+	return t
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenStore struct {
+	lock sync.Mutex
+	path string
+	// By hash:
+	tokens map[string]*APIToken
+	// Set when only last-used times changed; those are saved periodically rather than on every request:
+	dirty bool
+}
+
+var tokenStore *TokenStore
+
+func NewTokenStore(path string) *TokenStore {
+	return &TokenStore{path: path, tokens: make(map[string]*APIToken)}
+}
+
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *TokenStore) Load() error {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*APIToken
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens = make(map[string]*APIToken, len(list))
+	for _, t := range list {
+		s.tokens[t.Hash] = t
+	}
+	return nil
+}
+
+// Must be called with the lock held:
+func (s *TokenStore) save() error {
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tf, err := ioutil.TempFile(filepath.Dir(s.path), ".tokens-")
+	if err != nil {
+		return err
+	}
+	if _, err := tf.Write(b); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return err
+	}
+	tf.Close()
+	// Holds credentials; keep it private:
+	os.Chmod(tf.Name(), 0600)
+	if err := os.Rename(tf.Name(), s.path); err != nil {
+		os.Remove(tf.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Writes the tokens file if last-used times changed since the last save:
+func (s *TokenStore) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// Periodically saves last-used times in the background:
+func (s *TokenStore) SaveEvery(d time.Duration) {
+	go func() {
+		for range time.Tick(d) {
+			if err := s.Save(); err != nil {
+				log.Printf("Could not save tokens '%s'; %s\n", s.path, err)
+			}
+		}
+	}()
+}
+
+// Makes a new token, returning the token itself, which is not stored:
+func (s *TokenStore) Create(user, name string, scopes []string) (string, APIToken, error) {
+	secret := apiTokenPrefix + randomToken()
+	hash := hashAPIToken(secret)
+	t := &APIToken{
+		ID:      hash[:12],
+		Name:    name,
+		User:    user,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Hash:    hash,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokens[hash] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, hash)
+		return "", APIToken{}, err
+	}
+	return secret, t.public(), nil
+}
+
+// Revokes the token with the ID if `user` owns it:
+func (s *TokenStore) Revoke(id, user string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for hash, t := range s.tokens {
+		if t.ID == id && t.User == user {
+			delete(s.tokens, hash)
+			return s.save()
+		}
+	}
+	return os.ErrNotExist
+}
+
+// Lists the tokens `user` owns, oldest first:
+func (s *TokenStore) List(user string) []APIToken {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]APIToken, 0)
+	for _, t := range s.tokens {
+		if t.User == user {
+			list = append(list, t.public())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Looks up a token and records its use; tokens of accounts that no longer exist are refused:
+func (s *TokenStore) Authenticate(secret string) (APIToken, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.lookup(secret)
+	if !ok {
+		return APIToken{}, false
+	}
+	now := time.Now().UTC()
+	t.LastUsed = &now
+	s.dirty = true
+	return *t, true
+}
+
+// Reports whether `secret` is a live token, without counting it as used:
+func (s *TokenStore) Valid(secret string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.lookup(secret)
+	return ok
+}
+
+// Must be called with the lock held:
+func (s *TokenStore) lookup(secret string) (*APIToken, bool) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, false
+	}
+	t, ok := s.tokens[hashAPIToken(secret)]
+	if !ok {
+		return nil, false
+	}
+	if _, ok := accounts.users[t.User]; !ok {
+		return nil, false
+	}
+	return t, true
+}
+
+// Returns the token from an `Authorization: Bearer` header; "" if there is none:
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+type tokenContextKey struct{}
+
+// The API token the request was made with; nil for browser requests:
+func currentToken(req *http.Request) *APIToken {
+	t, _ := req.Context().Value(tokenContextKey{}).(*APIToken)
+	return t
+}
+
+type TokenRequest struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+func parseTokenRequest(req *http.Request) (tr TokenRequest, err error) {
+	if req.Method != "POST" {
+		return tr, NewHttpError(http.StatusMethodNotAllowed, "Token operations require POST method", fmt.Errorf("Token operations require POST method"))
+	}
+
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&tr); err != nil {
+			return tr, NewHttpError(http.StatusBadRequest, "Error parsing JSON request body", err)
+		}
+	} else {
+		if err := req.ParseForm(); err != nil {
+			return tr, NewHttpError(http.StatusBadRequest, "Error parsing form data", err)
+		}
+		tr.ID = req.Form.Get("id")
+		tr.Name = req.Form.Get("name")
+		tr.Scopes = req.Form["scope"]
+	}
+	tr.Name = strings.TrimSpace(tr.Name)
+	return
+}
+
+// Token management is for people signed in with a password; tokens cannot mint more tokens:
+func requireSessionUser(req *http.Request) (string, error) {
+	session := currentSession(req)
+	if session == nil {
+		return "", NewHttpError(http.StatusUnauthorized, "Please sign in first", fmt.Errorf("Token management without a session"))
+	}
+	return session.User, nil
+}
+
+// JSON handler for `/tokens`; lists the signed-in user's tokens:
+func tokensJsonHandler(req *http.Request) (interface{}, error) {
+	user, err := requireSessionUser(req)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Tokens []APIToken `json:"tokens"`
+		// To send as `X-CSRF-Token` when creating or revoking tokens:
+		CSRFToken string `json:"csrfToken"`
+	}{
+		Tokens:    tokenStore.List(user),
+		CSRFToken: currentSession(req).CSRFToken,
+	}, nil
+}
+
+// JSON handler for `/tokens/create`; the response is the only time the token is shown:
+func tokenCreateJsonHandler(req *http.Request) (interface{}, error) {
+	user, err := requireSessionUser(req)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := parseTokenRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if tr.Name == "" {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting a name for the token", fmt.Errorf("No token name given"))
+	}
+	if len(tr.Scopes) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "Expecting scope values", fmt.Errorf("No token scopes given"))
+	}
+	for _, scope := range tr.Scopes {
+		known := false
+		for _, s := range tokenScopes {
+			known = known || scope == s
+		}
+		if !known {
+			return nil, NewHttpError(http.StatusBadRequest, fmt.Sprintf("Unknown scope; expected one of %s", strings.Join(tokenScopes, ", ")), fmt.Errorf("Unknown token scope '%s'", scope))
+		}
+	}
+
+	secret, t, err := tokenStore.Create(user, tr.Name, tr.Scopes)
+	if err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "Could not save token", err)
+	}
+	log.Printf("User '%s' created token '%s' (%s) with scopes %v\n", user, t.Name, t.ID, t.Scopes)
+
+	return struct {
+		Success bool     `json:"success"`
+		Token   string   `json:"token"`
+		Info    APIToken `json:"info"`
+	}{
+		Success: true,
+		Token:   secret,
+		Info:    t,
+	}, nil
+}
+
+// JSON handler for `/tokens/revoke`:
+func tokenRevokeJsonHandler(req *http.Request) (interface{}, error) {
+	user, err := requireSessionUser(req)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := parseTokenRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := tokenStore.Revoke(tr.ID, user); os.IsNotExist(err) {
+		return nil, NewHttpError(http.StatusNotFound, "No such token", fmt.Errorf("User '%s' has no token '%s'", user, tr.ID))
+	} else if err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "Could not save tokens", err)
+	}
+	log.Printf("User '%s' revoked token %s\n", user, tr.ID)
+
+	return struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	}, nil
+}
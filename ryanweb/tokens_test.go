@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTokenStore(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	secret, info, err := tokenStore.Create("bob", "backup", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, apiTokenPrefix) || info.Hash != "" || info.ID == "" {
+		t.Errorf("created %q %+v", secret, info)
+	}
+
+	// Only the hash is stored, privately:
+	fi, err := os.Stat(tokenStore.path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("tokens file %v %v", fi, err)
+	}
+	if b, _ := ioutil.ReadFile(tokenStore.path); strings.Contains(string(b), secret) {
+		t.Error("tokens file holds the token")
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		ok     bool
+	}{
+		{"token", secret, true},
+		{"no prefix", strings.TrimPrefix(secret, apiTokenPrefix), false},
+		{"other token", apiTokenPrefix + "x" + secret[len(apiTokenPrefix)+1:], false},
+		{"prefix only", apiTokenPrefix, false},
+		{"empty", "", false},
+		{"hash", hashAPIToken(secret), false},
+	}
+	for _, tt := range tests {
+		if tokenStore.Valid(tt.secret) != tt.ok {
+			t.Errorf("%s: valid %v", tt.name, !tt.ok)
+		}
+		got, ok := tokenStore.Authenticate(tt.secret)
+		if ok != tt.ok || (ok && (got.User != "bob" || got.LastUsed == nil || !got.HasScope(scopeRead) || got.HasScope(scopeDelete))) {
+			t.Errorf("%s: authenticated %+v %v", tt.name, got, ok)
+		}
+	}
+
+	// Tokens survive restarts, along with when they were last used:
+	if err := tokenStore.Save(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewTokenStore(tokenStore.path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.List("bob"); len(list) != 1 || list[0].ID != info.ID || list[0].LastUsed == nil || list[0].Hash != "" {
+		t.Errorf("reloaded %+v", list)
+	}
+	if list := reloaded.List("ryan"); len(list) != 0 {
+		t.Errorf("ryan has %+v", list)
+	}
+
+	// Only the owner can revoke a token:
+	if err := tokenStore.Revoke(info.ID, "ryan"); !os.IsNotExist(err) {
+		t.Errorf("revoked by another user: %v", err)
+	}
+	if err := tokenStore.Revoke(info.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if tokenStore.Valid(secret) {
+		t.Error("revoked token still valid")
+	}
+}
+
+func TestTokenOfRemovedAccount(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	secret, _, err := tokenStore.Create("bob", "old", []string{scopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(accounts.users, "bob")
+	if _, ok := tokenStore.Authenticate(secret); ok {
+		t.Error("token of a removed account authenticated")
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"Bearer rwt_abc", "rwt_abc"},
+		{"bearer  rwt_abc ", "rwt_abc"},
+		{"Basic cnlhbjpzZWNyZXQ=", ""},
+		{"Bearer ", ""},
+		{"Bearer", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", tt.header)
+		if got := bearerToken(req); got != tt.want {
+			t.Errorf("bearerToken(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestTokenCreateJsonHandler(t *testing.T) {
+	setupTestAccounts(t, testUsers)
+	session := sessions.Create("bob")
+	tests := []struct {
+		name    string
+		form    url.Values
+		session *Session
+		status  int
+	}{
+		{"created", url.Values{"name": {"backup"}, "scope": {scopeRead, scopeUpload}}, session, http.StatusOK},
+		{"no session", url.Values{"name": {"backup"}, "scope": {scopeRead}}, nil, http.StatusUnauthorized},
+		{"no name", url.Values{"name": {"  "}, "scope": {scopeRead}}, session, http.StatusBadRequest},
+		{"no scopes", url.Values{"name": {"backup"}}, session, http.StatusBadRequest},
+		{"unknown scope", url.Values{"name": {"backup"}, "scope": {scopeRead, "admin"}}, session, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/tokens/create", strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.session != nil {
+			req = req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, tt.session))
+		}
+		rec := httptest.NewRecorder()
+		NewJsonHandler(tokenCreateJsonHandler).ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: %d %s", tt.name, rec.Code, rec.Body.String())
+		}
+	}
+	if list := tokenStore.List("bob"); len(list) != 1 || len(list[0].Scopes) != 2 {
+		t.Errorf("bob has %+v", list)
+	}
+}
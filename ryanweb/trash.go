@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long trashed files are kept before being purged automatically; zero keeps them forever:
+var trashRetention time.Duration
+
+// Deleted pictures and thumbnails are moved under these hidden directories:
+func picsTrashDir() string   { return path.Join(picsDir, ".trash") }
+func thumbsTrashDir() string { return path.Join(thumbsDir, ".trash") }
+
+// Describes a deleted file awaiting restore or purge:
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy"`
+	HasThumb  bool      `json:"hasThumb"`
+	// Tags and virtual album memberships to put back on restore:
+	Labels *TagSnapshot `json:"labels,omitempty"`
+}
+
+func newTrashID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// Trash IDs are generated by us; reject anything else to keep paths inside the trash directories:
+func validTrashID(id string) bool {
+	return id != "" && !isHiddenName(id) && !strings.ContainsAny(id, `/\`) && !strings.HasSuffix(id, ".json")
+}
+
+// Identifies the client responsible for a change, for the record; the account if signed in:
+func requestor(req *http.Request) string {
+	if user := currentUser(req); user != "" {
+		return user
+	}
+	return clientIP(req)
+}
+
+// Moves the named picture and its thumbnail into the trash:
+func trashFile(name, deletedBy string) (TrashItem, error) {
+	picPath := path.Join(picsDir, name)
+	fi, err := os.Lstat(picPath)
+	if err != nil {
+		return TrashItem{}, err
+	}
+
+	if err := os.MkdirAll(picsTrashDir(), 0775); err != nil {
+		return TrashItem{}, err
+	}
+	if err := os.MkdirAll(thumbsTrashDir(), 0775); err != nil {
+		return TrashItem{}, err
+	}
+
+	item := TrashItem{
+		ID:        newTrashID(),
+		Name:      name,
+		Size:      fi.Size(),
+		DeletedAt: time.Now().UTC(),
+		DeletedBy: deletedBy,
+	}
+
+	if err := os.Rename(picPath, path.Join(picsTrashDir(), item.ID)); err != nil {
+		return TrashItem{}, err
+	}
+	if err := os.Rename(path.Join(thumbsDir, name), path.Join(thumbsTrashDir(), item.ID)); err == nil {
+		item.HasThumb = true
+	}
+
+	if err := writeTrashItem(item); err != nil {
+		return TrashItem{}, err
+	}
+	return item, nil
+}
+
+func writeTrashItem(item TrashItem) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(picsTrashDir(), item.ID+".json"), b, 0664)
+}
+
+func readTrashItem(id string) (TrashItem, error) {
+	var item TrashItem
+	b, err := ioutil.ReadFile(path.Join(picsTrashDir(), id+".json"))
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(b, &item)
+	return item, err
+}
+
+// Lists the trash, most recently deleted first:
+func listTrash() ([]TrashItem, error) {
+	fis, err := ioutil.ReadDir(picsTrashDir())
+	if os.IsNotExist(err) {
+		return []TrashItem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]TrashItem, 0, len(fis)/2)
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		item, err := readTrashItem(removeSuffix(fi.Name(), ".json"))
+		if err != nil {
+			log.Printf("Could not read trash record '%s'; %s\n", fi.Name(), err)
+			continue
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// Moves a trashed picture back to its original name:
+func restoreTrash(id string) (TrashItem, error) {
+	item, err := readTrashItem(id)
+	if err != nil {
+		return item, err
+	}
+
+	picPath := path.Join(picsDir, item.Name)
+	if _, err := os.Lstat(picPath); err == nil {
+		return item, os.ErrExist
+	}
+	// Recreate the album if it was removed in the meantime:
+	if err := os.MkdirAll(path.Dir(picPath), 0775); err != nil {
+		return item, err
+	}
+	if err := os.Rename(path.Join(picsTrashDir(), id), picPath); err != nil {
+		return item, err
+	}
+	if item.HasThumb {
+		thumbPath := path.Join(thumbsDir, item.Name)
+		os.MkdirAll(path.Dir(thumbPath), 0775)
+		os.Rename(path.Join(thumbsTrashDir(), id), thumbPath)
+	}
+	os.Remove(path.Join(picsTrashDir(), id+".json"))
+
+	return item, nil
+}
+
+// Permanently removes a trashed picture:
+func purgeTrash(id string) error {
+	if err := os.Remove(path.Join(picsTrashDir(), id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(path.Join(thumbsTrashDir(), id))
+	return os.Remove(path.Join(picsTrashDir(), id+".json"))
+}
+
+// Purges trashed pictures older than the retention period:
+func purgeExpiredTrash() {
+	items, err := listTrash()
+	if err != nil {
+		log.Printf("Could not list trash; %s\n", err)
+		return
+	}
+	cutoff := time.Now().Add(-trashRetention)
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+		log.Printf("Purging '%s' deleted at %s\n", item.Name, item.DeletedAt)
+		if err := purgeTrash(item.ID); err != nil {
+			log.Printf("Could not purge trash item '%s'; %s\n", item.ID, err)
+		}
+	}
+}
+
+// Periodically purges expired trash in the background:
+func purgeTrashEvery(d time.Duration) {
+	if trashRetention <= 0 {
+		return
+	}
+	go func() {
+		purgeExpiredTrash()
+		for range time.Tick(d) {
+			purgeExpiredTrash()
+		}
+	}()
+}
+
+// Reads the `id` form value of a POST request naming a trash item:
+func getTrashID(req *http.Request) (string, error) {
+	if req.Method != "POST" {
+		return "", NewHttpError(http.StatusMethodNotAllowed, "Trash operations require POST method", fmt.Errorf("Trash operations require POST method"))
+	}
+	if err := req.ParseForm(); err != nil {
+		return "", NewHttpError(http.StatusBadRequest, "Error parsing form data", err)
+	}
+	id := req.Form.Get("id")
+	if !validTrashID(id) {
+		return "", NewHttpError(http.StatusBadRequest, "Expecting id form value", fmt.Errorf("Invalid trash id '%s'", id))
+	}
+	return id, nil
+}
+
+// JSON handler for `/trash`:
+func trashJsonHandler(req *http.Request) (interface{}, error) {
+	items, err := listTrash()
+	if err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "Unable to list trash", err)
+	}
+
+	// Only items from albums the requestor may see:
+	visible := make([]TrashItem, 0, len(items))
+	for _, item := range items {
+		if canViewAlbum(req, albumOf(item.Name)) {
+			visible = append(visible, item)
+		}
+	}
+
+	return struct {
+		Retention string      `json:"retention"`
+		Items     []TrashItem `json:"items"`
+	}{
+		Retention: trashRetention.String(),
+		Items:     visible,
+	}, nil
+}
+
+// JSON handler for `/trash/restore`:
+func restoreJsonHandler(req *http.Request) (interface{}, error) {
+	id, err := getTrashID(req)
+	if err != nil {
+		return nil, err
+	}
+	if item, err := readTrashItem(id); err == nil {
+		if err := requireEditAlbum(req, albumOf(item.Name)); err != nil {
+			return nil, err
+		}
+	}
+
+	item, err := undeletePic(id)
+	if os.IsExist(err) {
+		return nil, NewHttpError(http.StatusConflict, "A file with the same name already exists", fmt.Errorf("Cannot restore trash item '%s' over existing '%s'", id, item.Name))
+	}
+	if err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, "Unable to restore file", fmt.Errorf("Unable to restore trash item '%s': %s", id, err))
+	}
+	log.Printf("Restored '%s' from trash\n", item.Name)
+
+	return struct {
+		Success bool   `json:"success"`
+		Name    string `json:"name"`
+	}{
+		Success: true,
+		Name:    item.Name,
+	}, nil
+}
+
+// JSON handler for `/trash/purge`:
+func purgeJsonHandler(req *http.Request) (interface{}, error) {
+	id, err := getTrashID(req)
+	if err != nil {
+		return nil, err
+	}
+	// Purging cannot be undone:
+	if err := requireAdmin(req); err != nil {
+		return nil, err
+	}
+
+	if err := purgeTrash(id); err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, "Unable to purge file", fmt.Errorf("Unable to purge trash item '%s': %s", id, err))
+	}
+
+	return struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	}, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeRequiresAdmin(t *testing.T) {
+	setupTestStores(t)
+	setupTestAccounts(t, testUsers)
+	mux := http.NewServeMux()
+	mux.Handle("/trash/purge", NewJsonHandler(purgeJsonHandler))
+	auth := NewAuthHandler(mux)
+	auth.RequireCSRF("/trash/purge")
+
+	tests := []struct {
+		name   string
+		user   string
+		id     string
+		status int
+		code   string
+	}{
+		{"contributor", "bob", "1234-a.jpg", http.StatusForbidden, "forbidden"},
+		{"bad id", "ryan", "../x", http.StatusBadRequest, "bad_request"},
+		{"hidden id", "ryan", ".tags.json", http.StatusBadRequest, "bad_request"},
+		{"missing item", "ryan", "1234-a.jpg", http.StatusBadRequest, "bad_request"},
+	}
+	for _, tt := range tests {
+		session := sessions.Create(tt.user)
+		req := httptest.NewRequest("POST", "/trash/purge", strings.NewReader(url.Values{"id": {tt.id}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", "http://example.com")
+		req.Header.Set("X-CSRF-Token", session.CSRFToken)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session.ID})
+		status, body := serveJson(t, auth, req)
+		if status != tt.status || body.Code != tt.code {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, status, body.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestValidTrashID(t *testing.T) {
+	for id, want := range map[string]bool{newTrashID(): true, "": false, ".tags.json": false, "a/b": false, `a\b`: false, "x.json": false} {
+		if got := validTrashID(id); got != want {
+			t.Errorf("validTrashID(%q) = %v", id, got)
+		}
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	setupTestStores(t)
+	writeTestPic(t, "album/a.jpg", []byte("picture"))
+	thumbPath := path.Join(thumbsDir, "album/a.jpg")
+	if err := os.MkdirAll(path.Dir(thumbPath), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(thumbPath, []byte("thumb"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := trashFile("album/a.jpg", "ryan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.HasThumb || item.Size != 7 || item.DeletedBy != "ryan" {
+		t.Errorf("trashed %+v", item)
+	}
+	for _, p := range []string{path.Join(picsDir, "album/a.jpg"), thumbPath} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("'%s' left in place; %v", p, err)
+		}
+	}
+	items, err := listTrash()
+	if err != nil || len(items) != 1 || items[0].ID != item.ID || items[0].Name != "album/a.jpg" {
+		t.Fatalf("listTrash = %+v %v", items, err)
+	}
+
+	// Nothing is restored over a file that took the name meanwhile:
+	writeTestPic(t, "album/a.jpg", []byte("newer"))
+	if _, err := restoreTrash(item.ID); !os.IsExist(err) {
+		t.Errorf("restored over an existing file; %v", err)
+	}
+	if err := os.RemoveAll(path.Join(picsDir, "album")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The album is recreated as needed:
+	if _, err := restoreTrash(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{path.Join(picsDir, "album/a.jpg"): "picture", thumbPath: "thumb"} {
+		if b, err := ioutil.ReadFile(p); err != nil || string(b) != want {
+			t.Errorf("'%s' restored as %q %v", p, b, err)
+		}
+	}
+	if items, err := listTrash(); err != nil || len(items) != 0 {
+		t.Errorf("trash after restore = %+v %v", items, err)
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	setupTestStores(t)
+	defer func(d time.Duration) { trashRetention = d }(trashRetention)
+	trashRetention = 24 * time.Hour
+
+	writeTestPic(t, "old.jpg", []byte("old"))
+	writeTestPic(t, "new.jpg", []byte("new"))
+	old, err := trashFile("old.jpg", "ryan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trashFile("new.jpg", "ryan"); err != nil {
+		t.Fatal(err)
+	}
+	old.DeletedAt = time.Now().Add(-25 * time.Hour)
+	if err := writeTrashItem(old); err != nil {
+		t.Fatal(err)
+	}
+
+	purgeExpiredTrash()
+	items, err := listTrash()
+	if err != nil || len(items) != 1 || items[0].Name != "new.jpg" {
+		t.Errorf("trash after purging = %+v %v", items, err)
+	}
+	if _, err := os.Lstat(path.Join(picsTrashDir(), old.ID)); !os.IsNotExist(err) {
+		t.Errorf("expired file left in the trash; %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Video formats we know how to serve and describe:
+var videoMimeTypes = map[string]string{
+	".mp4":   "video/mp4",
+	".m4v":   "video/x-m4v",
+	".mov":   "video/quicktime",
+	".mjpg":  "video/x-motion-jpeg",
+	".mjpeg": "video/x-motion-jpeg",
+}
+
+// How long browsers may cache videos before revalidating:
+const videoMaxAge = 24 * time.Hour
+
+func isVideoName(name string) bool {
+	return strings.HasPrefix(getMimeType(name), "video/")
+}
+
+// Reports whether the video is an MP4 or QuickTime movie, whose boxes we can read:
+func isMP4Name(name string) bool {
+	switch getMimeType(name) {
+	case "video/mp4", "video/x-m4v", "video/quicktime":
+		return true
+	default:
+		return false
+	}
+}
+
+// Friendly names of common MP4/MOV sample formats:
+var codecNames = map[string]string{
+	"avc1": "H.264",
+	"avc3": "H.264",
+	"hvc1": "HEVC",
+	"hev1": "HEVC",
+	"av01": "AV1",
+	"vp09": "VP9",
+	"mp4v": "MPEG-4",
+	"jpeg": "Motion JPEG",
+	"mjpa": "Motion JPEG",
+	"apcn": "ProRes",
+	"apch": "ProRes",
+	"apcs": "ProRes",
+	"ap4h": "ProRes",
+	"mp4a": "AAC",
+	"ac-3": "AC-3",
+	"ec-3": "E-AC-3",
+	"Opus": "Opus",
+	"alac": "ALAC",
+	"lpcm": "PCM",
+	"sowt": "PCM",
+	"twos": "PCM",
+}
+
+func codecName(format string) string {
+	if name, ok := codecNames[format]; ok {
+		return name
+	}
+	return strings.TrimSpace(format)
+}
+
+// Describes a video's codecs, e.g. "H.264, AAC":
+func describeCodecs(meta PicMeta) string {
+	parts := make([]string, 0, 2)
+	if meta.VideoCodec != "" {
+		parts = append(parts, codecName(meta.VideoCodec))
+	}
+	if meta.AudioCodec != "" {
+		parts = append(parts, codecName(meta.AudioCodec))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Formats a running time as "m:ss" or "h:mm:ss":
+func formatDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// Serves a video with its proper type, byte-range support for seeking, and validators for caching. Metadata is
+// redacted when `privacy` is on:
+func serveVideo(rsp http.ResponseWriter, req *http.Request, videoPath string, fi os.FileInfo) error {
+	f, err := os.Open(videoPath)
+	if err != nil {
+		return NewHttpError(http.StatusNotFound, "404 Not Found", err)
+	}
+	defer f.Close()
+
+	var content io.ReadSeeker = f
+	if privacy != privacyOff {
+		if !isMP4Name(videoPath) {
+			return NewHttpError(http.StatusForbidden, "Originals of this type are not served while metadata is filtered", fmt.Errorf("No way to redact '%s'", videoPath))
+		}
+		pieces, err := redactMP4(f, fi.Size())
+		if err != nil {
+			return NewHttpError(http.StatusInternalServerError, "Could not filter file metadata", fmt.Errorf("Could not redact '%s'; %s", videoPath, err))
+		}
+		content = newSplicedReader(f, pieces)
+	}
+
+	h := rsp.Header()
+	h.Set("Content-Type", getMimeType(videoPath))
+	h.Set("Accept-Ranges", "bytes")
+	// Anyone may cache videos for a while, unless the caller has restricted caching:
+	switch h.Get("Cache-Control") {
+	case "":
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(videoMaxAge/time.Second)))
+	case "private":
+		h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(videoMaxAge/time.Second)))
+	}
+	// Lets `If-Range` resume downloads safely and `If-None-Match` revalidate:
+	h.Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+
+	http.ServeContent(rsp, req, fi.Name(), fi.ModTime(), content)
+	return nil
+}